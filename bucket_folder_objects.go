@@ -0,0 +1,97 @@
+package gcsext
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/kvanticoss/goutils/gzip"
+	"github.com/kvanticoss/goutils/iterator"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	googleIterator "google.golang.org/api/iterator"
+)
+
+// folderObjectsByPrefix returns an iterator which lists the objects (not their content) under the prefix grouped by
+// folder (path.Dir of the object name). Like FolderReadersByPrefixWithFilter folders are yielded in listing order.
+func folderObjectsByPrefix(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	predicate func(*storage.ObjectAttrs) bool,
+) func() (string, []*storage.ObjectAttrs, error) {
+	q := &storage.Query{
+		Delimiter: "",
+		Prefix:    prefix,
+		Versions:  false,
+	}
+	it := bucket.Objects(ctx, q)
+	predicate = CombineFilters(predicate, FilterOutVirtualGcsFolders, FilterOutCompactionManifests)
+
+	var lastFolderName string
+	var previousBatch []*storage.ObjectAttrs
+	done := false
+
+	return func() (string, []*storage.ObjectAttrs, error) {
+		if err := ctx.Err(); err != nil {
+			return "", nil, err
+		}
+
+		for !done {
+			objAttr, err := it.Next()
+			if err == googleIterator.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				return "", nil, err
+			}
+			if !predicate(objAttr) {
+				continue
+			}
+
+			currentFolder := path.Dir(objAttr.Name)
+			if currentFolder != lastFolderName && previousBatch != nil {
+				folder, res := lastFolderName, previousBatch
+				lastFolderName, previousBatch = currentFolder, []*storage.ObjectAttrs{objAttr}
+				return folder, res, nil
+			}
+			lastFolderName = currentFolder
+			previousBatch = append(previousBatch, objAttr)
+		}
+
+		if previousBatch == nil {
+			return "", nil, iterator.ErrIteratorStop
+		}
+		res := previousBatch
+		previousBatch = nil
+		return lastFolderName, res, nil
+	}
+}
+
+// newObjectReader opens a reader to the exact generation listed in objAttr; gunzipping objects ending with .gz
+func newObjectReader(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	objAttr *storage.ObjectAttrs,
+) (io.ReadCloser, error) {
+	handle := bucket.Object(objAttr.Name)
+	if objAttr.Generation != 0 {
+		handle = handle.Generation(objAttr.Generation)
+	}
+	or, err := handle.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(objAttr.Name, ".gz") {
+		gzr, err := gzip.NewReader(or)
+		if err != nil {
+			or.Close()
+			return nil, err
+		}
+		return gzr, nil
+	}
+	return or, nil
+}
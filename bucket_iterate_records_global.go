@@ -0,0 +1,182 @@
+package gcsext
+
+import (
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/recordbuffer"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	googleIterator "google.golang.org/api/iterator"
+)
+
+// IterateRecordsGloballySorted returns a single RecordIterator yielding every record under the prefix in sorted order;
+// unlike IterateRecordsByFoldersSorted the order holds across folders (assumes each object is saved in sorted order).
+//
+// Objects are listed on the first call but only opened once the merge needs them. At most WithMaxOpenReaders objects are
+// read concurrently; with more objects than that, groups of objects are first merged into intermediate sorted runs
+// (gob encoded into buffers from WithSpillBuffers; temporary files in WithSpillDir by default) which are then merged in
+// turn. The temporary files are removed once the iterator is exhausted or fails.
+func IterateRecordsGloballySorted(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	new func() interface{},
+	predicate func(*storage.ObjectAttrs) bool,
+	opts ...ReadOption,
+) iterator.RecordIterator {
+	cfg := newReadConfig(opts)
+
+	var it iterator.RecordIterator
+	return func() (interface{}, error) {
+		if it == nil {
+			if _, err := cfg.loadTombstones(ctx, bucket, new); err != nil {
+				return nil, err
+			}
+			objects, err := listObjects(ctx, bucket, prefix, CombineFilters(predicate, cfg.notTombstoneObject))
+			if err != nil {
+				return nil, err
+			}
+			if cfg.unsorted == UnsortedExternalSort {
+				sources, cleanup, err := cfg.sortedSources(ctx, bucket, objects, new)
+				if err != nil {
+					return nil, err
+				}
+				if it, err = cfg.mergeBounded(sources, new); err != nil {
+					cleanup()
+					return nil, err
+				}
+				it = cleanupWhenDone(it, cleanup)
+				return it()
+			}
+			sources := make([]iterator.RecordIterator, len(objects))
+			for i, objAttr := range objects {
+				sources[i] = cfg.lazyDecoder(ctx, bucket, objAttr, new)
+			}
+			if it, err = cfg.mergeBounded(sources, new); err != nil {
+				return nil, err
+			}
+		}
+		return it()
+	}
+}
+
+// IterateRecordsGlobally is the type safe version of IterateRecordsGloballySorted; see IterateRecords
+func IterateRecordsGlobally[T any](
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	predicate func(*storage.ObjectAttrs) bool,
+	cmp Comparator[T],
+	opts ...ReadOption,
+) func() (T, error) {
+	it := IterateRecordsGloballySorted(ctx, bucket, prefix, newGeneric[T], predicate, append(opts[:len(opts):len(opts)], genericCompare(cmp))...)
+	return func() (T, error) {
+		rec, err := it()
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		return *rec.(*T), nil
+	}
+}
+
+// listObjects returns the attributes of all (non placeholder) objects under the prefix accepted by the predicate
+func listObjects(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	predicate func(*storage.ObjectAttrs) bool,
+) ([]*storage.ObjectAttrs, error) {
+	q := &storage.Query{
+		Delimiter: "",
+		Prefix:    prefix,
+		Versions:  false,
+	}
+	it := bucket.Objects(ctx, q)
+	predicate = CombineFilters(predicate, FilterOutVirtualGcsFolders, FilterOutCompactionManifests)
+
+	res := []*storage.ObjectAttrs{}
+	for {
+		objAttr, err := it.Next()
+		if err == googleIterator.Done {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if predicate(objAttr) {
+			res = append(res, objAttr)
+		}
+	}
+}
+
+// lazyDecoder returns a decoding RecordIterator which doesn't open the object until the first record is requested
+func (cfg *readConfig) lazyDecoder(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	objAttr *storage.ObjectAttrs,
+	new func() interface{},
+) iterator.RecordIterator {
+	var it iterator.RecordIterator
+	return func() (interface{}, error) {
+		if it == nil {
+			reader, err := newObjectReader(ctx, bucket, objAttr)
+			if err != nil {
+				return nil, err
+			}
+			it = cfg.decoder(objAttr, reader, new)
+		}
+		return it()
+	}
+}
+
+// mergeBounded merges the sorted sources while never reading more than cfg.maxOpenReaders of them at the same time;
+// spilling intermediate runs as needed. Without WithSpillBuffers the runs are spilled to temporary files which are
+// removed once the returned iterator stops.
+func (cfg *readConfig) mergeBounded(sources []iterator.RecordIterator, new func() interface{}) (iterator.RecordIterator, error) {
+	if cfg.spillFactory != nil {
+		return cfg.mergeBoundedWith(cfg.spillFactory, sources, new)
+	}
+
+	buffers := NewTempFileBuffers(cfg.spillDir)
+	cleanup := func() { buffers.Cleanup() }
+	it, err := cfg.mergeBoundedWith(buffers.New, sources, new)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanupWhenDone(it, cleanup), nil
+}
+
+// mergeBoundedWith is mergeBounded spilling into buffers from the spillFactory
+func (cfg *readConfig) mergeBoundedWith(
+	spillFactory recordbuffer.ReadWriteResetterFactory,
+	sources []iterator.RecordIterator,
+	new func() interface{},
+) (iterator.RecordIterator, error) {
+	fanIn := cfg.maxOpenReaders
+	if fanIn < 2 {
+		fanIn = defaultMaxOpenReaders
+	}
+
+	for len(sources) > fanIn {
+		runs := make([]iterator.RecordIterator, 0, len(sources)/fanIn+1)
+		for start := 0; start < len(sources); start += fanIn {
+			end := start + fanIn
+			if end > len(sources) {
+				end = len(sources)
+			}
+			merged, err := mergeSorted(sources[start:end], cfg.comparator())
+			if err != nil {
+				return nil, err
+			}
+			run, err := newSpillRun(spillFactory, merged)
+			if err != nil {
+				return nil, err
+			}
+			runs = append(runs, run.iterator(new))
+		}
+		sources = runs
+	}
+	return cfg.sorted(sources)
+}
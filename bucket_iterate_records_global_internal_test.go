@@ -0,0 +1,72 @@
+package gcsext
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeBoundedLimitsOpenSources(t *testing.T) {
+	open, maxOpen := 0, 0
+	tracked := func(it iterator.RecordIterator) iterator.RecordIterator {
+		started := false
+		return func() (interface{}, error) {
+			if !started {
+				started = true
+				open++
+				if open > maxOpen {
+					maxOpen = open
+				}
+			}
+			rec, err := it()
+			if err == iterator.ErrIteratorStop {
+				open--
+			}
+			return rec, err
+		}
+	}
+
+	sources := []iterator.RecordIterator{
+		tracked(plainRecordIterator(1, 8, 15)),
+		tracked(plainRecordIterator(2, 9)),
+		tracked(plainRecordIterator(3, 10, 16)),
+		tracked(plainRecordIterator(4)),
+		tracked(plainRecordIterator(5, 11)),
+		tracked(plainRecordIterator(0, 6, 12)),
+		tracked(plainRecordIterator(7, 13, 14)),
+	}
+
+	cfg := newReadConfig([]ReadOption{WithMaxOpenReaders(2), withCompare(comparePlainRecords)})
+	it, err := cfg.mergeBounded(sources, func() interface{} { return &plainRecord{} })
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, collectKeys(t, it))
+	assert.Equal(t, 2, maxOpen, "expected no more than 2 sources to be read concurrently")
+}
+
+func TestMergeBoundedSpillsToTemporaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcsext-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sources := []iterator.RecordIterator{
+		plainRecordIterator(1, 4),
+		plainRecordIterator(2, 5),
+		plainRecordIterator(3, 6),
+	}
+	cfg := newReadConfig([]ReadOption{WithMaxOpenReaders(2), WithSpillDir(dir), withCompare(comparePlainRecords)})
+	it, err := cfg.mergeBounded(sources, func() interface{} { return &plainRecord{} })
+	require.NoError(t, err)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.NotEmpty(t, files, "expected the runs to be spilled to the spill dir")
+
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, collectKeys(t, it))
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files, "expected the temporary files to be removed")
+}
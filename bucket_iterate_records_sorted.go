@@ -0,0 +1,119 @@
+package gcsext
+
+import (
+	"github.com/kvanticoss/goutils/iterator"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// IterateRecordsByFoldersSorted works like IterateJSONRecordsByFoldersSorted but decodes each object with the Format
+// matching its suffix (see FormatByName) unless WithFormat is provided. Records from all objects in a folder are merged
+// in sorted order (assumes the record implements the Lesser interface and that each object is saved in sorted order).
+func IterateRecordsByFoldersSorted(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	new func() interface{},
+	predicate func(*storage.ObjectAttrs) bool,
+	opts ...ReadOption,
+) func() (string, interface{}, error) {
+	cfg := newReadConfig(opts)
+
+	// Folder iterator. Will yeild the objects of each folder; readers are opened once the folder is reached
+	folderIt := folderObjectsByPrefix(ctx, bucket, prefix, CombineFilters(predicate, cfg.notTombstoneObject))
+	fetchNextSortedFolderIt := func() (string, iterator.RecordIterator, error) {
+		if _, err := cfg.loadTombstones(ctx, bucket, new); err != nil {
+			return "", nil, err
+		}
+		folder, objects, err := folderIt()
+		if err != nil {
+			return "", nil, err
+		}
+		if cfg.unsorted == UnsortedExternalSort {
+			it, err := cfg.externalSort(ctx, bucket, objects, new)
+			if err != nil {
+				return "", nil, err
+			}
+			return folder, cfg.filtered(cfg.deduplicated(it), nil, nil), nil
+		}
+
+		iterators := make([]iterator.RecordIterator, len(objects))
+		for index, objAttr := range objects {
+			reader, err := newObjectReader(ctx, bucket, objAttr)
+			if err != nil {
+				return "", nil, err
+			}
+			iterators[index] = cfg.decoder(objAttr, reader, new)
+		}
+		it, err := cfg.sorted(iterators)
+		return folder, it, err
+	}
+
+	var currentFolderIterator iterator.RecordIterator
+	var err error
+	var lastRecord interface{}
+	var lastFolder string
+	return func() (string, interface{}, error) {
+		if currentFolderIterator == nil && err == nil {
+			lastFolder, currentFolderIterator, err = fetchNextSortedFolderIt()
+			if err != nil {
+				return "", nil, err
+			}
+		}
+
+		lastRecord, err = currentFolderIterator()
+		for err == iterator.ErrIteratorStop {
+			if lastFolder, currentFolderIterator, err = fetchNextSortedFolderIt(); err != nil {
+				return "", nil, err
+			}
+			lastRecord, err = currentFolderIterator()
+		}
+
+		return lastFolder, lastRecord, err
+	}
+}
+
+// IterateRecordsByFoldersSortedCB works like IterateRecordsByFoldersSorted but through an callback pattern
+func IterateRecordsByFoldersSortedCB(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	new func() interface{},
+	predicate func(*storage.ObjectAttrs) bool,
+	callback func(string, func() (interface{}, error)) error,
+	opts ...ReadOption,
+) error {
+	it := IterateRecordsByFoldersSorted(ctx, bucket, prefix, new, predicate, opts...)
+
+	nextFolder := ""
+	previousFolder, previousRecord, err := it()
+	if err != nil {
+		return err
+	}
+
+	for err == nil {
+		err = callback(previousFolder, func() (interface{}, error) {
+			if nextFolder != previousFolder && nextFolder != "" {
+				err = iterator.ErrIteratorStop
+				return nil, err
+			}
+			defer func() {
+				// Only fetch next if we are clear of errors
+				if err == nil {
+					nextFolder, previousRecord, err = it()
+				}
+			}()
+			return previousRecord, err
+		})
+		if err != nil && err != iterator.ErrIteratorStop {
+			return err
+		}
+		if nextFolder == "" {
+			return err
+		}
+		previousFolder = nextFolder
+		err = nil
+	}
+	return err
+}
@@ -86,7 +86,7 @@ func ReadFoldersByPrefixWithFilter(
 		Versions:  false,
 	}
 	it := bucket.Objects(ctx, q)
-	predicate = CombineFilters(predicate, FilterOutVirtualGcsFolders)
+	predicate = CombineFilters(predicate, FilterOutVirtualGcsFolders, FilterOutCompactionManifests)
 	readerIterator := gcsObjectIteratorToReaderIterator(ctx, bucket, it, predicate)
 
 	type resTuple struct {
@@ -170,7 +170,7 @@ func FolderReadersByPrefixWithFilter(
 		Versions:  false,
 	}
 	it := bucket.Objects(ctx, q)
-	predicate = CombineFilters(predicate, FilterOutVirtualGcsFolders)
+	predicate = CombineFilters(predicate, FilterOutVirtualGcsFolders, FilterOutCompactionManifests)
 	readerIterator := gcsObjectIteratorToReaderIterator(ctx, bucket, it, predicate)
 
 	var lastFolderName string
@@ -0,0 +1,92 @@
+package gcsext
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"golang.org/x/net/context"
+)
+
+// folderLeaseName is the name of the lease object within each folder claimed by a worker (see WithFolderLeases)
+const folderLeaseName = "_gcsext_compaction_lease"
+
+// WithFolderLeases lets several workers (e.g. on different machines) compact the same prefix. Each folder is claimed
+// through a Lock on a lease object in the folder before it is compacted; folders leased by another worker are skipped
+// (see FolderResult.Leased). Leases are renewed every ttl/3 while the folder is compacted and may be taken over by other
+// workers once they haven't been renewed for ttl; should that happen the compaction is cancelled. Writes to the
+// destination are conditional on its generation regardless, so a lost lease never corrupts the destination. See
+// SortGCSFoldersLeased for leases without a Compactor.
+//
+// The ttl should comfortably exceed the latency of a few GCS requests; a minute or more is recommended. A ttl below
+// MinLeaseTTL fails every folder with ErrInvalidLeaseTTL.
+func WithFolderLeases(ttl time.Duration) CompactionOption {
+	return func(c *Compactor) {
+		c.leases, c.leaseTTL = true, ttl
+		if c.leaseOwner == "" {
+			c.leaseOwner = newLeaseOwner()
+		}
+	}
+}
+
+// newLeaseOwner identifies this process as the owner of leases
+func newLeaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), rand.Int63())
+}
+
+func leasePath(folder string) string {
+	return path.Join(folder, folderLeaseName)
+}
+
+// compactLeased returns the result of compact while holding the lease of the folder (see WithFolderLeases). If another
+// worker holds the lease the folder is skipped instead. Without leases compact is just called.
+func (c *Compactor) compactLeased(ctx context.Context, folder string, compact func(ctx context.Context) *FolderResult) *FolderResult {
+	if !c.leases {
+		return compact(ctx)
+	}
+	res := &FolderResult{Folder: folder, Destination: c.destination(folder)}
+	err := c.withFolderLease(ctx, folder, func(ctx context.Context) error {
+		res = compact(ctx)
+		return res.Err
+	})
+	if errors.Is(err, ErrLeaseHeld) {
+		res.Skipped, res.Leased = true, true
+		return res
+	}
+	res.Err = err
+	return res
+}
+
+// withFolderLease calls fn while holding the lease of the folder; fn's context is cancelled if the lease is lost.
+// ErrLeaseHeld is returned, without calling fn, if another worker holds the lease.
+func (c *Compactor) withFolderLease(ctx context.Context, folder string, fn func(ctx context.Context) error) error {
+	if !c.leases {
+		return fn(ctx)
+	}
+	l, err := NewLock(c.bucket, leasePath(folder), c.leaseOwner, c.leaseTTL)
+	if err != nil {
+		return err
+	}
+	if err := l.TryLock(ctx, nil); err != nil {
+		return err
+	}
+
+	leaseCtx, stop := l.KeepAlive(ctx)
+	err = fn(leaseCtx)
+	if lostErr := stop(); lostErr != nil && err != nil {
+		// The error is most likely the cancellation caused by losing the lease; both remain inspectable with errors.Is
+		return fmt.Errorf("%w: %w", lostErr, err)
+	}
+	if releaseErr := l.Release(ctx); releaseErr != nil && !errors.Is(releaseErr, ErrLeaseLost) && err == nil {
+		return errors.Wrap(releaseErr, "failed to release folder lease")
+	}
+	return err
+}
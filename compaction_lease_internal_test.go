@@ -0,0 +1,74 @@
+package gcsext
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestFolderLeasesAreNeverRecords(t *testing.T) {
+	assert.False(t, FilterOutCompactionManifests(&storage.ObjectAttrs{Name: leasePath("prefix/a")}))
+	assert.Equal(t, "prefix/a/"+folderLeaseName, leasePath("prefix/a"))
+}
+
+func TestWithFolderLeases(t *testing.T) {
+	c := NewCompactor(nil, nil, WithFolderLeases(time.Minute))
+	assert.Equal(t, time.Minute, c.leaseTTL)
+	assert.NotEmpty(t, c.leaseOwner)
+	assert.NotEqual(t, c.leaseOwner, NewCompactor(nil, nil, WithFolderLeases(time.Minute)).leaseOwner)
+}
+
+func TestCompactWithShortLeaseTTL(t *testing.T) {
+	c := NewCompactor(nil, nil, WithDestination("sorted.json"), WithFolderLeases(0))
+	res := c.compactLeased(context.Background(), "prefix/a", func(ctx context.Context) *FolderResult {
+		t.Fatal("expected the folder not to be compacted")
+		return nil
+	})
+	assert.True(t, errors.Is(res.Err, ErrInvalidLeaseTTL), "unexpected error %v", res.Err)
+	assert.False(t, res.Leased)
+}
+
+func TestCompactWithoutLeases(t *testing.T) {
+	c := NewCompactor(nil, nil, WithDestination("sorted.json"))
+	res := c.compactLeased(context.Background(), "prefix/a", func(ctx context.Context) *FolderResult {
+		return &FolderResult{Folder: "prefix/a", Records: 3}
+	})
+	assert.Equal(t, &FolderResult{Folder: "prefix/a", Records: 3}, res)
+}
+
+func TestSortFoldersSkipsLeasedFolders(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("f/1.json", 2, 1)
+	fake.putKeys("g/1.json", 2, 1)
+	held := newTestLock(t, bucket, leasePath("f"), "worker-2", time.Minute)
+	require.NoError(t, held.TryLock(ctx, nil))
+
+	err := SortFoldersLeased[plainRecord](ctx, bucket, "", func(a, b plainRecord) int { return a.Key - b.Key }, nil,
+		"sorted.json", nil, nil, false, false, time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, fake.attrs("f/sorted.json"), "expected the leased folder to be skipped")
+	assert.Equal(t, []int{1, 2}, fake.keys(t, "g/sorted.json"))
+	assert.Nil(t, fake.attrs(leasePath("g")), "expected the lease to be released")
+
+	err = SortFoldersLeased[plainRecord](ctx, bucket, "", func(a, b plainRecord) int { return a.Key - b.Key }, nil,
+		"sorted.json", nil, nil, false, false, 0)
+	assert.True(t, errors.Is(err, ErrInvalidLeaseTTL), "unexpected error %v", err)
+}
+
+func TestLostFolderLeaseCancelsCompaction(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	c := NewCompactor(bucket, nil, WithFolderLeases(30*time.Millisecond))
+	err := c.withFolderLease(context.Background(), "f", func(ctx context.Context) error {
+		fake.put(leasePath("f"), "", nil) // Taken over by another worker
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.True(t, errors.Is(err, ErrLeaseLost), "unexpected error %v", err)
+	assert.True(t, errors.Is(err, context.Canceled), "expected the cause to be kept; got %v", err)
+}
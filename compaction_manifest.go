@@ -0,0 +1,340 @@
+package gcsext
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	googleIterator "google.golang.org/api/iterator"
+)
+
+const (
+	// compactionManifestName is the name of the manifest within each folder being compacted
+	compactionManifestName = "_gcsext_compaction_manifest.json"
+	// stagedPartPrefix starts the names of the parts staged by a compaction before they are published (see stagedName)
+	stagedPartPrefix = "_gcsext_staged_"
+	// compactionIDMetadata is the metadata key on compaction outputs identifying the compaction which wrote them; and
+	// thereby the compactionRecord of the sources they have merged
+	compactionIDMetadata = "gcsext-compaction-id"
+
+	manifestPending   = "pending"
+	manifestStaged    = "staged"
+	manifestCommitted = "committed"
+)
+
+// ErrIncompleteCompaction is returned when the staged parts of a compaction could only be published in part; a part was
+// changed by someone else while publishing. The folder needs attention before it is compacted again.
+var ErrIncompleteCompaction = errors.New("compaction could only publish some of its parts")
+
+// CompactionManifest records a compaction in progress; it is written to the folder before the destination is replaced
+// (when sources are removed or the destination is rolled into parts) and removed once all sources have been removed.
+// Parts are staged before they are published under their final names; the manifest records them, and the parts they
+// replace, before any is published. Should the process die in between the next Compact (or Recover) finishes the
+// compaction if the outputs were written, or staged; otherwise it is rolled back.
+type CompactionManifest struct {
+	ID          string            `json:"id"`
+	Folder      string            `json:"folder"`
+	Destination string            `json:"destination"`
+	State       string            `json:"state"` // pending until all outputs are written, or staged; then committed
+	Sources     []PlannedObject   `json:"sources"`
+	Outputs     []PlannedObject   `json:"outputs"`
+	Staged      []*StagedPart     `json:"staged"`
+	Removes     []PlannedObject   `json:"removes"` // Parts no longer needed once the staged parts are published
+	Metadata    map[string]string `json:"metadata"`
+	Created     time.Time         `json:"created"`
+
+	// ReplacedRecords are the IDs of the compaction records no longer referred to by any output once committed
+	ReplacedRecords []string `json:"replaced_records"`
+}
+
+// StagedPart is a part written under a staged name; it is published under its name replacing the part at the given
+// generation (0 for a new part).
+type StagedPart struct {
+	Name       string `json:"name"`
+	Staged     string `json:"staged"`
+	Generation int64  `json:"generation"`
+	Replaces   int64  `json:"replaces"`
+}
+
+// FilterOutCompactionManifests is a predicate function which removes the manifests and staged parts of compactions in
+// progress and the leases of folders claimed by compaction workers; all objects whose names start with _gcsext_
+func FilterOutCompactionManifests(objAttr *storage.ObjectAttrs) bool {
+	return !strings.HasPrefix(path.Base(objAttr.Name), "_gcsext_")
+}
+
+func manifestPath(folder string) string {
+	return path.Join(folder, compactionManifestName)
+}
+
+func newCompactionID() string {
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+}
+
+// Recover finishes or rolls back any compaction under the prefix interrupted by a crash; Compact calls it before
+// compacting when sources are removed or the destination is rolled into parts. With WithFolderLeases, folders leased
+// by another worker are left alone as their compactions might still be in progress.
+func (c *Compactor) Recover(ctx context.Context, prefix string) error {
+	q := &storage.Query{
+		Delimiter: "",
+		Prefix:    prefix,
+		Versions:  false,
+	}
+	it := c.bucket.Objects(ctx, q)
+	for {
+		objAttr, err := it.Next()
+		if err == googleIterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if path.Base(objAttr.Name) != compactionManifestName {
+			continue
+		}
+		folder := path.Dir(objAttr.Name)
+		err = c.withFolderLease(ctx, folder, func(ctx context.Context) error {
+			_, err := c.recoverFolder(ctx, folder)
+			return err
+		})
+		if err != nil && !errors.Is(err, ErrLeaseHeld) {
+			return errors.Wrapf(err, "failed to recover %s", folder)
+		}
+	}
+}
+
+// recoverFolder finishes or rolls back an interrupted compaction of the folder; reporting if there was one
+func (c *Compactor) recoverFolder(ctx context.Context, folder string) (bool, error) {
+	m, generation, err := c.readManifest(ctx, folder)
+	if err != nil || m == nil {
+		return false, err
+	}
+
+	switch m.State {
+	case manifestPending:
+		committed, err := c.outputsCommitted(ctx, m)
+		if err != nil {
+			return false, err
+		}
+		if !committed {
+			return true, c.abortCompaction(ctx, m, generation)
+		}
+	case manifestStaged:
+		if published, err := c.publishStaged(ctx, m); err != nil {
+			if published {
+				return false, err
+			}
+			return true, c.abortCompaction(ctx, m, generation)
+		}
+	}
+	_, err = c.finishCompaction(ctx, m, generation)
+	return true, err
+}
+
+// outputsCommitted reports if the outputs of a pending compaction were written. Parts are only staged while the
+// manifest is pending; they were never published.
+func (c *Compactor) outputsCommitted(ctx context.Context, m *CompactionManifest) (bool, error) {
+	if c.rolling() {
+		return false, nil
+	}
+	objAttr, err := c.bucket.Object(m.Destination).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return objAttr.Metadata[compactionIDMetadata] == m.ID, nil
+}
+
+// readManifest returns the manifest of the folder and its generation; or nil if there is none
+func (c *Compactor) readManifest(ctx context.Context, folder string) (*CompactionManifest, int64, error) {
+	r, err := c.bucket.Object(manifestPath(folder)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read compaction manifest")
+	}
+	defer r.Close()
+
+	m := &CompactionManifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to decode compaction manifest")
+	}
+	return m, r.Attrs.Generation, nil
+}
+
+// writeManifest writes the manifest under the conditions and returns its new generation
+func (c *Compactor) writeManifest(ctx context.Context, m *CompactionManifest, conditions storage.Conditions) (int64, error) {
+	w := newAbortableWriter(ctx, c.bucket.Object(manifestPath(m.Folder)).If(conditions))
+	w.ContentType = "application/json"
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		w.Abort()
+		return 0, errors.Wrap(err, "failed to encode compaction manifest")
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return w.Attrs().Generation, nil
+}
+
+// beginCompaction writes a pending manifest for compacting the sources; the metadata of the outputs is recorded
+// along with the ID of the compaction
+func (c *Compactor) beginCompaction(
+	ctx context.Context,
+	folder, dst string,
+	sources []*storage.ObjectAttrs,
+	metadata map[string]string,
+) (*CompactionManifest, int64, error) {
+	m := &CompactionManifest{
+		ID:          newCompactionID(),
+		Folder:      folder,
+		Destination: dst,
+		State:       manifestPending,
+		Sources:     plannedObjects(sources),
+		Outputs:     []PlannedObject{},
+		Staged:      []*StagedPart{},
+		Removes:     []PlannedObject{},
+		Metadata:    metadata,
+		Created:     time.Now(),
+	}
+	metadata[compactionIDMetadata] = m.ID
+	generation, err := c.writeManifest(ctx, m, storage.Conditions{DoesNotExist: true})
+	return m, generation, err
+}
+
+// stageCompaction records the staged parts, and the parts they make redundant, in the manifest before any is published
+func (c *Compactor) stageCompaction(ctx context.Context, m *CompactionManifest, generation int64, stage *partStage) (int64, error) {
+	m.State = manifestStaged
+	m.Staged = stage.parts
+	m.Removes = plannedObjects(stage.removes)
+	return c.writeManifest(ctx, m, storage.Conditions{GenerationMatch: generation})
+}
+
+// publishStaged copies the staged parts to their names, removes the parts no longer needed and then the staged
+// objects; reporting if any part was published. Parts already published by an earlier attempt are skipped. Should a
+// part have changed since it was staged, after others were published, ErrIncompleteCompaction is returned.
+func (c *Compactor) publishStaged(ctx context.Context, m *CompactionManifest) (bool, error) {
+	published := false
+	fail := func(err error) (bool, error) {
+		if published {
+			return true, fmt.Errorf("%w: compaction %s of %s: %w", ErrIncompleteCompaction, m.ID, m.Folder, err)
+		}
+		return false, err
+	}
+
+	for _, part := range m.Staged {
+		objAttr, err := c.bucket.Object(part.Name).Attrs(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return fail(errors.Wrapf(err, "failed to get the attributes of %s", part.Name))
+		}
+		if err == nil && objAttr.Metadata[compactionIDMetadata] == m.ID {
+			published = true
+			continue
+		}
+
+		conditions := storage.Conditions{DoesNotExist: true}
+		if part.Replaces != 0 {
+			conditions = storage.Conditions{GenerationMatch: part.Replaces}
+		}
+		src := c.bucket.Object(part.Staged).Generation(part.Generation)
+		if _, err := c.bucket.Object(part.Name).If(conditions).CopierFrom(src).Run(ctx); err != nil {
+			return fail(errors.Wrapf(err, "failed to publish %s", part.Name))
+		}
+		published = true
+	}
+
+	// Parts which have changed since they were listed are left alone
+	for _, o := range m.Removes {
+		err := c.bucket.Object(o.Name).If(storage.Conditions{GenerationMatch: o.Generation}).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist && !isPreconditionFailed(err) {
+			return fail(errors.Wrapf(err, "failed to remove part %s", o.Name))
+		}
+	}
+	for _, part := range m.Staged {
+		err := c.bucket.Object(part.Staged).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return fail(errors.Wrapf(err, "failed to remove staged part %s", part.Staged))
+		}
+	}
+	return published, nil
+}
+
+// commitCompaction marks the manifest as committed; recording the outputs written and the compaction records they
+// replaced
+func (c *Compactor) commitCompaction(
+	ctx context.Context,
+	m *CompactionManifest,
+	generation int64,
+	outputs []string,
+	replaced []string,
+) (int64, error) {
+	m.State = manifestCommitted
+	m.ReplacedRecords = replaced
+	for _, name := range outputs {
+		objAttr, err := c.bucket.Object(name).Attrs(ctx)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to get the attributes of %s", name)
+		}
+		m.Outputs = append(m.Outputs, PlannedObject{Name: objAttr.Name, Generation: objAttr.Generation, Size: objAttr.Size})
+	}
+	return c.writeManifest(ctx, m, storage.Conditions{GenerationMatch: generation})
+}
+
+// finishCompaction removes the sources of a committed compaction, the compaction records it replaced and then the
+// manifest. Sources are only removed at the generation which was compacted; sources which have been overwritten since
+// are left for the next compaction and returned.
+func (c *Compactor) finishCompaction(ctx context.Context, m *CompactionManifest, generation int64) ([]string, error) {
+	changed := []string{}
+	for _, o := range m.Sources {
+		err := c.bucket.Object(o.Name).If(storage.Conditions{GenerationMatch: o.Generation}).Delete(ctx)
+		if isPreconditionFailed(err) {
+			changed = append(changed, o.Name)
+			continue
+		}
+		if err != nil && err != storage.ErrObjectNotExist {
+			return changed, errors.Wrapf(err, "failed to remove source %s", o.Name)
+		}
+	}
+	if err := c.removeRecords(ctx, m.Destination, m.ReplacedRecords...); err != nil {
+		return changed, err
+	}
+	return changed, c.removeManifest(ctx, m, generation)
+}
+
+// abortCompaction removes the record of the compaction, the objects it staged and then the manifest
+func (c *Compactor) abortCompaction(ctx context.Context, m *CompactionManifest, generation int64) error {
+	if err := c.removeRecords(ctx, m.Destination, m.ID); err != nil {
+		return err
+	}
+	return c.removeManifest(ctx, m, generation)
+}
+
+// removeManifest removes the objects staged by the compaction and then the manifest
+func (c *Compactor) removeManifest(ctx context.Context, m *CompactionManifest, generation int64) error {
+	// Parts staged by an attempt which died before recording them are found by the compaction ID in their names
+	staged := path.Join(path.Dir(m.Destination), stagedPartPrefix+m.ID+"_")
+	err := forEachRemoval(ctx, c.bucket, staged, nil, func(objAttr *storage.ObjectAttrs) error {
+		err := c.bucket.Object(objAttr.Name).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return errors.Wrapf(err, "failed to remove staged part %s", objAttr.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.bucket.Object(manifestPath(m.Folder)).If(storage.Conditions{GenerationMatch: generation}).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return errors.Wrap(err, "failed to remove compaction manifest")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package gcsext
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCompactionManifestsAreNeverRecords(t *testing.T) {
+	assert.False(t, FilterOutCompactionManifests(&storage.ObjectAttrs{Name: manifestPath("prefix/a")}))
+	assert.True(t, FilterOutCompactionManifests(&storage.ObjectAttrs{Name: "prefix/a/1.json"}))
+	assert.Equal(t, "prefix/a/"+compactionManifestName, manifestPath("prefix/a"))
+}
+
+func TestCompactionManifestSerialization(t *testing.T) {
+	m := &CompactionManifest{
+		ID:          newCompactionID(),
+		Folder:      "prefix/a",
+		Destination: "prefix/a/sorted.json.gz",
+		State:       manifestPending,
+		Sources:     []PlannedObject{{Name: "prefix/a/1.json", Generation: 3, Size: 10}},
+		Outputs:     []PlannedObject{},
+		Staged:      []*StagedPart{{Name: "prefix/a/part-00000.json", Staged: "prefix/a/_gcsext_staged_1_part-00000.json", Generation: 4}},
+		Removes:     []PlannedObject{{Name: "prefix/a/part-00001.json", Generation: 2}},
+		Metadata:    map[string]string{compactionIDMetadata: "1"},
+		Created:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+
+		ReplacedRecords: []string{"0"},
+	}
+	raw, err := json.Marshal(m)
+	require.NoError(t, err)
+
+	decoded := &CompactionManifest{}
+	require.NoError(t, json.Unmarshal(raw, decoded))
+	assert.Equal(t, m, decoded)
+	assert.NotEqual(t, m.ID, newCompactionID())
+}
+
+// putManifest stores the manifest as if a compaction had died while it was in place
+func putManifest(t *testing.T, fake *fakeGCS, m *CompactionManifest) {
+	encoded, err := json.Marshal(m)
+	require.NoError(t, err)
+	fake.put(manifestPath(m.Folder), string(encoded), nil)
+}
+
+func rollingCompactor(bucket *storage.BucketHandle) *Compactor {
+	return NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+		WithDestination("part.json"),
+		WithMaxRecordsPerFile(3),
+		WithSourceRemoval(),
+		WithReadOptions(WithComparator(comparePlainRecords)),
+	)
+}
+
+func TestRecoverRemovesPartsStagedBeforeTheyWereRecorded(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	source := fake.putKeys("f/1.json", 1)
+	fake.putKeys("f/part-00000.json", 0)
+	fake.putKeys("f/_gcsext_staged_x_part-00000.json", 0, 1)
+	putManifest(t, fake, &CompactionManifest{
+		ID:          "x",
+		Folder:      "f",
+		Destination: "f/part.json",
+		State:       manifestPending,
+		Sources:     plannedObjects([]*storage.ObjectAttrs{source}),
+	})
+
+	require.NoError(t, rollingCompactor(bucket).Recover(context.Background(), "f/"))
+	assert.Equal(t, []string{"f/1.json", "f/part-00000.json"}, fake.names())
+	assert.Equal(t, []int{0}, fake.keys(t, "f/part-00000.json"))
+}
+
+func TestRecoverPublishesStagedParts(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	source := fake.putKeys("f/1.json", 1, 2)
+	part := fake.putKeys("f/part-00000.json", 0, 9)
+	removed := fake.putKeys("f/part-00001.json", 10)
+	metadata := map[string]string{compactionIDMetadata: "x"}
+	staged := fake.put("f/_gcsext_staged_x_part-00000.json", `{"key":0}
+{"key":1}
+{"key":2}
+{"key":9}
+`, metadata)
+	putManifest(t, fake, &CompactionManifest{
+		ID:          "x",
+		Folder:      "f",
+		Destination: "f/part.json",
+		State:       manifestStaged,
+		Sources:     plannedObjects([]*storage.ObjectAttrs{source}),
+		Staged: []*StagedPart{
+			{Name: part.Name, Staged: staged.Name, Generation: staged.Generation, Replaces: part.Generation},
+		},
+		Removes:  plannedObjects([]*storage.ObjectAttrs{removed}),
+		Metadata: metadata,
+	})
+	putRecord(t, fake, "f", &compactionRecord{ID: "x", Sources: plannedObjects([]*storage.ObjectAttrs{source})})
+
+	c := rollingCompactor(bucket)
+	it, err := c.readFolder(context.Background(), "f")
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 9}, collectKeys(t, it), "expected reads to see the staged parts")
+
+	require.NoError(t, c.Recover(context.Background(), "f/"))
+	assert.Equal(t, []string{recordPath("f", "x"), "f/part-00000.json"}, fake.names())
+	assert.Equal(t, []int{0, 1, 2, 9}, fake.keys(t, "f/part-00000.json"))
+	assert.Equal(t, "x", fake.attrs("f/part-00000.json").Metadata[compactionIDMetadata])
+}
+
+func TestRecoverReportsPartsChangedWhilePublishing(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	metadata := map[string]string{compactionIDMetadata: "x"}
+	fake.put("f/part-00000.json", `{"key":1}`+"\n", metadata) // Published before the crash
+	fake.putKeys("f/part-00001.json", 5)                      // Replaced by someone else since it was staged
+	staged := fake.putKeys("f/_gcsext_staged_x_part-00001.json", 4, 5)
+	putManifest(t, fake, &CompactionManifest{
+		ID:          "x",
+		Folder:      "f",
+		Destination: "f/part.json",
+		State:       manifestStaged,
+		Staged: []*StagedPart{
+			{Name: "f/part-00000.json", Staged: "f/_gcsext_staged_x_part-00000.json", Generation: 1},
+			{Name: "f/part-00001.json", Staged: staged.Name, Generation: staged.Generation, Replaces: 1},
+		},
+		Metadata: metadata,
+	})
+
+	_, err := rollingCompactor(bucket).recoverFolder(context.Background(), "f")
+	assert.True(t, errors.Is(err, ErrIncompleteCompaction), "unexpected error %v", err)
+	assert.Contains(t, fake.names(), manifestPath("f"), "expected the manifest to be kept")
+	assert.Equal(t, []int{5}, fake.keys(t, "f/part-00001.json"))
+}
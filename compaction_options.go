@@ -0,0 +1,82 @@
+package gcsext
+
+import (
+	"path"
+
+	"github.com/kvanticoss/goutils/backoff"
+	"github.com/kvanticoss/goutils/recordbuffer"
+
+	"cloud.google.com/go/storage"
+)
+
+// CompactionOption configures a Compactor
+type CompactionOption func(*Compactor)
+
+// WithSourcePredicate only compacts (and removes) the objects accepted by the predicate
+func WithSourcePredicate(predicate func(*storage.ObjectAttrs) bool) CompactionOption {
+	return func(c *Compactor) {
+		c.srcPredicate = predicate
+	}
+}
+
+// WithDestination writes the compacted records of each folder to folder/name. If name ends with .gz the contents
+// will be gzipped; the records are encoded in the Format matching the suffix (see FormatByName).
+func WithDestination(name string) CompactionOption {
+	return WithDestinationNaming(func(folder string) string {
+		return path.Join(folder, name)
+	})
+}
+
+// WithDestinationNaming names the destination object of each folder; it should be within the folder
+func WithDestinationNaming(naming func(folder string) string) CompactionOption {
+	return func(c *Compactor) {
+		c.destination = naming
+	}
+}
+
+// WithCacheFactory sets the buffers used for sorting; defaults to RAM. See NewTempFileBuffers for local files.
+func WithCacheFactory(cacheFactory recordbuffer.ReadWriteResetterFactory) CompactionOption {
+	return func(c *Compactor) {
+		if cacheFactory != nil {
+			c.cacheFactory = cacheFactory
+		}
+	}
+}
+
+// WithRetryPolicy sets the backoff used when a folder needs to be compacted again because its objects changed during
+// compaction; each folder starts from a copy of bo. Defaults to 5 re-attempts with at least 15 second sleep intervals.
+func WithRetryPolicy(bo *backoff.RandExpBackoff) CompactionOption {
+	return func(c *Compactor) {
+		c.backoff = bo
+	}
+}
+
+// WithDuplicateRemoval removes duplicated records; see WithDeduplication and WithKeyDeduplication for defining
+// duplicates through WithReadOptions
+func WithDuplicateRemoval() CompactionOption {
+	return func(c *Compactor) {
+		c.removeDuplicates = true
+	}
+}
+
+// WithSourceRemoval removes the source objects once their records has been written to the destination
+func WithSourceRemoval() CompactionOption {
+	return func(c *Compactor) {
+		c.removeSources = true
+	}
+}
+
+// WithConcurrency sets how many folders are compacted concurrently; defaults to 1. Each folder has its own record buffer
+// and retry state; see WithMemoryBudget for bounding the buffers of all workers together.
+func WithConcurrency(workers int) CompactionOption {
+	return func(c *Compactor) {
+		c.concurrency = workers
+	}
+}
+
+// WithReadOptions sets the ReadOptions used when reading the source files; e.g WithFormat or WithSortKey
+func WithReadOptions(opts ...ReadOption) CompactionOption {
+	return func(c *Compactor) {
+		c.readOpts = append(c.readOpts, opts...)
+	}
+}
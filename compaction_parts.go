@@ -0,0 +1,434 @@
+package gcsext
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// WithMaxRecordsPerFile rolls the destination into sequentially numbered parts with at most n records each; for a
+// destination of part.json.gz the parts are named part-00000.json.gz, part-00001.json.gz and so on. The key ranges of
+// the parts never overlap; a part may exceed the limit rather than splitting records which sort as equal.
+func WithMaxRecordsPerFile(n int64) CompactionOption {
+	return func(c *Compactor) {
+		c.maxRecordsPerFile = n
+	}
+}
+
+// WithMaxBytesPerFile rolls the destination into parts (see WithMaxRecordsPerFile) once a part has at least n encoded,
+// uncompressed, bytes.
+func WithMaxBytesPerFile(n int64) CompactionOption {
+	return func(c *Compactor) {
+		c.maxBytesPerFile = n
+	}
+}
+
+// WithIncrementalCompaction merges new records into the existing part covering their key range instead of rewriting
+// all parts; parts without new records are left untouched. Parts rewritten incrementally are not split and may grow
+// beyond the limits; a compaction without this option splits them again.
+func WithIncrementalCompaction() CompactionOption {
+	return func(c *Compactor) {
+		c.incremental = true
+	}
+}
+
+// rolling reports if the destination is split into parts
+func (c *Compactor) rolling() bool {
+	return c.maxRecordsPerFile > 0 || c.maxBytesPerFile > 0
+}
+
+// isDestination reports if the object is the destination, or a part of it, for its folder
+func (c *Compactor) isDestination(name string) bool {
+	dst := c.destination(path.Dir(name))
+	if name == dst {
+		return true
+	}
+	if !c.rolling() {
+		return false
+	}
+	_, ok := partIndex(dst, name)
+	return ok
+}
+
+// partName returns the name of the index'th part of the destination
+func partName(dst string, index int) string {
+	base, ext := splitExt(dst)
+	return fmt.Sprintf("%s-%05d%s", base, index, ext)
+}
+
+// partSuffix matches what partName appends to the base name of the destination
+var partSuffix = regexp.MustCompile(`^-(\d{5,})$`)
+
+// partIndex returns the index of the part if name is a part of the destination
+func partIndex(dst, name string) (int, bool) {
+	base, ext := splitExt(dst)
+	if len(name) < len(base)+len(ext) || !strings.HasPrefix(name, base) || !strings.HasSuffix(name, ext) {
+		return 0, false
+	}
+	m := partSuffix.FindStringSubmatch(name[len(base) : len(name)-len(ext)])
+	if m == nil {
+		return 0, false
+	}
+	index, err := strconv.Atoi(m[1])
+	return index, err == nil
+}
+
+// splitExt splits a path at the first dot of its last element; e.g. folder/part.json.gz into folder/part and .json.gz
+func splitExt(name string) (string, string) {
+	dir, file := path.Split(name)
+	if i := strings.Index(file, "."); i > 0 {
+		return dir + file[:i], file[i:]
+	}
+	return name, ""
+}
+
+// listParts returns the existing parts of the destination ordered by index
+func (c *Compactor) listParts(ctx context.Context, dst string) ([]*storage.ObjectAttrs, error) {
+	objects, err := listObjects(ctx, c.bucket, path.Dir(dst)+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	return partsOf(dst, objects), nil
+}
+
+// partsOf returns the parts of the destination among the objects ordered by index
+func partsOf(dst string, objects []*storage.ObjectAttrs) []*storage.ObjectAttrs {
+	parts := []*storage.ObjectAttrs{}
+	for _, objAttr := range objects {
+		if _, ok := partIndex(dst, objAttr.Name); ok {
+			parts = append(parts, objAttr)
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		a, _ := partIndex(dst, parts[i].Name)
+		b, _ := partIndex(dst, parts[j].Name)
+		return a < b
+	})
+	return parts
+}
+
+// partStage writes the parts of a compaction under staged names (see stagedName) so that no part is replaced before all
+// of them are written. Once the staged parts are recorded in the CompactionManifest they are published under their
+// final names (see publishStaged); a failed attempt thereby leaves the parts as they were and can be retried without
+// merging any records twice.
+type partStage struct {
+	c        *Compactor
+	id       string
+	metadata map[string]string
+	parts    []*StagedPart
+	removes  []*storage.ObjectAttrs // Existing parts no longer needed once the staged parts are published
+}
+
+// newPartStage returns a stage for the parts of a compaction; the metadata is set on all parts
+func (c *Compactor) newPartStage(metadata map[string]string) *partStage {
+	id := metadata[compactionIDMetadata]
+	if id == "" {
+		id = newCompactionID()
+	}
+	return &partStage{c: c, id: id, metadata: metadata}
+}
+
+// stagedName returns the name the part is staged under by the compaction; like manifests staged parts are never listed
+// (see FilterOutCompactionManifests)
+func stagedName(id, name string) string {
+	return path.Join(path.Dir(name), stagedPartPrefix+id+"_"+path.Base(name))
+}
+
+// writer returns a writer staging the part which replaces the generation (0 for a new part)
+func (s *partStage) writer(ctx context.Context, name string, replaces int64) io.WriteCloser {
+	part := &StagedPart{Name: name, Staged: stagedName(s.id, name), Replaces: replaces}
+	w := newAbortableWriter(ctx, s.c.bucket.Object(part.Staged).If(storage.Conditions{DoesNotExist: true}))
+	w.Metadata = s.metadata
+	s.parts = append(s.parts, part)
+	return &stagedWriter{WriteCloser: compressed(w), w: w, part: part}
+}
+
+// stagedWriter records the generation of the staged part once it is written
+type stagedWriter struct {
+	io.WriteCloser
+	w    *abortableWriter
+	part *StagedPart
+}
+
+func (s *stagedWriter) Close() error {
+	if err := s.WriteCloser.Close(); err != nil {
+		return err
+	}
+	s.part.Generation = s.w.Attrs().Generation
+	return nil
+}
+
+func (s *stagedWriter) Abort() {
+	abortWriter(s.WriteCloser)
+}
+
+// discard removes the staged objects and returns err; or the first error removing them
+func (s *partStage) discard(ctx context.Context, err error) error {
+	for _, part := range s.parts {
+		if part.Generation == 0 {
+			continue
+		}
+		delErr := s.c.bucket.Object(part.Staged).If(storage.Conditions{GenerationMatch: part.Generation}).Delete(ctx)
+		if err == nil && delErr != nil && delErr != storage.ErrObjectNotExist {
+			err = errors.Wrapf(delErr, "failed to remove staged part %s", part.Staged)
+		}
+	}
+	return err
+}
+
+// mergeParts is merge for rolling destinations; parts are the existing parts as listed. The new parts are staged and
+// returned for the caller to publish; nil if there were no records to write.
+func (c *Compactor) mergeParts(
+	ctx context.Context,
+	res *FolderResult,
+	sources []*storage.ObjectAttrs,
+	parts []*storage.ObjectAttrs,
+	metadata map[string]string,
+) (*partStage, error) {
+	cfg := c.mergeConfig()
+
+	// Tombstone objects might delete records of any part; all parts are rewritten to apply them
+	if c.incremental && !c.rebuild && len(parts) > 0 && len(cfg.tombstoneKeys) == 0 {
+		return c.mergeIntoParts(ctx, cfg, res, sources, parts, metadata)
+	}
+
+	// Rewrite all parts
+	existing := parts
+	if c.rebuild {
+		existing = nil
+	}
+	runs, err := c.loadSources(ctx, cfg, existing, sources)
+	if err != nil {
+		return nil, err
+	}
+	if runs.len() == 0 {
+		return nil, nil
+	}
+	rIt, err := c.sortedRecords(cfg, res, runs)
+	if err != nil {
+		return nil, err
+	}
+	stage := c.newPartStage(metadata)
+	if err := c.writeParts(ctx, cfg, res, rIt, parts, stage); err != nil {
+		return nil, stage.discard(ctx, err)
+	}
+	// Parts no longer needed are removed once the new ones are published
+	stage.removes = []*storage.ObjectAttrs{}
+	if len(res.Outputs) < len(parts) {
+		stage.removes = parts[len(res.Outputs):]
+	}
+	return stage, nil
+}
+
+// writeParts stages the sorted records as parts numbered from 0; replacing the existing parts at their generation
+func (c *Compactor) writeParts(
+	ctx context.Context,
+	cfg *readConfig,
+	res *FolderResult,
+	it iterator.RecordIterator,
+	parts []*storage.ObjectAttrs,
+	stage *partStage,
+) error {
+	dstFormat := FormatByName(res.Destination)
+	cmp := cfg.comparator()
+
+	var w io.WriteCloser
+	var counter *countingWriter
+	var enc RecordEncoder
+	var partRecords int64
+	var last interface{}
+
+	closePart := func() error {
+		if err := enc.Close(); err != nil {
+			abortWriter(w)
+			return errors.Wrap(err, "failed to flush records to gcsWriter")
+		}
+		enc = nil
+		// Here we can get precondition errors; errors we can retry on
+		return w.Close()
+	}
+	// fail aborts the part being written
+	fail := func(err error) error {
+		if enc != nil {
+			abortWriter(w)
+		}
+		return err
+	}
+
+	var rec interface{}
+	var err error
+	for rec, err = it(); err == nil; rec, err = it() {
+		if enc != nil && c.partFull(partRecords, counter.n) && cmp(last, rec) < 0 {
+			if err := closePart(); err != nil {
+				return err
+			}
+		}
+		if enc == nil {
+			name := partName(res.Destination, len(res.Outputs))
+			var generation int64
+			if len(res.Outputs) < len(parts) {
+				generation = parts[len(res.Outputs)].Generation
+			}
+			w = stage.writer(ctx, name, generation)
+			counter = &countingWriter{w: w}
+			if enc, err = dstFormat.NewEncoder(counter); err != nil {
+				abortWriter(w)
+				return errors.Wrap(err, "failed to create record encoder for gcsWriter")
+			}
+			res.Outputs = append(res.Outputs, name)
+			partRecords = 0
+		}
+
+		if err := enc.Encode(rec); err != nil {
+			return fail(errors.Wrap(err, "failed to write records to gcsWriter"))
+		}
+		partRecords++
+		res.Records++
+		last = rec
+	}
+	if err != iterator.ErrIteratorStop {
+		return fail(errors.Wrap(err, "failed to read sorted records"))
+	}
+	if enc != nil {
+		return closePart()
+	}
+	return nil
+}
+
+// partFull reports if a part has reached the limits
+func (c *Compactor) partFull(records, bytes int64) bool {
+	return (c.maxRecordsPerFile > 0 && records >= c.maxRecordsPerFile) || (c.maxBytesPerFile > 0 && bytes >= c.maxBytesPerFile)
+}
+
+// mergeIntoParts merges the sorted records of the sources into the existing parts covering their key range; staging the
+// parts merged into. A part covers the records from its first record up to the first record of the next part.
+func (c *Compactor) mergeIntoParts(
+	ctx context.Context,
+	cfg *readConfig,
+	res *FolderResult,
+	sources []*storage.ObjectAttrs,
+	parts []*storage.ObjectAttrs,
+	metadata map[string]string,
+) (*partStage, error) {
+	runs, err := c.loadSources(ctx, cfg, nil, sources)
+	if err != nil {
+		return nil, err
+	}
+	if runs.len() == 0 {
+		return nil, nil
+	}
+	sorted, err := runs.sorted(c.newer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get sorted iterator")
+	}
+	stage := c.newPartStage(metadata)
+	if err := c.stageIntoParts(ctx, cfg, res, sorted, parts, stage); err != nil {
+		return nil, stage.discard(ctx, err)
+	}
+	return stage, nil
+}
+
+// stageIntoParts stages the parts covering the key range of the sorted new records with the records merged in
+func (c *Compactor) stageIntoParts(
+	ctx context.Context,
+	cfg *readConfig,
+	res *FolderResult,
+	sorted iterator.RecordIterator,
+	parts []*storage.ObjectAttrs,
+	stage *partStage,
+) error {
+	dstFormat := FormatByName(res.Destination)
+	cmp := cfg.comparator()
+
+	// A constant key; only used to peek at the next record
+	newRecords := newKeyedIterator(c.deduplicated(cfg, sorted), func(interface{}) Key { return nil })
+
+	for i, part := range parts {
+		rec, _, err := newRecords.peek()
+		if err == iterator.ErrIteratorStop {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// The new records belonging to this part
+		var upper interface{}
+		if i+1 < len(parts) {
+			if upper, err = c.firstRecord(ctx, parts[i+1]); err != nil {
+				return err
+			}
+		}
+		if upper != nil && cmp(rec, upper) >= 0 {
+			continue
+		}
+		group := func() (interface{}, error) {
+			rec, _, err := newRecords.peek()
+			if err != nil {
+				return nil, err
+			}
+			if upper != nil && cmp(rec, upper) >= 0 {
+				return nil, iterator.ErrIteratorStop
+			}
+			newRecords.advance()
+			return rec, nil
+		}
+
+		reader, err := newObjectReader(ctx, c.bucket, part)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %s", part.Name)
+		}
+		merged, err := mergeSorted([]iterator.RecordIterator{dstFormat.NewDecoder(reader, c.newer), group}, cmp)
+		if err != nil {
+			reader.Close()
+			return errors.Wrapf(err, "couldn't merge new records into %s", part.Name)
+		}
+		written, err := encodeTo(stage.writer(ctx, part.Name, part.Generation), dstFormat, cfg.filtered(c.deduplicated(cfg, merged), &res.Deleted, &res.Dropped))
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		res.Records += written
+		res.Outputs = append(res.Outputs, part.Name)
+	}
+	return nil
+}
+
+// firstRecord returns the first record of the object; or nil if it is empty
+func (c *Compactor) firstRecord(ctx context.Context, objAttr *storage.ObjectAttrs) (interface{}, error) {
+	reader, err := newObjectReader(ctx, c.bucket, objAttr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", objAttr.Name)
+	}
+	defer reader.Close()
+	rec, err := FormatByName(objAttr.Name).NewDecoder(reader, c.newer)()
+	if err == iterator.ErrIteratorStop {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the first record of %s", objAttr.Name)
+	}
+	return rec, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
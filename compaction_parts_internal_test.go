@@ -0,0 +1,98 @@
+package gcsext
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestPartNames(t *testing.T) {
+	assert.Equal(t, "folder/part-00000.json.gz", partName("folder/part.json.gz", 0))
+	assert.Equal(t, "folder/part-123456", partName("folder/part", 123456))
+	assert.Equal(t, "a.b/sorted-00012.csv", partName("a.b/sorted.csv", 12))
+
+	index, ok := partIndex("folder/part.json.gz", "folder/part-00042.json.gz")
+	assert.True(t, ok)
+	assert.Equal(t, 42, index)
+	for _, name := range []string{"folder/part.json.gz", "folder/part-42.json.gz", "folder/part-00042.json", "other/part-00042.json.gz", "folder/part.gz", "folder/part-00042x.json.gz"} {
+		_, ok := partIndex("folder/part.json.gz", name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestRollingDestinationsAreNotSources(t *testing.T) {
+	c := NewCompactor(nil, nil, WithDestination("part.json.gz"))
+	assert.True(t, c.isDestination("folder/part.json.gz"))
+	assert.False(t, c.isDestination("folder/part-00001.json.gz"))
+
+	c = NewCompactor(nil, nil, WithDestination("part.json.gz"), WithMaxRecordsPerFile(10))
+	assert.True(t, c.isDestination("folder/part-00001.json.gz"))
+	assert.False(t, c.isDestination("folder/raw-00001.json.gz"))
+}
+
+func TestPartFull(t *testing.T) {
+	c := NewCompactor(nil, nil, WithMaxRecordsPerFile(10), WithMaxBytesPerFile(100))
+	assert.False(t, c.partFull(9, 99))
+	assert.True(t, c.partFull(10, 0))
+	assert.True(t, c.partFull(1, 100))
+	assert.False(t, NewCompactor(nil, nil, WithMaxBytesPerFile(100)).partFull(1000, 99))
+}
+
+func TestRetriedPartsAreNotMergedTwice(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("f/1.json", 1, 2, 3, 4, 5)
+	fake.putKeys("f/2.json", 6)
+	failed := false
+	fake.hook = func(op, name string) int {
+		// The second part fails once; after the first part was written
+		if op == "insert" && strings.HasSuffix(name, "part-00001.json") && !failed {
+			failed = true
+			return http.StatusPreconditionFailed
+		}
+		return 0
+	}
+
+	c := NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+		WithDestination("part.json"),
+		WithMaxRecordsPerFile(2),
+		WithRetryPolicy(noBackoff(3)),
+		WithReadOptions(WithComparator(comparePlainRecords)),
+	)
+	res, err := c.Compact(context.Background(), "f/")
+	require.NoError(t, err)
+	require.True(t, failed)
+	assert.Equal(t, 2, res.Folders[0].Attempts)
+	assert.Equal(t, []int{1, 2}, fake.keys(t, "f/part-00000.json"))
+	assert.Equal(t, []int{3, 4}, fake.keys(t, "f/part-00001.json"))
+	assert.Equal(t, []int{5, 6}, fake.keys(t, "f/part-00002.json"))
+	names, records := withoutRecords(fake.names())
+	assert.Equal(t, []string{"f/1.json", "f/2.json", "f/part-00000.json", "f/part-00001.json", "f/part-00002.json"}, names,
+		"expected no staged parts to be left")
+	assert.Equal(t, 1, records, "expected only the record of the compaction which succeeded to be left")
+}
+
+func TestPartsArePublishedOnlyOnceAllAreStaged(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("f/1.json", 1, 2, 3)
+	fake.putKeys("f/part-00000.json", 0)
+	fake.hook = func(op, name string) int {
+		if op == "insert" && strings.HasSuffix(name, "part-00001.json") {
+			return http.StatusForbidden
+		}
+		return 0
+	}
+
+	c := NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+		WithDestination("part.json"),
+		WithMaxRecordsPerFile(2),
+		WithReadOptions(WithComparator(comparePlainRecords)),
+	)
+	_, err := c.Compact(context.Background(), "f/")
+	require.Error(t, err)
+	assert.Equal(t, []int{0}, fake.keys(t, "f/part-00000.json"), "expected the existing part to be untouched")
+	assert.Equal(t, []string{"f/1.json", "f/part-00000.json"}, fake.names())
+}
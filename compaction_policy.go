@@ -0,0 +1,98 @@
+package gcsext
+
+import (
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// CompactionPolicy decides from the listing metadata alone (before any object is read) if a folder should be compacted
+type CompactionPolicy func(folder *FolderListing) bool
+
+// WithCompactionPolicy only compacts the folders accepted by all policies; folders rejected are reported as Skipped.
+// Use AnyPolicy to compact folders accepted by either of several policies.
+func WithCompactionPolicy(policies ...CompactionPolicy) CompactionOption {
+	return func(c *Compactor) {
+		c.policies = append(c.policies, policies...)
+	}
+}
+
+// shouldCompact evaluates the policies for the folder
+func (c *Compactor) shouldCompact(folder *FolderListing) bool {
+	for _, policy := range c.policies {
+		if policy != nil && !policy(folder) {
+			return false
+		}
+	}
+	return true
+}
+
+// AnyPolicy accepts folders accepted by at least one of the policies
+func AnyPolicy(policies ...CompactionPolicy) CompactionPolicy {
+	return func(folder *FolderListing) bool {
+		for _, policy := range policies {
+			if policy(folder) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MinSmallFiles accepts folders with at least n source objects smaller than smallerThan bytes
+func MinSmallFiles(n int, smallerThan int64) CompactionPolicy {
+	return func(folder *FolderListing) bool {
+		small := 0
+		for _, objAttr := range folder.Sources {
+			if objAttr.Size < smallerThan {
+				small++
+			}
+		}
+		return small >= n
+	}
+}
+
+// MinSourceFiles accepts folders with at least n source objects
+func MinSourceFiles(n int) CompactionPolicy {
+	return func(folder *FolderListing) bool {
+		return len(folder.Sources) >= n
+	}
+}
+
+// MinTotalBytes accepts folders where the source objects are at least n bytes in total
+func MinTotalBytes(n int64) CompactionPolicy {
+	return func(folder *FolderListing) bool {
+		var total int64
+		for _, objAttr := range folder.Sources {
+			total += objAttr.Size
+		}
+		return total >= n
+	}
+}
+
+// NewestOlderThan accepts folders where no source object has been updated within age; i.e. folders which are no longer
+// written to
+func NewestOlderThan(age time.Duration) CompactionPolicy {
+	return func(folder *FolderListing) bool {
+		return folder.Now.Sub(newestUpdated(folder.Sources)) >= age
+	}
+}
+
+// NewerThanLastCompaction accepts folders with source objects not yet compacted (and folders never compacted). Outputs
+// record the sources they compacted at their generation (see compactionRecord); sources written or rewritten since are
+// compacted next time, whatever the clocks of the writers say.
+func NewerThanLastCompaction() CompactionPolicy {
+	return func(folder *FolderListing) bool {
+		return len(folder.Outputs) == 0 || len(folder.Sources) > 0
+	}
+}
+
+func newestUpdated(objects []*storage.ObjectAttrs) time.Time {
+	var newest time.Time
+	for _, objAttr := range objects {
+		if objAttr.Updated.After(newest) {
+			newest = objAttr.Updated
+		}
+	}
+	return newest
+}
@@ -0,0 +1,43 @@
+package gcsext_test
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	gcsext "github.com/kvanticoss/google-cloudstorage-ext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactionPolicies(t *testing.T) {
+	now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	folder := &gcsext.FolderListing{
+		Folder: "prefix/2020-01-01",
+		Sources: []*storage.ObjectAttrs{
+			{Name: "prefix/2020-01-01/a.json", Size: 10, Updated: now.Add(-2 * time.Hour)},
+			{Name: "prefix/2020-01-01/b.json", Size: 20, Updated: now.Add(-time.Hour)},
+			{Name: "prefix/2020-01-01/c.json", Size: 1000, Updated: now.Add(-3 * time.Hour)},
+		},
+		Outputs: []*storage.ObjectAttrs{
+			{Name: "prefix/2020-01-01/sorted.json.gz", Size: 5000, Updated: now.Add(-90 * time.Minute)},
+		},
+		Now: now,
+	}
+
+	assert.True(t, gcsext.MinSmallFiles(2, 100)(folder))
+	assert.False(t, gcsext.MinSmallFiles(3, 100)(folder))
+	assert.True(t, gcsext.MinSourceFiles(3)(folder))
+	assert.False(t, gcsext.MinSourceFiles(4)(folder))
+	assert.True(t, gcsext.MinTotalBytes(1030)(folder))
+	assert.False(t, gcsext.MinTotalBytes(1031)(folder))
+	assert.True(t, gcsext.NewestOlderThan(time.Hour)(folder))
+	assert.False(t, gcsext.NewestOlderThan(61*time.Minute)(folder))
+	assert.True(t, gcsext.NewerThanLastCompaction()(folder))
+	assert.True(t, gcsext.AnyPolicy(gcsext.MinSourceFiles(10), gcsext.MinTotalBytes(1))(folder))
+	assert.False(t, gcsext.AnyPolicy(gcsext.MinSourceFiles(10), gcsext.MinTotalBytes(1e6))(folder))
+
+	folder.Compacted, folder.Sources = folder.Sources, nil
+	assert.False(t, gcsext.NewerThanLastCompaction()(folder))
+	folder.Outputs = nil
+	assert.True(t, gcsext.NewerThanLastCompaction()(folder))
+}
@@ -0,0 +1,173 @@
+package gcsext
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"golang.org/x/net/context"
+)
+
+// CompactionError is returned when one or more folders failed to compact; the folders are in name order
+type CompactionError struct {
+	Folders []*FolderResult
+}
+
+func (e *CompactionError) Error() string {
+	msgs := make([]string, len(e.Folders))
+	for i, res := range e.Folders {
+		msgs[i] = fmt.Sprintf("%s: %v", res.Folder, res.Err)
+	}
+	return fmt.Sprintf("failed to compact %d folder(s): %s", len(e.Folders), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of all failed folders (for errors.Is and errors.As)
+func (e *CompactionError) Unwrap() []error {
+	res := make([]error, len(e.Folders))
+	for i, folder := range e.Folders {
+		res[i] = folder.Err
+	}
+	return res
+}
+
+// WithMemoryBudget limits the memory used by all workers together. Before a folder is compacted its size (the size of
+// its objects) is reserved from the budget and it only starts once enough of the budget is available; folders larger
+// than the budget reserve all of it and run alone. Folders are started in listing order. Note that it is an estimate;
+// compressed objects need more memory than their size unless WithCacheFactory spills to disk.
+func WithMemoryBudget(bytes int64) CompactionOption {
+	return func(c *Compactor) {
+		c.memoryBudget = bytes
+	}
+}
+
+// folderTask is a folder to compact and the memory it needs
+type folderTask struct {
+	folder  string
+	weight  int64
+	compact func() *FolderResult
+}
+
+// runFolders compacts the folders returned by next (until iterator.ErrIteratorStop) using up to WithConcurrency workers
+// within the memory budget. Folders start as soon as next returns them; each has its own record buffer and retry state.
+// If the context is cancelled the folders not yet started fail with its error. If next fails no more folders are
+// started and its error is returned once the started folders are done. The results are sorted by folder.
+func (c *Compactor) runFolders(ctx context.Context, next func() (*folderTask, error)) ([]*FolderResult, error) {
+	results := []*FolderResult{}
+	mu := sync.Mutex{}
+	workers := c.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	budget := newMemoryBudget(c.memoryBudget)
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	var err error
+	for {
+		var task *folderTask
+		if task, err = next(); err != nil {
+			break
+		}
+		sem <- struct{}{}
+		reserved := budget.acquire(task.weight)
+		if err := ctx.Err(); err != nil {
+			budget.release(reserved)
+			<-sem
+			mu.Lock()
+			results = append(results, &FolderResult{Folder: task.folder, Err: err})
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				budget.release(reserved)
+				<-sem
+				wg.Done()
+			}()
+			res := task.compact()
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Folder < results[j].Folder })
+	if err == iterator.ErrIteratorStop {
+		err = nil
+	}
+	return results, err
+}
+
+// folderTasks returns the tasks as a task producer for runFolders
+func folderTasks(tasks []*folderTask) func() (*folderTask, error) {
+	return func() (*folderTask, error) {
+		if len(tasks) == 0 {
+			return nil, iterator.ErrIteratorStop
+		}
+		task := tasks[0]
+		tasks = tasks[1:]
+		return task, nil
+	}
+}
+
+// collectResults returns the results and a *CompactionError if any folder failed
+func collectResults(results []*FolderResult) (*CompactionResult, error) {
+	result := &CompactionResult{Folders: results}
+	failed := []*FolderResult{}
+	for _, res := range results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	if len(failed) > 0 {
+		return result, &CompactionError{Folders: failed}
+	}
+	return result, nil
+}
+
+// memoryBudget is a weighted semaphore; a nil budget is unlimited
+type memoryBudget struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	total     int64
+	available int64
+}
+
+func newMemoryBudget(total int64) *memoryBudget {
+	if total <= 0 {
+		return nil
+	}
+	b := &memoryBudget{total: total, available: total}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n (at most the total) is available and returns the amount reserved
+func (b *memoryBudget) acquire(n int64) int64 {
+	if b == nil {
+		return 0
+	}
+	if n > b.total {
+		n = b.total
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.available < n {
+		b.cond.Wait()
+	}
+	b.available -= n
+	return n
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.available += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
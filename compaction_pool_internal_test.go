@@ -0,0 +1,79 @@
+package gcsext
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestRunFoldersIsDeterministic(t *testing.T) {
+	folders := []string{"a", "b", "c", "d", "e", "f"}
+	weights := []int64{5, 5, 10, 20, 1, 1}
+	errBroken := errors.New("broken")
+
+	c := NewCompactor(nil, nil, WithConcurrency(3), WithMemoryBudget(10))
+	mu := sync.Mutex{}
+	inUse, maxInUse := int64(0), int64(0)
+	compactFolder := func(i int) *FolderResult {
+		reserved := weights[i]
+		if reserved > 10 {
+			reserved = 10
+		}
+		mu.Lock()
+		inUse += reserved
+		if inUse > maxInUse {
+			maxInUse = inUse
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Duration(len(folders)-i) * time.Millisecond)
+
+		mu.Lock()
+		inUse -= reserved
+		mu.Unlock()
+		res := &FolderResult{Folder: folders[i]}
+		if i%2 == 1 {
+			res.Err = fmt.Errorf("%w %d", errBroken, i)
+		}
+		return res
+	}
+	tasks := make([]*folderTask, len(folders))
+	for i := range folders {
+		i := i
+		tasks[i] = &folderTask{folder: folders[i], weight: weights[i], compact: func() *FolderResult {
+			return compactFolder(i)
+		}}
+	}
+	// Listed in reverse; results are still sorted by folder
+	for i, j := 0, len(tasks)-1; i < j; i, j = i+1, j-1 {
+		tasks[i], tasks[j] = tasks[j], tasks[i]
+	}
+	results, err := c.runFolders(context.Background(), folderTasks(tasks))
+	require.NoError(t, err)
+	assert.LessOrEqual(t, maxInUse, int64(10), "expected the memory budget to be respected")
+
+	res, err := collectResults(results)
+	for i, folder := range res.Folders {
+		assert.Equal(t, folders[i], folder.Folder)
+	}
+	require.Error(t, err)
+	assert.Equal(t, "failed to compact 3 folder(s): b: broken 1; d: broken 3; f: broken 5", err.Error())
+	assert.True(t, errors.Is(err, errBroken))
+}
+
+func TestRunFoldersCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := NewCompactor(nil, nil).runFolders(ctx, folderTasks([]*folderTask{{folder: "a", compact: func() *FolderResult {
+		t.Fatal("expected no folder to start")
+		return nil
+	}}}))
+	require.NoError(t, err)
+	assert.Equal(t, []*FolderResult{{Folder: "a", Err: context.Canceled}}, results)
+}
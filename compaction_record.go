@@ -0,0 +1,147 @@
+package gcsext
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// compactionRecordPrefix starts the names of the compaction records next to the outputs (see compactionRecord)
+const compactionRecordPrefix = "_gcsext_compacted_"
+
+// compactionRecord lists the sources merged into the outputs of a compaction; the outputs refer to it by the ID of the
+// compaction in their metadata (see compactionIDMetadata). It is written before any output and never changed, so the
+// outputs always agree with the record they refer to. A source is compacted, and skipped by later compactions and by
+// Read, only if the outputs refer to a record holding it at its current generation; no clocks are compared. Likewise
+// tombstone objects are only removed once the records of all outputs hold them (see tombstonesApplied).
+//
+// Records are cumulative: the sources compacted earlier, and still listed, are carried over from the records of the
+// outputs replaced. Records no longer referred to by any output are removed once the compaction is done.
+type compactionRecord struct {
+	ID         string          `json:"id"`
+	Sources    []PlannedObject `json:"sources"`    // The sources merged into the outputs, at the generation merged
+	Tombstones []PlannedObject `json:"tombstones"` // The tombstone objects applied to the outputs written
+}
+
+// sourceGeneration identifies a source at a generation
+type sourceGeneration struct {
+	name       string
+	generation int64
+}
+
+func recordPath(dir, id string) string {
+	return path.Join(dir, compactionRecordPrefix+id+".json")
+}
+
+// compactionIDs returns the IDs of the compactions which wrote the outputs; outputs written without one are left out
+func compactionIDs(outputs []*storage.ObjectAttrs) map[string]string {
+	ids := map[string]string{}
+	for _, objAttr := range outputs {
+		if id := objAttr.Metadata[compactionIDMetadata]; id != "" {
+			ids[id] = path.Dir(objAttr.Name)
+		}
+	}
+	return ids
+}
+
+// readRecords returns the records the outputs refer to by the ID of their compaction. Outputs without a record (e.g.
+// written before records were kept) have compacted nothing.
+func (c *Compactor) readRecords(ctx context.Context, outputs []*storage.ObjectAttrs) (map[string]*compactionRecord, error) {
+	records := map[string]*compactionRecord{}
+	for id, dir := range compactionIDs(outputs) {
+		name := recordPath(dir, id)
+		r, err := c.bucket.Object(name).NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read compaction record %s", name)
+		}
+		record := &compactionRecord{}
+		err = json.NewDecoder(r).Decode(record)
+		r.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode compaction record %s", name)
+		}
+		records[id] = record
+	}
+	return records, nil
+}
+
+// compactedSources returns the sources, at their generation, merged into the outputs of the records
+func compactedSources(records map[string]*compactionRecord) map[sourceGeneration]bool {
+	compacted := map[sourceGeneration]bool{}
+	for _, record := range records {
+		for _, o := range record.Sources {
+			compacted[sourceGeneration{o.Name, o.Generation}] = true
+		}
+	}
+	return compacted
+}
+
+// newRecord returns the record of compacting the listing; the sources merged along with those compacted earlier
+func (c *Compactor) newRecord(id string, f *FolderListing) *compactionRecord {
+	record := &compactionRecord{ID: id, Sources: []PlannedObject{}, Tombstones: plannedObjects(c.tombstones)}
+	seen := map[sourceGeneration]bool{}
+	for _, o := range append(f.carried[:len(f.carried):len(f.carried)], plannedObjects(c.merged(f))...) {
+		if key := (sourceGeneration{o.Name, o.Generation}); !seen[key] {
+			seen[key] = true
+			record.Sources = append(record.Sources, o)
+		}
+	}
+	return record
+}
+
+// writeRecord writes the record of a compaction of the destination before any of its outputs
+func (c *Compactor) writeRecord(ctx context.Context, dst string, record *compactionRecord) error {
+	w := newAbortableWriter(ctx, c.bucket.Object(recordPath(path.Dir(dst), record.ID)).If(storage.Conditions{DoesNotExist: true}))
+	w.ContentType = "application/json"
+	if err := json.NewEncoder(w).Encode(record); err != nil {
+		w.Abort()
+		return errors.Wrap(err, "failed to encode compaction record")
+	}
+	return errors.Wrap(w.Close(), "failed to write compaction record")
+}
+
+// removeRecords removes the records of the compactions with the IDs
+func (c *Compactor) removeRecords(ctx context.Context, dst string, ids ...string) error {
+	for _, id := range ids {
+		err := c.bucket.Object(recordPath(path.Dir(dst), id)).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return errors.Wrapf(err, "failed to remove compaction record %s", id)
+		}
+	}
+	return nil
+}
+
+// replacedRecords returns the IDs of the records which the outputs listed referred to and the outputs after the
+// compaction don't; the outputs kept are those listed which the compaction neither replaced nor removed
+func replacedRecords(listed []*storage.ObjectAttrs, written []string, stage *partStage, id string) []string {
+	kept := []*storage.ObjectAttrs{}
+	replaced := map[string]bool{}
+	for _, name := range written {
+		replaced[name] = true
+	}
+	if stage != nil {
+		for _, objAttr := range stage.removes {
+			replaced[objAttr.Name] = true
+		}
+	}
+	for _, objAttr := range listed {
+		if !replaced[objAttr.Name] {
+			kept = append(kept, objAttr)
+		}
+	}
+	referred := compactionIDs(kept)
+	res := []string{}
+	for old := range compactionIDs(listed) {
+		if _, ok := referred[old]; !ok && old != id {
+			res = append(res, old)
+		}
+	}
+	return res
+}
@@ -0,0 +1,104 @@
+package gcsext
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// putRecord stores the compaction record in the folder as if the compaction had written it
+func putRecord(t *testing.T, fake *fakeGCS, folder string, record *compactionRecord) {
+	encoded, err := json.Marshal(record)
+	require.NoError(t, err)
+	fake.put(recordPath(folder, record.ID), string(encoded), nil)
+}
+
+// withoutRecords returns the names which aren't compaction records along with the number of records
+func withoutRecords(names []string) ([]string, int) {
+	res, records := []string{}, 0
+	for _, name := range names {
+		if strings.HasPrefix(name[strings.LastIndex(name, "/")+1:], compactionRecordPrefix) {
+			records++
+			continue
+		}
+		res = append(res, name)
+	}
+	return res, records
+}
+
+func TestCompactionRecordsAreNeverRecords(t *testing.T) {
+	assert.False(t, FilterOutCompactionManifests(&storage.ObjectAttrs{Name: recordPath("prefix/a", "1")}))
+	assert.Equal(t, "prefix/a/"+compactionRecordPrefix+"1.json", recordPath("prefix/a", "1"))
+}
+
+func TestSkewedServerClockLosesNoSources(t *testing.T) {
+	for _, skew := range []time.Duration{-time.Hour, time.Hour} {
+		ctx := context.Background()
+		fake, bucket := newFakeGCS(t)
+		fake.skew = skew
+		fake.putKeys("f/1.json", 1)
+		c := NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+			WithDestination("sorted.json"),
+			WithSourceRemoval(),
+			WithCompactionPolicy(NewerThanLastCompaction()),
+			WithReadOptions(WithComparator(comparePlainRecords)),
+		)
+		_, err := c.Compact(ctx, "f/")
+		require.NoError(t, err)
+
+		// Written after the compaction; the server tells otherwise when its clock is behind
+		fake.putKeys("f/2.json", 2)
+		listing, err := c.listFolder(ctx, "f")
+		require.NoError(t, err)
+		assert.Len(t, listing.Sources, 1, "skew %v", skew)
+		it, err := c.readFolder(ctx, "f")
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 2}, collectKeys(t, it), "skew %v: expected reads to see the new source", skew)
+
+		res, err := c.Compact(ctx, "f/")
+		require.NoError(t, err)
+		require.Len(t, res.Folders, 1, "skew %v", skew)
+		assert.Equal(t, []int{1, 2}, fake.keys(t, "f/sorted.json"), "skew %v: expected the new source to be merged", skew)
+		names, records := withoutRecords(fake.names())
+		assert.Equal(t, []string{"f/sorted.json"}, names, "skew %v", skew)
+		assert.Equal(t, 1, records, "skew %v: expected the replaced record to be removed", skew)
+	}
+}
+
+func TestWidenedSourcePredicateMergesEarlierSources(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("f/a-1.json", 1)
+	fake.putKeys("f/b-1.json", 2)
+	compactor := func(srcPredicate func(*storage.ObjectAttrs) bool, opts ...CompactionOption) *Compactor {
+		return NewCompactor(bucket, func() interface{} { return &plainRecord{} }, append([]CompactionOption{
+			WithDestination("sorted.json"),
+			WithSourcePredicate(srcPredicate),
+			WithReadOptions(WithComparator(comparePlainRecords)),
+		}, opts...)...)
+	}
+
+	_, err := compactor(func(objAttr *storage.ObjectAttrs) bool { return strings.HasPrefix(objAttr.Name, "f/a-") }).Compact(ctx, "f/")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, fake.keys(t, "f/sorted.json"))
+
+	// b-1 was written before the outputs but never merged into them
+	widened := compactor(func(*storage.ObjectAttrs) bool { return true }, WithSourceRemoval())
+	it, err := widened.readFolder(ctx, "f")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, collectKeys(t, it))
+
+	res, err := widened.Compact(ctx, "f/")
+	require.NoError(t, err)
+	require.Len(t, res.Folders, 1)
+	assert.Equal(t, 1, res.Folders[0].Sources)
+	assert.Equal(t, []int{1, 2}, fake.keys(t, "f/sorted.json"))
+	names, _ := withoutRecords(fake.names())
+	assert.Equal(t, []string{"f/a-1.json", "f/sorted.json"}, names, "expected only the source merged to be removed")
+}
@@ -0,0 +1,658 @@
+package gcsext
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kvanticoss/goutils/backoff"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/recordbuffer"
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	googleIterator "google.golang.org/api/iterator"
+)
+
+// ErrNoCompactionDestination is returned by Compactor.Compact when no destination has been configured
+var ErrNoCompactionDestination = errors.New("compactor: no destination configured; use WithDestination or WithDestinationNaming")
+
+// Compactor sorts and merges all objects of each folder under a prefix into a destination object per folder; merging
+// with the destination's existing records. It replaces the positional arguments of SortGCSFolders with
+// CompactionOptions. A Compactor may be reused for multiple Compact calls.
+type Compactor struct {
+	bucket *storage.BucketHandle
+	newer  func() interface{}
+
+	srcPredicate     func(*storage.ObjectAttrs) bool
+	destination      func(folder string) string
+	cacheFactory     recordbuffer.ReadWriteResetterFactory
+	backoff          *backoff.RandExpBackoff
+	removeDuplicates bool
+	removeSources    bool
+	concurrency      int
+	memoryBudget     int64
+	readOpts         []ReadOption
+	policies         []CompactionPolicy
+	leases           bool
+	leaseTTL         time.Duration
+	leaseOwner       string
+	tombstoneScope   string
+	tombstones       []*storage.ObjectAttrs // The tombstone objects applied by the run; see withTombstones
+
+	maxRecordsPerFile int64
+	maxBytesPerFile   int64
+	incremental       bool
+
+	// Set for the levels of a TieredCompactor
+	parent  func(folder string) string // Groups the sources by the parent of their folder
+	rebuild bool                       // Replace the destination with the sources instead of merging them into it
+}
+
+// NewCompactor creates a Compactor for records created by newer (see SortGCSFolders for the requirements on records)
+func NewCompactor(bucket *storage.BucketHandle, newer func() interface{}, opts ...CompactionOption) *Compactor {
+	c := &Compactor{
+		bucket:       bucket,
+		newer:        newer,
+		cacheFactory: defaultSpillFactory,
+		concurrency:  1,
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(c)
+		}
+	}
+	return c
+}
+
+// CompactionResult reports what Compact did; folders are in name order
+type CompactionResult struct {
+	Folders    []*FolderResult
+	Tombstones []string // Tombstone objects removed once applied to all folders (see WithTombstonePrefix)
+}
+
+// FolderResult reports the compaction of a single folder
+type FolderResult struct {
+	Folder      string
+	Destination string
+	Sources     int      // Number of source objects merged (not counting the existing destination)
+	Records     int64    // Number of records written to the destination
+	Deleted     int64    // Number of records deleted by tombstones (see WithTombstones)
+	Dropped     int64    // Number of records dropped by the retention policy (see WithRetention)
+	Outputs     []string // The objects written
+	Attempts    int
+	Skipped     bool     // Not compacted as decided by the CompactionPolicies; or as Leased
+	Leased      bool     // Skipped as another worker holds the folder's lease (see WithFolderLeases)
+	Changed     []string // Sources overwritten during compaction; not removed but left for the next compaction
+	Err         error
+}
+
+// Compact compacts all folders under the prefix. Folders are compacted by up to WithConcurrency workers (see also
+// WithMemoryBudget) as soon as the listing has passed them; a failed folder doesn't stop the others. The result of
+// every folder is reported in name order and if any folder failed a *CompactionError is returned as well.
+func (c *Compactor) Compact(ctx context.Context, prefix string) (*CompactionResult, error) {
+	if c.destination == nil {
+		return nil, ErrNoCompactionDestination
+	}
+	// All folders are compacted with the same tombstones; read once
+	c, tombstones, err := c.withTombstones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Folders with tombstones to apply are rewritten even without new sources
+	result, err := c.compact(ctx, prefix, len(tombstones) > 0)
+	if err == nil && len(tombstones) > 0 {
+		result.Tombstones, err = c.removeTombstones(ctx, prefix, result.Folders, tombstones, []*Compactor{c})
+	}
+	return result, err
+}
+
+// compact compacts the folders under the prefix; with rewrite every folder with a destination is compacted regardless
+// of new sources and policies
+func (c *Compactor) compact(ctx context.Context, prefix string, rewrite bool) (*CompactionResult, error) {
+	if c.tracked() {
+		if err := c.Recover(ctx, prefix); err != nil {
+			return nil, err
+		}
+	}
+	listings := c.folderListings(ctx, prefix, rewrite)
+	results, err := c.runFolders(ctx, func() (*folderTask, error) {
+		folder, err := listings()
+		if err != nil {
+			return nil, err
+		}
+		return &folderTask{folder: folder.Folder, weight: folder.size(), compact: func() *FolderResult {
+			return c.compactListed(ctx, folder, rewrite)
+		}}, nil
+	})
+	if err != nil {
+		result, _ := collectResults(results)
+		return result, errors.Wrap(err, "failed to list source objects")
+	}
+	return collectResults(results)
+}
+
+// compactListed compacts a listed folder unless its policy skips it
+func (c *Compactor) compactListed(ctx context.Context, folder *FolderListing, rewrite bool) *FolderResult {
+	if !rewrite && !c.shouldCompact(folder) {
+		return &FolderResult{Folder: folder.Folder, Destination: c.destination(folder.Folder), Skipped: true}
+	}
+	return c.compactLeased(ctx, folder.Folder, func(ctx context.Context) *FolderResult {
+		listing := folder
+		if c.leases {
+			// Another worker might have compacted the folder since it was listed
+			var err error
+			if listing, err = c.listFolder(ctx, folder.Folder); err != nil {
+				return &FolderResult{Folder: folder.Folder, Destination: c.destination(folder.Folder), Err: err}
+			}
+			if len(listing.Sources) == 0 && !rewrite {
+				return &FolderResult{Folder: folder.Folder, Destination: c.destination(folder.Folder), Skipped: true}
+			}
+		}
+		return c.compactFolder(ctx, listing, false)
+	})
+}
+
+// FolderListing is the listing metadata of a folder; what a CompactionPolicy decides on. Sources are the objects not
+// yet compacted: those which the outputs haven't merged at their current generation (see compactionRecord). Objects
+// written after they were listed are left for the next compaction.
+type FolderListing struct {
+	Folder    string
+	Sources   []*storage.ObjectAttrs // The objects to be compacted
+	Compacted []*storage.ObjectAttrs // Sources already compacted into the outputs; left unless sources are removed
+	Outputs   []*storage.ObjectAttrs // The existing destination (or its parts)
+	Now       time.Time              // When the listing started
+
+	records map[string]*compactionRecord // The records of the outputs by compaction ID
+	carried []PlannedObject              // The sources compacted earlier which the next record carries over
+}
+
+// classify splits the sources of the listing into those to be compacted and those already compacted into the outputs
+func (c *Compactor) classify(ctx context.Context, f *FolderListing, sources []*storage.ObjectAttrs) error {
+	records, err := c.readRecords(ctx, f.Outputs)
+	if err != nil {
+		return err
+	}
+	compacted := compactedSources(records)
+	f.records, f.Sources, f.Compacted = records, nil, nil
+	for _, objAttr := range sources {
+		if compacted[sourceGeneration{objAttr.Name, objAttr.Generation}] {
+			f.Compacted = append(f.Compacted, objAttr)
+		} else {
+			f.Sources = append(f.Sources, objAttr)
+		}
+	}
+	// Sources compacted earlier which are no longer listed (e.g. removed) are forgotten
+	f.carried = plannedObjects(f.Compacted)
+	return nil
+}
+
+// merged returns the sources merged into the destination; a rebuilt destination merges the compacted sources as well
+func (c *Compactor) merged(f *FolderListing) []*storage.ObjectAttrs {
+	if c.rebuild {
+		return append(f.Sources[:len(f.Sources):len(f.Sources)], f.Compacted...)
+	}
+	return f.Sources
+}
+
+// size is the total size of the sources and outputs
+func (f *FolderListing) size() int64 {
+	var total int64
+	for _, objAttr := range append(f.Sources[:len(f.Sources):len(f.Sources)], f.Outputs...) {
+		total += objAttr.Size
+	}
+	return total
+}
+
+// sourcePredicate accepts the objects matching the source predicate which aren't compaction destinations nor
+// tombstone objects
+func (c *Compactor) sourcePredicate() func(*storage.ObjectAttrs) bool {
+	return CombineFilters(c.srcPredicate, newReadConfig(c.readOpts).notTombstoneObject, func(objAttr *storage.ObjectAttrs) bool {
+		return !c.isDestination(objAttr.Name)
+	})
+}
+
+// listFolders lists the source objects and destinations under the prefix grouped by folder; sorted by folder name.
+// Folders without sources are left out unless withOutputs is set and they have a destination.
+func (c *Compactor) listFolders(ctx context.Context, prefix string, withOutputs bool) ([]*FolderListing, error) {
+	listings := c.folderListings(ctx, prefix, withOutputs)
+	res := []*FolderListing{}
+	for {
+		folder, err := listings()
+		if err == iterator.ErrIteratorStop {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, folder)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Folder < res[j].Folder })
+	return res, nil
+}
+
+// folderListings returns an iterator over the source objects and destinations under the prefix grouped by folder.
+// Rather than listing the whole prefix first, a folder is returned as soon as the listing has passed all names under
+// folder + "/"; nested folders therefore come before their parents. Folders with objects outside of folder + "/" (see
+// CompactionLevel.Parent) are held until the listing is done. Folders without sources are left out unless withOutputs
+// is set and they have a destination.
+func (c *Compactor) folderListings(ctx context.Context, prefix string, withOutputs bool) func() (*FolderListing, error) {
+	sourcePredicate := c.sourcePredicate()
+	predicate := CombineFilters(func(objAttr *storage.ObjectAttrs) bool {
+		return c.isDestination(objAttr.Name) || sourcePredicate(objAttr)
+	}, FilterOutVirtualGcsFolders, FilterOutCompactionManifests)
+	now := time.Now()
+	it := c.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+
+	open := map[string]*FolderListing{}
+	sources := map[string][]*storage.ObjectAttrs{}
+	held := map[string]bool{}
+	ready := []*FolderListing{}
+	// flush readies the open folders the listing has passed (at name); all of them once the listing is done
+	flush := func(name string, done bool) error {
+		folders := []string{}
+		for folder := range open {
+			under := folder + "/"
+			if done || (!held[folder] && name > under && !strings.HasPrefix(name, under)) {
+				folders = append(folders, folder)
+			}
+		}
+		// Nested folders first
+		sort.Sort(sort.Reverse(sort.StringSlice(folders)))
+		for _, folder := range folders {
+			f := open[folder]
+			if err := c.classify(ctx, f, sources[folder]); err != nil {
+				return errors.Wrapf(err, "failed to classify the sources of %s", folder)
+			}
+			delete(open, folder)
+			delete(sources, folder)
+			if len(f.Sources) > 0 || (withOutputs && len(f.Outputs) > 0) {
+				ready = append(ready, f)
+			}
+		}
+		return nil
+	}
+
+	done := false
+	return func() (*FolderListing, error) {
+		for len(ready) == 0 && !done {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			objAttr, err := it.Next()
+			if err == googleIterator.Done {
+				done = true
+				if err := flush("", true); err != nil {
+					return nil, err
+				}
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := flush(objAttr.Name, false); err != nil {
+				return nil, err
+			}
+			if !predicate(objAttr) {
+				continue
+			}
+
+			isOutput := c.isDestination(objAttr.Name)
+			folder := path.Dir(objAttr.Name)
+			if !isOutput {
+				folder = c.sourceFolder(objAttr.Name)
+			}
+			f, ok := open[folder]
+			if !ok {
+				f = &FolderListing{Folder: folder, Now: now}
+				open[folder] = f
+			}
+			if !strings.HasPrefix(objAttr.Name, folder+"/") {
+				held[folder] = true
+			}
+			if isOutput {
+				f.Outputs = append(f.Outputs, objAttr)
+			} else {
+				sources[folder] = append(sources[folder], objAttr)
+			}
+		}
+		if len(ready) == 0 {
+			return nil, iterator.ErrIteratorStop
+		}
+		f := ready[0]
+		ready = ready[1:]
+		return f, nil
+	}
+}
+
+// sourceFolder returns the folder a source object is compacted into; its own folder unless sources are grouped by
+// their parent folder (see TieredCompactor)
+func (c *Compactor) sourceFolder(name string) string {
+	if c.parent != nil {
+		return c.parent(path.Dir(name))
+	}
+	return path.Dir(name)
+}
+
+// listFolder lists the source objects and destination of the folder
+func (c *Compactor) listFolder(ctx context.Context, folder string) (*FolderListing, error) {
+	now := time.Now()
+	listings, err := c.listFolders(ctx, folder+"/", true)
+	if err != nil {
+		return nil, err
+	}
+	for _, listing := range listings {
+		if listing.Folder == folder {
+			return listing, nil
+		}
+	}
+	return &FolderListing{Folder: folder, Now: now}, nil
+}
+
+// newBackoff returns the retry state of a single folder
+func (c *Compactor) newBackoff() *backoff.RandExpBackoff {
+	if c.backoff == nil {
+		var bo *backoff.RandExpBackoff
+		return bo.WithMaxAttempts(5).WithMinBackoff(time.Second * 15).WithScale(5) // Add some sane default for our backoff timer
+	}
+	bo := *c.backoff
+	return &bo
+}
+
+// compactFolder merges the sources of the listing into the destination of the folder; retrying with a fresh listing of
+// the folder if the destination or the sources changed while being compacted.
+//
+// In exact mode (executing a CompactionPlan) nothing is retried; changes are reported as ErrPlanOutdated instead.
+func (c *Compactor) compactFolder(ctx context.Context, listing *FolderListing, exact bool) *FolderResult {
+	folder := listing.Folder
+	res := &FolderResult{Folder: folder, Destination: c.destination(folder)}
+	bo := c.newBackoff()
+	var manifest *CompactionManifest
+	var manifestGeneration int64
+	for {
+		res.Attempts++
+		res.Sources = len(listing.Sources)
+		res.Err = c.compactOnce(ctx, res, listing, exact, &manifest, &manifestGeneration)
+		if res.Err == nil {
+			break
+		}
+		if !isRetryable(res.Err) {
+			return res
+		}
+		if exact {
+			res.Err = errors.Wrapf(ErrPlanOutdated, "%v", res.Err)
+			return res
+		}
+
+		var boErr error
+		if bo, boErr = bo.SleepAndIncr(); boErr != nil {
+			res.Err = errors.Wrapf(res.Err, "failed even after %d attempts; aborting", res.Attempts)
+			return res
+		}
+		// Note; this time we only list the folder we failed to compact, not the root prefix
+		if listing, res.Err = c.listFolder(ctx, folder); res.Err != nil {
+			return res
+		}
+	}
+
+	if manifest != nil {
+		// Only remove the orignal files intended for compaction; at the generation we read
+		res.Changed, res.Err = c.finishCompaction(ctx, manifest, manifestGeneration)
+	}
+	return res
+}
+
+// compactOnce makes a single attempt at compacting the folder. The sources merged are recorded (see compactionRecord)
+// before any output is written. When sources are to be removed, or the destination is rolled into parts, it is tracked
+// by a manifest (see CompactionManifest) which is committed once the outputs are written; and removed if the attempt
+// fails. Only the sources merged by the attempt are removed; sources compacted earlier are left as they are.
+func (c *Compactor) compactOnce(
+	ctx context.Context,
+	res *FolderResult,
+	listing *FolderListing,
+	exact bool,
+	manifest **CompactionManifest,
+	manifestGeneration *int64,
+) error {
+	if !c.tracked() {
+		id := newCompactionID()
+		if err := c.writeRecord(ctx, res.Destination, c.newRecord(id, listing)); err != nil {
+			return err
+		}
+		_, err := c.merge(ctx, res, c.merged(listing), listing.Outputs, map[string]string{compactionIDMetadata: id})
+		if err != nil || len(res.Outputs) == 0 {
+			if removeErr := c.removeRecords(ctx, res.Destination, id); err == nil {
+				err = removeErr
+			}
+			return err
+		}
+		return c.removeRecords(ctx, res.Destination, replacedRecords(listing.Outputs, res.Outputs, nil, id)...)
+	}
+
+	recovered, err := c.recoverFolder(ctx, res.Folder)
+	if err != nil {
+		return errors.Wrap(err, "failed to recover an earlier compaction")
+	}
+	if recovered {
+		// Sources might have been removed by the earlier compaction
+		if exact {
+			return errors.Wrap(ErrPlanOutdated, "an earlier compaction was recovered")
+		}
+		if listing, err = c.listFolder(ctx, res.Folder); err != nil {
+			return err
+		}
+		res.Sources = len(listing.Sources)
+	}
+
+	removes := []*storage.ObjectAttrs{}
+	if c.removeSources {
+		removes = c.merged(listing)
+	}
+	metadata := map[string]string{}
+	m, generation, err := c.beginCompaction(ctx, res.Folder, res.Destination, removes, metadata)
+	if err != nil {
+		return errors.Wrap(err, "failed to write compaction manifest")
+	}
+	var stage *partStage
+	if err = c.writeRecord(ctx, res.Destination, c.newRecord(m.ID, listing)); err == nil {
+		stage, err = c.merge(ctx, res, c.merged(listing), listing.Outputs, metadata)
+	}
+	if err == nil && stage != nil {
+		var published bool
+		if generation, err = c.stageCompaction(ctx, m, generation, stage); err != nil {
+			err = errors.Wrap(err, "failed to record staged parts in compaction manifest")
+		} else if published, err = c.publishStaged(ctx, m); err != nil && published {
+			// Some parts are published; only Recover can finish the compaction
+			return err
+		}
+	}
+	if err != nil {
+		if abortErr := c.abortCompaction(ctx, m, generation); abortErr != nil {
+			return errors.Wrapf(abortErr, "failed to abort compaction after: %v", err)
+		}
+		return err
+	}
+	replaced := replacedRecords(listing.Outputs, res.Outputs, stage, m.ID)
+	if len(res.Outputs) == 0 {
+		replaced = append(replaced, m.ID) // Nothing refers to the record
+	}
+	if generation, err = c.commitCompaction(ctx, m, generation, res.Outputs, replaced); err != nil {
+		return errors.Wrap(err, "failed to commit compaction manifest")
+	}
+	*manifest, *manifestGeneration = m, generation
+	return nil
+}
+
+// tracked reports if compactions are tracked by manifests; when sources are removed or the destination is rolled into
+// parts
+func (c *Compactor) tracked() bool {
+	return c.removeSources || c.rolling()
+}
+
+// isRetryable reports if the error means that the destination (precondition failed) or a source (not found) changed
+// during compaction or that we were rate limited; an incomplete compaction is never retried
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrIncompleteCompaction) {
+		return false
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return true
+	}
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && (gerr.Code == http.StatusPreconditionFailed || gerr.Code == http.StatusTooManyRequests)
+}
+
+// isPreconditionFailed reports if the error means that the object didn't match the conditions (e.g. GenerationMatch)
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// merge sorts the records of the sources and the existing outputs (as listed or planned) and writes them to the
+// destination (or to its parts; see WithMaxRecordsPerFile). Outputs are read, and replaced, only at their listed
+// generation; a destination which wasn't listed is only created if it still doesn't exist. The metadata is set on all
+// objects written. Parts are only staged; the stage is returned for the caller to publish (see CompactionManifest).
+func (c *Compactor) merge(
+	ctx context.Context,
+	res *FolderResult,
+	sources []*storage.ObjectAttrs,
+	outputs []*storage.ObjectAttrs,
+	metadata map[string]string,
+) (*partStage, error) {
+	res.Records, res.Deleted, res.Dropped, res.Outputs = 0, 0, 0, nil
+	if c.rolling() {
+		return c.mergeParts(ctx, res, sources, partsOf(res.Destination, outputs), metadata)
+	}
+
+	// Create a sorted iterator from all files in a GCS folder
+	// Put into a limited memory cache (deduplication)
+	// Write into sorted cache-files (either local FS or RAM)
+	// Read from sorted cache files and write to dst
+	cfg := c.mergeConfig()
+	dstFormat := FormatByName(res.Destination)
+	conditions := storage.Conditions{DoesNotExist: true}
+	existing := []*storage.ObjectAttrs{}
+	for _, objAttr := range outputs {
+		if objAttr.Name != res.Destination {
+			continue
+		}
+		conditions = storage.Conditions{GenerationMatch: objAttr.Generation}
+		if !c.rebuild {
+			existing = append(existing, objAttr)
+		}
+	}
+	runs, err := c.loadSources(ctx, cfg, existing, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	if runs.len() == 0 {
+		return nil, nil
+	}
+	rIt, err := c.sortedRecords(cfg, res, runs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write it all in the format of the destination file; failing if the destination has changed since it was listed
+	w := newAbortableWriter(ctx, c.bucket.Object(res.Destination).If(conditions))
+	w.Metadata = metadata
+	if res.Records, err = encodeTo(compressed(w), dstFormat, rIt); err != nil {
+		return nil, err
+	}
+	res.Outputs = []string{res.Destination}
+	return nil, nil
+}
+
+// loadSources reads all records of the outputs and then the sources into sorted runs kept in buffers from the
+// cacheFactory. Records sorting as equal keep the order they were loaded in; the records of the outputs come first,
+// like Read merges them. Outputs are always read in the format matching their name.
+func (c *Compactor) loadSources(
+	ctx context.Context,
+	cfg *readConfig,
+	outputs []*storage.ObjectAttrs,
+	sources []*storage.ObjectAttrs,
+) (*sortedRuns, error) {
+	runs := newSortedRuns(c.cacheFactory, cfg.comparator())
+	outputCfg := *cfg
+	outputCfg.format = nil
+	load := func(cfg *readConfig, objAttr *storage.ObjectAttrs) error {
+		reader, err := newObjectReader(ctx, c.bucket, objAttr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %s", objAttr.Name)
+		}
+		err = runs.load(cfg.decoder(objAttr, reader, c.newer))
+		reader.Close()
+		if err != nil {
+			return errors.Wrapf(err, "couldn't load data from %s", objAttr.Name)
+		}
+		return nil
+	}
+	for _, objAttr := range outputs {
+		if err := load(&outputCfg, objAttr); err != nil {
+			return nil, err
+		}
+	}
+	for _, objAttr := range sources {
+		if err := load(cfg, objAttr); err != nil {
+			return nil, err
+		}
+	}
+	return runs, nil
+}
+
+// sortedRecords returns the buffered records in sorted order; deduplicated and filtered by the tombstones and the
+// retention policy if requested. Deleted and dropped records are counted in the result.
+func (c *Compactor) sortedRecords(cfg *readConfig, res *FolderResult, runs *sortedRuns) (iterator.RecordIterator, error) {
+	it, err := runs.sorted(c.newer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get sorted iterator")
+	}
+	return cfg.filtered(c.deduplicated(cfg, it), &res.Deleted, &res.Dropped), nil
+}
+
+// deduplicated removes duplicates from the sorted records if requested
+func (c *Compactor) deduplicated(cfg *readConfig, it iterator.RecordIterator) iterator.RecordIterator {
+	if c.removeDuplicates || cfg.deduplicate {
+		return cfg.removeDuplicates(it)
+	}
+	return it
+}
+
+// encodeTo writes all records to w in the format and closes w; returning the number of records written. Errors from
+// closing w (e.g. failed preconditions) are returned as is; on any other error w is aborted (see abortWriter).
+func encodeTo(w io.WriteCloser, format Format, it iterator.RecordIterator) (int64, error) {
+	var written int64
+	counted := func() (interface{}, error) {
+		rec, err := it()
+		if err == nil {
+			written++
+		}
+		return rec, err
+	}
+
+	enc, err := format.NewEncoder(w)
+	if err != nil {
+		abortWriter(w)
+		return 0, errors.Wrap(err, "failed to create record encoder for gcsWriter")
+	}
+	if err = EncodeRecords(counted, enc); err != nil && err != iterator.ErrIteratorStop {
+		abortWriter(w)
+		return 0, errors.Wrap(err, "failed to write records to gcsWriter")
+	}
+	if err = enc.Close(); err != nil {
+		abortWriter(w)
+		return 0, errors.Wrap(err, "failed to flush records to gcsWriter")
+	}
+
+	// Here we can get precondition errors; errors we can retry on
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
@@ -0,0 +1,144 @@
+package gcsext
+
+import (
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/kvanticoss/goutils/backoff"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	raw "google.golang.org/api/storage/v1"
+)
+
+func TestCompactorSourcePredicate(t *testing.T) {
+	c := NewCompactor(nil, nil, WithDestination("sorted.json.gz"), WithSourcePredicate(func(objAttr *storage.ObjectAttrs) bool {
+		return objAttr.Name != "a/skip.json"
+	}))
+	predicate := c.sourcePredicate()
+	assert.True(t, predicate(&storage.ObjectAttrs{Name: "a/1.json"}))
+	assert.False(t, predicate(&storage.ObjectAttrs{Name: "a/skip.json"}))
+	assert.False(t, predicate(&storage.ObjectAttrs{Name: "a/sorted.json.gz"}), "expected the destination to never be a source")
+	assert.True(t, predicate(&storage.ObjectAttrs{Name: "a/b/sorted.json.gz.tmp"}))
+}
+
+func TestCompactorDefaults(t *testing.T) {
+	c := NewCompactor(nil, nil, WithCacheFactory(nil))
+	assert.NotNil(t, c.cacheFactory)
+	assert.Equal(t, 1, c.concurrency)
+
+	_, err := c.Compact(context.Background(), "prefix/")
+	assert.Equal(t, ErrNoCompactionDestination, err)
+
+	var bo *backoff.RandExpBackoff
+	bo = bo.WithMaxAttempts(2)
+	c = NewCompactor(nil, nil, WithRetryPolicy(bo))
+	assert.False(t, c.newBackoff() == bo, "expected each folder to get its own retry state")
+	assert.Equal(t, *bo, *c.newBackoff())
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(errors.Wrap(&googleapi.Error{Code: http.StatusPreconditionFailed}, "closing")))
+	assert.True(t, isRetryable(&googleapi.Error{Code: http.StatusTooManyRequests}))
+	assert.True(t, isRetryable(errors.Wrap(storage.ErrObjectNotExist, "opening")))
+	assert.False(t, isRetryable(&googleapi.Error{Code: http.StatusForbidden}))
+	assert.False(t, isRetryable(errors.New("decode")))
+}
+
+func TestIsPreconditionFailed(t *testing.T) {
+	assert.True(t, isPreconditionFailed(&googleapi.Error{Code: http.StatusPreconditionFailed}))
+	assert.False(t, isPreconditionFailed(&googleapi.Error{Code: http.StatusTooManyRequests}))
+	assert.False(t, isPreconditionFailed(storage.ErrObjectNotExist))
+	assert.False(t, isPreconditionFailed(nil))
+}
+
+func TestFolderListingsStreamByFolder(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	for _, name := range []string{"a/1.json", "a/b/1.json", "a/b/c/1.json", "a/b/sorted.json.gz", "b/1.json", "x.json", "z/1.json", "z/2.json"} {
+		fake.put(name, "", nil)
+	}
+	lists := 0
+	fake.hook = func(op, name string) int {
+		if op == "list" {
+			lists++
+		}
+		return 0
+	}
+
+	c := NewCompactor(bucket, nil, WithDestination("sorted.json.gz"))
+	listings := c.folderListings(context.Background(), "", true)
+	folders := []string{}
+	for {
+		folder, err := listings()
+		if err == iterator.ErrIteratorStop {
+			break
+		}
+		require.NoError(t, err)
+		if len(folders) == 0 {
+			assert.Equal(t, 2, lists, "expected the first folder before the listing is done")
+		}
+		folders = append(folders, folder.Folder)
+		if folder.Folder == "a/b" {
+			assert.Len(t, folder.Sources, 1)
+			assert.Len(t, folder.Outputs, 1)
+		}
+	}
+	assert.Equal(t, 3, lists)
+	assert.Equal(t, []string{"a/b/c", "a/b", "a", "b", "z", "."}, folders)
+
+	listed, err := c.listFolders(context.Background(), "", true)
+	require.NoError(t, err)
+	names := []string{}
+	for _, folder := range listed {
+		names = append(names, folder.Folder)
+	}
+	assert.Equal(t, []string{".", "a", "a/b", "a/b/c", "b", "z"}, names)
+}
+
+func TestSourcesWrittenWhileCompactingAreCompactedNextTime(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("f/1.json", 1, 2)
+	listed, written := false, false
+	fake.hook = func(op, name string) int {
+		// The hook is called with the fake locked; store directly
+		switch {
+		case op == "list" && !listed:
+			listed = true
+			fake.store(&raw.Object{Name: "f/2.json"}, []byte("{\"Key\":3}\n"))
+		case op == "insert" && name == "f/sorted.json" && !written:
+			written = true
+			fake.store(&raw.Object{Name: "f/3.json"}, []byte("{\"Key\":4}\n"))
+		}
+		return 0
+	}
+
+	c := NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+		WithDestination("sorted.json"),
+		WithCompactionPolicy(NewerThanLastCompaction()),
+		WithReadOptions(WithComparator(comparePlainRecords)),
+	)
+	res, err := c.Compact(context.Background(), "f/")
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Folders[0].Sources, "expected the source listed to be merged")
+	assert.Equal(t, []int{1, 2, 3}, fake.keys(t, "f/sorted.json"))
+	assert.NotEmpty(t, fake.attrs("f/sorted.json").Metadata[compactionIDMetadata])
+
+	listing, err := c.listFolder(context.Background(), "f")
+	require.NoError(t, err)
+	assert.Len(t, listing.Sources, 1)
+	assert.Len(t, listing.Compacted, 2)
+	assert.True(t, NewerThanLastCompaction()(listing), "expected sources written before the output to be compacted next time")
+
+	res, err = c.Compact(context.Background(), "f/")
+	require.NoError(t, err)
+	assert.False(t, res.Folders[0].Skipped)
+	assert.Equal(t, []int{1, 2, 3, 4}, fake.keys(t, "f/sorted.json"), "expected every source to be merged once")
+
+	res, err = c.Compact(context.Background(), "f/")
+	require.NoError(t, err)
+	assert.Empty(t, res.Folders, "expected nothing left to compact")
+}
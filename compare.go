@@ -0,0 +1,106 @@
+package gcsext
+
+import (
+	"container/heap"
+
+	"github.com/kvanticoss/goutils/iterator"
+)
+
+// compareFunc returns a negative number when a sorts before b, a positive number when b sorts before a and 0 when they are equal
+type compareFunc func(a, b interface{}) int
+
+// compareLessers is the default compareFunc; it requires both records to implement the Lesser interface
+// (which is enforced by requireLessers) and treats everything else as equal.
+func compareLessers(a, b interface{}) int {
+	la, ok := a.(iterator.Lesser)
+	if !ok {
+		return 0
+	}
+	lb, ok := b.(iterator.Lesser)
+	if !ok {
+		return 0
+	}
+	if la.Less(lb) {
+		return -1
+	}
+	if lb.Less(la) {
+		return 1
+	}
+	return 0
+}
+
+// requireLessers returns ErrNotLesser for any record not implementing the Lesser interface
+func requireLessers(it iterator.RecordIterator) iterator.RecordIterator {
+	return func() (interface{}, error) {
+		rec, err := it()
+		if err != nil {
+			return rec, err
+		}
+		if _, ok := rec.(iterator.Lesser); !ok {
+			return nil, iterator.ErrNotLesser
+		}
+		return rec, nil
+	}
+}
+
+// mergeSorted combines a list of sorted iterators; always yielding the lowest record available from all of them.
+// Equal records are yielded in the order of the iterators they came from. Like iterator.SortedRecordIterators the
+// first record of each iterator is read up front.
+func mergeSorted(iterators []iterator.RecordIterator, cmp compareFunc) (iterator.RecordIterator, error) {
+	h := &mergeHeap{cmp: cmp}
+	for i, it := range iterators {
+		rec, err := it()
+		if err == iterator.ErrIteratorStop {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		h.items = append(h.items, mergeItem{rec: rec, index: i})
+	}
+	heap.Init(h)
+
+	return func() (interface{}, error) {
+		if h.Len() == 0 {
+			return nil, iterator.ErrIteratorStop
+		}
+
+		best := h.items[0]
+		next, err := iterators[best.index]()
+		if err == iterator.ErrIteratorStop {
+			heap.Pop(h)
+		} else if err != nil {
+			heap.Pop(h)
+			return nil, err
+		} else {
+			h.items[0].rec = next
+			heap.Fix(h, 0)
+		}
+		return best.rec, nil
+	}, nil
+}
+
+type mergeItem struct {
+	rec   interface{}
+	index int
+}
+
+type mergeHeap struct {
+	items []mergeItem
+	cmp   compareFunc
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+func (h *mergeHeap) Less(i, j int) bool {
+	if c := h.cmp(h.items[i].rec, h.items[j].rec); c != 0 {
+		return c < 0
+	}
+	return h.items[i].index < h.items[j].index
+}
+func (h *mergeHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap) Push(x interface{}) { h.items = append(h.items, x.(mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
@@ -0,0 +1,96 @@
+package gcsext
+
+import (
+	"testing"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type plainRecord struct {
+	Key   int
+	Value string
+}
+
+func comparePlainRecords(a, b interface{}) int {
+	return a.(*plainRecord).Key - b.(*plainRecord).Key
+}
+
+func plainRecordIterator(keys ...int) iterator.RecordIterator {
+	return func() (interface{}, error) {
+		if len(keys) == 0 {
+			return nil, iterator.ErrIteratorStop
+		}
+		rec := &plainRecord{Key: keys[0]}
+		keys = keys[1:]
+		return rec, nil
+	}
+}
+
+func collectKeys(t *testing.T, it iterator.RecordIterator) []int {
+	res := []int{}
+	var rec interface{}
+	var err error
+	for rec, err = it(); err == nil; rec, err = it() {
+		res = append(res, rec.(*plainRecord).Key)
+	}
+	require.EqualError(t, err, iterator.ErrIteratorStop.Error())
+	return res
+}
+
+func TestMergeSorted(t *testing.T) {
+	it, err := mergeSorted([]iterator.RecordIterator{
+		plainRecordIterator(1, 4, 7),
+		plainRecordIterator(),
+		plainRecordIterator(2, 2, 8, 9),
+		plainRecordIterator(0, 3),
+	}, comparePlainRecords)
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2, 2, 3, 4, 7, 8, 9}, collectKeys(t, it))
+}
+
+func TestMergeSortedRequiresLessers(t *testing.T) {
+	it, err := mergeSorted([]iterator.RecordIterator{requireLessers(plainRecordIterator(1))}, compareLessers)
+	assert.Equal(t, iterator.ErrNotLesser, err)
+	assert.Nil(t, it)
+}
+
+func TestSortedRunsThroughRecordBuffer(t *testing.T) {
+	runs := newSortedRuns(defaultSpillFactory, comparePlainRecords)
+	require.NoError(t, runs.load(plainRecordIterator(5, 3, 9, 1, 1)))
+	assert.Equal(t, 3, runs.len())
+
+	it, err := runs.sorted(func() interface{} { return &plainRecord{} })
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 1, 3, 5, 9}, collectKeys(t, it))
+}
+
+func TestSortedRunsKeepInsertionOrderOfEqualRecords(t *testing.T) {
+	byKey := func(a, b interface{}) int {
+		return a.(*plainRecord).Key - b.(*plainRecord).Key
+	}
+	runs := newSortedRuns(defaultSpillFactory, byKey)
+	for i, key := range []int{5, 7, 5, 3, 5, 3} {
+		require.NoError(t, runs.add(&plainRecord{Key: key, Value: string(rune('a' + i))}))
+	}
+
+	it, err := runs.sorted(func() interface{} { return &plainRecord{} })
+	require.NoError(t, err)
+	assert.Equal(t, []plainRecord{{3, "d"}, {3, "f"}, {5, "a"}, {5, "c"}, {5, "e"}, {7, "b"}}, collectRecords(t, it))
+}
+
+func TestDeduplicationByKey(t *testing.T) {
+	byKey := newReadConfig([]ReadOption{
+		withCompare(comparePlainRecords),
+		WithDeduplication(func(r interface{}) Key { return Key{r.(*plainRecord).Key / 10} }),
+	})
+	it, err := byKey.sorted([]iterator.RecordIterator{plainRecordIterator(1, 5, 12, 31), plainRecordIterator(3, 14, 20)})
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 12, 20, 31}, collectKeys(t, it))
+
+	byOrder := newReadConfig([]ReadOption{withCompare(comparePlainRecords), WithDescending(), WithDeduplication(nil)})
+	it, err = byOrder.sorted([]iterator.RecordIterator{plainRecordIterator(9, 5, 5, 1), plainRecordIterator(5, 2)})
+	require.NoError(t, err)
+	assert.Equal(t, []int{9, 5, 2, 1}, collectKeys(t, it))
+}
@@ -2,6 +2,8 @@ package gcsext
 
 const (
 	bufferSize = 1024 * 1024 * 5 // 5 MBytes
+
+	defaultMaxOpenReaders = 100 // Max number of objects read concurrently when merging globally
 )
 
 var (
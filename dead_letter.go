@@ -0,0 +1,173 @@
+package gcsext
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/kvanticoss/goutils/eioutil"
+	"github.com/kvanticoss/goutils/gzip"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/writerfactory"
+
+	"cloud.google.com/go/storage"
+)
+
+// ErrTooManyDeadLetters is returned once more records than the threshold of a DeadLetterQueue has failed to decode
+var ErrTooManyDeadLetters = errors.New("too many records failed to decode")
+
+// DeadLetter is the NDJSON entry written to the dead letter object for each record that failed to decode
+type DeadLetter struct {
+	Object     string `json:"object"`
+	Generation int64  `json:"generation"`
+	Line       int64  `json:"line"`
+	Raw        string `json:"raw"`
+	Error      string `json:"error"`
+}
+
+// DeadLetterQueue quarantines records that fails to decode (see RecordDecodeError) into a single object instead of
+// aborting the iteration; NDJSON unless the path has the suffix of another format (see FormatByName). It is safe for
+// concurrent use.
+type DeadLetterQueue struct {
+	wf        writerfactory.WriterFactory
+	path      string
+	format    Format
+	threshold int
+
+	mu     sync.Mutex
+	base   eioutil.WriteCloser // The writer from the factory; aborted on failed writes
+	w      io.WriteCloser      // base, or a gzip writer on top of it for paths ending in .gz
+	enc    RecordEncoder
+	counts map[string]int
+	total  int
+}
+
+// NewDeadLetterQueue creates a DeadLetterQueue writing to path through the writer factory (e.g GetGCSWriterFactory); the
+// object is only created once the first record is quarantined. Once more than threshold records has been quarantined the
+// iteration fails with ErrTooManyDeadLetters; a threshold <= 0 tolerates any number of bad records. Like WriteRecords the
+// object is gzipped if path ends with .gz. An error is returned if the format of the path can't encode records (e.g.
+// .avro without a writer schema; see NewAvroFormat).
+func NewDeadLetterQueue(wf writerfactory.WriterFactory, path string, threshold int) (*DeadLetterQueue, error) {
+	format := FormatByName(path)
+	enc, err := format.NewEncoder(io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("dead letter queue %s: %w", path, err)
+	}
+	enc.Close()
+	return &DeadLetterQueue{
+		wf:        wf,
+		path:      path,
+		format:    format,
+		threshold: threshold,
+		counts:    map[string]int{},
+	}, nil
+}
+
+// Add writes the failed record to the dead letter object
+func (q *DeadLetterQueue) Add(objAttr *storage.ObjectAttrs, decodeErr *RecordDecodeError) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.enc == nil {
+		base, err := q.wf(q.path)
+		if err != nil {
+			return err
+		}
+		var w io.WriteCloser = base
+		if strings.HasSuffix(q.path, ".gz") {
+			w = gzip.NewWriter(w)
+		}
+		enc, err := q.format.NewEncoder(w)
+		if err != nil {
+			abortWriter(base)
+			return err
+		}
+		q.base, q.w, q.enc = base, w, enc
+	}
+
+	q.total++
+	q.counts[objAttr.Name]++
+	if err := q.enc.Encode(&DeadLetter{
+		Object:     objAttr.Name,
+		Generation: objAttr.Generation,
+		Line:       decodeErr.Line,
+		Raw:        string(decodeErr.Raw),
+		Error:      decodeErr.Err.Error(),
+	}); err != nil {
+		q.abort()
+		return err
+	}
+
+	if q.threshold > 0 && q.total > q.threshold {
+		return fmt.Errorf("%w; %d records quarantined in %s (last %s line %d)", ErrTooManyDeadLetters, q.total, q.path, objAttr.Name, decodeErr.Line)
+	}
+	return nil
+}
+
+// Count returns the total number of quarantined records
+func (q *DeadLetterQueue) Count() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.total
+}
+
+// Counts returns the number of quarantined records per source object
+func (q *DeadLetterQueue) Counts() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := make(map[string]int, len(q.counts))
+	for k, v := range q.counts {
+		res[k] = v
+	}
+	return res
+}
+
+// Close flushes and closes the dead letter object (if any records were quarantined). Must be called once the iteration
+// is done; for GCS writers the object isn't created until Close.
+func (q *DeadLetterQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.w == nil {
+		return nil
+	}
+	if err := q.enc.Close(); err != nil {
+		q.abort()
+		return err
+	}
+	err := q.w.Close()
+	q.base, q.w, q.enc = nil, nil, nil
+	return err
+}
+
+// abort discards the dead letter object after a failed write (see GetGCSWriterFactory) rather than committing a
+// truncated one; the caller must hold q.mu
+func (q *DeadLetterQueue) abort() {
+	abortWriter(q.base)
+	q.base, q.w, q.enc = nil, nil, nil
+}
+
+// quarantine returns an iterator which hands records failing to decode over to the queue and continues with the next one
+func (q *DeadLetterQueue) quarantine(objAttr *storage.ObjectAttrs, it iterator.RecordIterator) iterator.RecordIterator {
+	return func() (interface{}, error) {
+		for {
+			rec, err := it()
+			decodeErr, ok := err.(*RecordDecodeError)
+			if !ok {
+				return rec, err
+			}
+			if err := q.Add(objAttr, decodeErr); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// WithDeadLetterQueue makes the record iterators tolerant to records that can't be decoded; instead of failing they are
+// written to the DeadLetterQueue (together with the source object, generation and line number).
+func WithDeadLetterQueue(q *DeadLetterQueue) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.deadLetters = q
+	}
+}
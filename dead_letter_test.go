@@ -0,0 +1,52 @@
+package gcsext_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	gcsext "github.com/kvanticoss/google-cloudstorage-ext"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/writerfactory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONFormatDecodesPrettyPrintedRecords(t *testing.T) {
+	it := gcsext.JSONFormat.NewDecoder(bytes.NewBufferString("{\"Var2\":1} {\"Var2\":2}\n{\n  \"Var2\": 3\n}\n"), func() interface{} {
+		return &testStruct{}
+	})
+
+	for _, want := range []int{1, 2, 3} {
+		rec, err := it()
+		require.NoError(t, err)
+		assert.Equal(t, want, rec.(*testStruct).Var2)
+	}
+	_, err := it()
+	assert.EqualError(t, err, iterator.ErrIteratorStop.Error())
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	buffers, wf := writerfactory.GetMemoryWriterFactory()
+	q, err := gcsext.NewDeadLetterQueue(wf, "dead/letters.json", 2)
+	require.NoError(t, err)
+	obj := &storage.ObjectAttrs{Name: "folder/file.json", Generation: 42}
+
+	assert.NoError(t, q.Add(obj, &gcsext.RecordDecodeError{Line: 2, Raw: []byte("{broken"), Err: errors.New("bad")}))
+	assert.NoError(t, q.Add(obj, &gcsext.RecordDecodeError{Line: 7, Raw: []byte("nope"), Err: errors.New("bad")}))
+	err = q.Add(&storage.ObjectAttrs{Name: "folder/other.json"}, &gcsext.RecordDecodeError{Line: 1, Err: errors.New("bad")})
+	assert.True(t, errors.Is(err, gcsext.ErrTooManyDeadLetters), "expected the threshold to be enforced; got %v", err)
+	require.NoError(t, q.Close())
+
+	assert.Equal(t, 3, q.Count())
+	assert.Equal(t, map[string]int{"folder/file.json": 2, "folder/other.json": 1}, q.Counts())
+
+	lines := strings.Split(strings.TrimSpace(buffers["dead/letters.json"].String()), "\n")
+	require.Len(t, lines, 3)
+	first := gcsext.DeadLetter{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, gcsext.DeadLetter{Object: "folder/file.json", Generation: 42, Line: 2, Raw: "{broken", Error: "bad"}, first)
+}
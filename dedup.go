@@ -0,0 +1,81 @@
+package gcsext
+
+import (
+	"github.com/kvanticoss/goutils/iterator"
+)
+
+// MergeFunc combines two records sharing the same primary key into the record to keep; kept is the result of the
+// previous merges of the group and next is the following record in the sorted stream.
+type MergeFunc func(kept, next interface{}) interface{}
+
+// KeepFirst is a MergeFunc keeping the first record of each key
+func KeepFirst(kept, next interface{}) interface{} {
+	return kept
+}
+
+// KeepLast is a MergeFunc keeping the last record of each key in the sorted stream
+func KeepLast(kept, next interface{}) interface{} {
+	return next
+}
+
+// KeepLatest returns a MergeFunc keeping the record with the highest version (e.g. an updated timestamp or a sequence
+// number) of each key; last write wins. On equal versions the later record in the sorted stream is kept.
+func KeepLatest(version KeyExtractor) MergeFunc {
+	return func(kept, next interface{}) interface{} {
+		if CompareKeys(version(next), version(kept)) >= 0 {
+			return next
+		}
+		return kept
+	}
+}
+
+// WithKeyDeduplication reduces all records sharing a primary key to a single record by folding them with merge (e.g.
+// KeepLatest for last write wins semantics, KeepFirst or a custom merge). Records with the same key must be adjacent in
+// the sorted stream; i.e. the sort order must start with the primary key. For SortGCSFolders it implies
+// removeDuplicates and the existing destination records take part in the merge.
+func WithKeyDeduplication(key KeyExtractor, merge MergeFunc) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.deduplicate = true
+		cfg.dedupKey = key
+		cfg.dedupMerge = merge
+	}
+}
+
+// WithLastWriteWins is short for WithKeyDeduplication(key, KeepLatest(version))
+func WithLastWriteWins(key, version KeyExtractor) ReadOption {
+	return WithKeyDeduplication(key, KeepLatest(version))
+}
+
+// removeDuplicates reduces each run of duplicates in the sorted stream to a single record
+func (cfg *readConfig) removeDuplicates(it iterator.RecordIterator) iterator.RecordIterator {
+	if cfg.dedupMerge == nil {
+		return deduplicateAdjacent(it, cfg.duplicates())
+	}
+	return mergeAdjacent(it, cfg.duplicates(), cfg.dedupMerge)
+}
+
+// mergeAdjacent folds each run of adjacent equal records into one using merge. Errors from the underlying iterator are
+// returned after the record preceding them.
+func mergeAdjacent(it iterator.RecordIterator, equal func(a, b interface{}) bool, merge MergeFunc) iterator.RecordIterator {
+	var next interface{}
+	var nextErr error
+	started := false
+	return func() (interface{}, error) {
+		if !started {
+			next, nextErr = it()
+			started = true
+		}
+		if nextErr != nil {
+			return nil, nextErr
+		}
+
+		kept := next
+		for {
+			next, nextErr = it()
+			if nextErr != nil || !equal(kept, next) {
+				return kept, nil
+			}
+			kept = merge(kept, next)
+		}
+	}
+}
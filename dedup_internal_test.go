@@ -0,0 +1,61 @@
+package gcsext
+
+import (
+	"testing"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func versionedRecords(records ...plainRecord) iterator.RecordIterator {
+	return func() (interface{}, error) {
+		if len(records) == 0 {
+			return nil, iterator.ErrIteratorStop
+		}
+		rec := records[0]
+		records = records[1:]
+		return &rec, nil
+	}
+}
+
+func collectRecords(t *testing.T, it iterator.RecordIterator) []plainRecord {
+	res := []plainRecord{}
+	var rec interface{}
+	var err error
+	for rec, err = it(); err == nil; rec, err = it() {
+		res = append(res, *rec.(*plainRecord))
+	}
+	require.EqualError(t, err, iterator.ErrIteratorStop.Error())
+	return res
+}
+
+func TestKeyDeduplication(t *testing.T) {
+	key := func(r interface{}) Key { return Key{r.(*plainRecord).Key} }
+	version := func(r interface{}) Key { return Key{r.(*plainRecord).Value} }
+	sources := func() []iterator.RecordIterator {
+		return []iterator.RecordIterator{
+			versionedRecords(plainRecord{1, "b"}, plainRecord{2, "a"}, plainRecord{3, "c"}),
+			versionedRecords(plainRecord{1, "c"}, plainRecord{1, "a"}, plainRecord{3, "a"}),
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		opt      ReadOption
+		expected []plainRecord
+	}{
+		"latest": {WithLastWriteWins(key, version), []plainRecord{{1, "c"}, {2, "a"}, {3, "c"}}},
+		"first":  {WithKeyDeduplication(key, KeepFirst), []plainRecord{{1, "b"}, {2, "a"}, {3, "c"}}},
+		"last":   {WithKeyDeduplication(key, KeepLast), []plainRecord{{1, "a"}, {2, "a"}, {3, "a"}}},
+		"merge": {WithKeyDeduplication(key, func(kept, next interface{}) interface{} {
+			return &plainRecord{Key: kept.(*plainRecord).Key, Value: kept.(*plainRecord).Value + next.(*plainRecord).Value}
+		}), []plainRecord{{1, "bca"}, {2, "a"}, {3, "ca"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := newReadConfig([]ReadOption{withCompare(comparePlainRecords), tc.opt})
+			it, err := cfg.sorted(sources())
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, collectRecords(t, it))
+		})
+	}
+}
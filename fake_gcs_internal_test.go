@@ -0,0 +1,541 @@
+package gcsext
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/kvanticoss/goutils/backoff"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+)
+
+const fakeBucket = "fake-bucket"
+
+// fakeGCS is an in memory stand in for the parts of the GCS JSON API (and the XML API for reads) used by this package;
+// one bucket, no object versioning. Updated follows the local clock, shifted by the skew of the server, and is strictly
+// increasing.
+type fakeGCS struct {
+	mu         sync.Mutex
+	objects    map[string]*fakeObject
+	generation int64
+	now        time.Time
+
+	// pageSize bounds the number of objects per listing page
+	pageSize int
+
+	// skew shifts the clock of the server from the local one
+	skew time.Duration
+
+	// hook is called before each request with the operation (list, get, read, insert, patch, delete or rewrite) and
+	// object name; returning a non zero status code fails the request with it
+	hook func(op, name string) int
+}
+
+type fakeObject struct {
+	attrs raw.Object
+	data  []byte
+}
+
+// newFakeGCS starts a fakeGCS and returns a handle to its bucket. It sets STORAGE_EMULATOR_HOST for the duration of the
+// test; tests using it can't run in parallel.
+func newFakeGCS(t *testing.T) (*fakeGCS, *storage.BucketHandle) {
+	f := &fakeGCS{
+		objects:  map[string]*fakeObject{},
+		now:      time.Now().UTC(),
+		pageSize: 3,
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	t.Setenv("STORAGE_EMULATOR_HOST", u.Host)
+
+	client, err := storage.NewClient(
+		context.Background(),
+		option.WithEndpoint(srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication(),
+	)
+	require.NoError(t, err)
+	return f, client.Bucket(fakeBucket)
+}
+
+// put stores an object directly; returning its attributes as listed
+func (f *fakeGCS) put(name, data string, metadata map[string]string) *storage.ObjectAttrs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj := f.store(&raw.Object{Name: name, Metadata: metadata}, []byte(data))
+	return fakeAttrs(obj)
+}
+
+// putKeys stores plainRecords with the keys as a JSON object
+func (f *fakeGCS) putKeys(name string, keys ...int) *storage.ObjectAttrs {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, key := range keys {
+		enc.Encode(&plainRecord{Key: key, Value: name})
+	}
+	return f.put(name, buf.String(), nil)
+}
+
+// keys returns the keys of the plainRecords in the JSON object; nil if it doesn't exist
+func (f *fakeGCS) keys(t *testing.T, name string) []int {
+	data, ok := f.content(name)
+	if !ok {
+		return nil
+	}
+	keys := []int{}
+	dec := json.NewDecoder(strings.NewReader(data))
+	for dec.More() {
+		rec := &plainRecord{}
+		require.NoError(t, dec.Decode(rec))
+		keys = append(keys, rec.Key)
+	}
+	return keys
+}
+
+// noBackoff retries immediately; see WithRetryPolicy
+func noBackoff(attempts int) *backoff.RandExpBackoff {
+	var bo *backoff.RandExpBackoff
+	return bo.WithScale(0).WithMaxAttempts(attempts)
+}
+
+// content returns the data of the object; ok is false if it doesn't exist
+func (f *fakeGCS) content(name string) (data string, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[name]
+	if !ok {
+		return "", false
+	}
+	return string(obj.data), true
+}
+
+// attrs returns the attributes of the object or nil if it doesn't exist
+func (f *fakeGCS) attrs(name string) *storage.ObjectAttrs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[name]
+	if !ok {
+		return nil
+	}
+	return fakeAttrs(obj)
+}
+
+// names returns the names of all objects in order
+func (f *fakeGCS) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.objects))
+	for name := range f.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fakeAttrs converts the stored attributes like the storage client does
+func fakeAttrs(obj *fakeObject) *storage.ObjectAttrs {
+	updated, _ := time.Parse(time.RFC3339Nano, obj.attrs.Updated)
+	return &storage.ObjectAttrs{
+		Bucket:         fakeBucket,
+		Name:           obj.attrs.Name,
+		Generation:     obj.attrs.Generation,
+		Metageneration: obj.attrs.Metageneration,
+		Size:           int64(obj.attrs.Size),
+		ContentType:    obj.attrs.ContentType,
+		Metadata:       obj.attrs.Metadata,
+		Created:        updated,
+		Updated:        updated,
+	}
+}
+
+// tick advances the clock of the bucket to the (skewed) current time; strictly increasing so every update is ordered,
+// even once the skew is turned back. f.mu must be held.
+func (f *fakeGCS) tick() {
+	now := time.Now().UTC().Add(f.skew)
+	if !now.After(f.now) {
+		now = f.now.Add(time.Microsecond)
+	}
+	f.now = now
+}
+
+// store saves a new generation of the object; f.mu must be held
+func (f *fakeGCS) store(attrs *raw.Object, data []byte) *fakeObject {
+	f.generation++
+	f.tick()
+	obj := &fakeObject{
+		attrs: raw.Object{
+			Kind:           "storage#object",
+			Bucket:         fakeBucket,
+			Name:           attrs.Name,
+			ContentType:    attrs.ContentType,
+			Metadata:       attrs.Metadata,
+			Generation:     f.generation,
+			Metageneration: 1,
+			Size:           uint64(len(data)),
+			TimeCreated:    f.now.Format(time.RFC3339Nano),
+			Updated:        f.now.Format(time.RFC3339Nano),
+		},
+		data: data,
+	}
+	f.objects[attrs.Name] = obj
+	return obj
+}
+
+// checkConditions validates the if(Meta)generation(Not)Match parameters against the object (nil if missing)
+func checkConditions(q url.Values, obj *fakeObject) int {
+	var generation, metageneration int64
+	if obj != nil {
+		generation, metageneration = obj.attrs.Generation, obj.attrs.Metageneration
+	}
+	check := func(param string, actual int64, match bool) bool {
+		v := q.Get(param)
+		if v == "" {
+			return true
+		}
+		want, _ := strconv.ParseInt(v, 10, 64)
+		return (want == actual) == match
+	}
+	if !check("ifGenerationMatch", generation, true) || !check("ifGenerationNotMatch", generation, false) {
+		return http.StatusPreconditionFailed
+	}
+	if q.Get("ifMetagenerationMatch") != "" && obj == nil {
+		return http.StatusPreconditionFailed
+	}
+	if !check("ifMetagenerationMatch", metageneration, true) || !check("ifMetagenerationNotMatch", metageneration, false) {
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The storage Writer points the client at the bare emulator host once it is used; accept both forms
+	const api = "/b/" + fakeBucket + "/o"
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/storage/v1")
+	switch {
+	case path == api && r.Method == http.MethodGet:
+		f.list(w, r)
+	case path == api && r.Method == http.MethodPost:
+		f.insert(w, r)
+	case strings.HasPrefix(path, api+"/"):
+		segments := strings.Split(strings.TrimPrefix(path, api+"/"), "/")
+		name, err := url.PathUnescape(segments[0])
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(segments) == 6 && segments[1] == "rewriteTo" {
+			dst, _ := url.PathUnescape(segments[5])
+			f.rewrite(w, r, name, dst)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			f.get(w, r, name)
+		case http.MethodPatch:
+			f.patch(w, r, name)
+		case http.MethodDelete:
+			f.delete(w, r, name)
+		default:
+			fakeError(w, http.StatusMethodNotAllowed, r.Method)
+		}
+	case strings.HasPrefix(r.URL.Path, "/"+fakeBucket+"/"):
+		f.read(w, r, strings.TrimPrefix(r.URL.Path, "/"+fakeBucket+"/"))
+	default:
+		fakeError(w, http.StatusNotFound, r.URL.Path)
+	}
+}
+
+func fakeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+func fakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// intercept calls the hook; f.mu must be held
+func (f *fakeGCS) intercept(w http.ResponseWriter, op, name string) bool {
+	if f.hook == nil {
+		return false
+	}
+	if code := f.hook(op, name); code != 0 {
+		fakeError(w, code, "injected by test")
+		return true
+	}
+	return false
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	if f.intercept(w, "list", prefix) {
+		return
+	}
+
+	names := make([]string, 0, len(f.objects))
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) && name > q.Get("pageToken") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	res := &raw.Objects{Kind: "storage#objects"}
+	seen := map[string]bool{}
+	last := ""
+	for _, name := range names {
+		if len(res.Items)+len(res.Prefixes) == f.pageSize {
+			res.NextPageToken = last
+			break
+		}
+		last = name
+		if i := strings.Index(name[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			if p := name[:len(prefix)+i+len(delimiter)]; !seen[p] {
+				seen[p] = true
+				res.Prefixes = append(res.Prefixes, p)
+			}
+			continue
+		}
+		obj := f.objects[name].attrs
+		res.Items = append(res.Items, &obj)
+	}
+	fakeJSON(w, res)
+}
+
+func (f *fakeGCS) get(w http.ResponseWriter, r *http.Request, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.intercept(w, "get", name) {
+		return
+	}
+	obj, ok := f.objects[name]
+	if !ok || (r.URL.Query().Get("generation") != "" && r.URL.Query().Get("generation") != strconv.FormatInt(obj.attrs.Generation, 10)) {
+		fakeError(w, http.StatusNotFound, "no such object: "+name)
+		return
+	}
+	if code := checkConditions(r.URL.Query(), obj); code != 0 {
+		fakeError(w, code, "conditions not met")
+		return
+	}
+	fakeJSON(w, obj.attrs)
+}
+
+func (f *fakeGCS) read(w http.ResponseWriter, r *http.Request, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.intercept(w, "read", name) {
+		return
+	}
+	obj, ok := f.objects[name]
+	if !ok || (r.URL.Query().Get("generation") != "" && r.URL.Query().Get("generation") != strconv.FormatInt(obj.attrs.Generation, 10)) {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+
+	data, status := obj.data, http.StatusOK
+	if rng := strings.TrimPrefix(r.Header.Get("Range"), "bytes="); rng != "" {
+		start, end := int64(0), int64(len(data))-1
+		parts := strings.SplitN(rng, "-", 2)
+		if parts[0] == "" {
+			n, _ := strconv.ParseInt(parts[1], 10, 64)
+			start = end + 1 - n
+		} else {
+			start, _ = strconv.ParseInt(parts[0], 10, 64)
+			if len(parts) == 2 && parts[1] != "" {
+				end, _ = strconv.ParseInt(parts[1], 10, 64)
+			}
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data, status = data[start:end+1], http.StatusPartialContent
+	}
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(obj.attrs.Generation, 10))
+	w.Header().Set("X-Goog-Metageneration", strconv.FormatInt(obj.attrs.Metageneration, 10))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (f *fakeGCS) insert(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		fakeError(w, http.StatusBadRequest, "only multipart uploads are supported")
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	attrs := &raw.Object{}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(attrs)
+	}
+	var data []byte
+	if err == nil {
+		if part, err = mr.NextPart(); err == nil {
+			data, err = ioutil.ReadAll(part)
+		}
+	}
+	if err == nil {
+		if _, err = mr.NextPart(); err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		// e.g. an upload cancelled half way
+		fakeError(w, http.StatusBadRequest, "incomplete upload: "+err.Error())
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		attrs.Name = name
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.intercept(w, "insert", attrs.Name) {
+		return
+	}
+	if code := checkConditions(r.URL.Query(), f.objects[attrs.Name]); code != 0 {
+		fakeError(w, code, "conditions not met")
+		return
+	}
+	fakeJSON(w, f.store(attrs, data).attrs)
+}
+
+func (f *fakeGCS) patch(w http.ResponseWriter, r *http.Request, name string) {
+	update := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.intercept(w, "patch", name) {
+		return
+	}
+	obj, ok := f.objects[name]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "no such object: "+name)
+		return
+	}
+	if code := checkConditions(r.URL.Query(), obj); code != 0 {
+		fakeError(w, code, "conditions not met")
+		return
+	}
+
+	updated := *obj
+	updated.attrs.Metadata = map[string]string{}
+	for k, v := range obj.attrs.Metadata {
+		updated.attrs.Metadata[k] = v
+	}
+	if rawMetadata, ok := update["metadata"]; ok {
+		metadata := map[string]*string{}
+		if err := json.Unmarshal(rawMetadata, &metadata); err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if metadata == nil {
+			updated.attrs.Metadata = map[string]string{}
+		}
+		for k, v := range metadata {
+			if v == nil {
+				delete(updated.attrs.Metadata, k)
+			} else {
+				updated.attrs.Metadata[k] = *v
+			}
+		}
+	}
+	f.tick()
+	updated.attrs.Metageneration++
+	updated.attrs.Updated = f.now.Format(time.RFC3339Nano)
+	f.objects[name] = &updated
+	fakeJSON(w, updated.attrs)
+}
+
+func (f *fakeGCS) delete(w http.ResponseWriter, r *http.Request, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.intercept(w, "delete", name) {
+		return
+	}
+	obj, ok := f.objects[name]
+	if !ok || (r.URL.Query().Get("generation") != "" && r.URL.Query().Get("generation") != strconv.FormatInt(obj.attrs.Generation, 10)) {
+		fakeError(w, http.StatusNotFound, "no such object: "+name)
+		return
+	}
+	if code := checkConditions(r.URL.Query(), obj); code != 0 {
+		fakeError(w, code, "conditions not met")
+		return
+	}
+	delete(f.objects, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGCS) rewrite(w http.ResponseWriter, r *http.Request, src, dst string) {
+	attrs := &raw.Object{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, attrs); err != nil {
+			fakeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.intercept(w, "rewrite", dst) {
+		return
+	}
+	q := r.URL.Query()
+	obj, ok := f.objects[src]
+	if !ok || (q.Get("sourceGeneration") != "" && q.Get("sourceGeneration") != strconv.FormatInt(obj.attrs.Generation, 10)) {
+		fakeError(w, http.StatusNotFound, "no such object: "+src)
+		return
+	}
+	if code := checkConditions(q, f.objects[dst]); code != 0 {
+		fakeError(w, code, "conditions not met")
+		return
+	}
+	copied := &raw.Object{Name: dst, ContentType: obj.attrs.ContentType, Metadata: obj.attrs.Metadata}
+	if attrs.Metadata != nil {
+		copied.Metadata = attrs.Metadata
+	}
+	res := f.store(copied, obj.data)
+	fakeJSON(w, &raw.RewriteResponse{
+		Kind:                "storage#rewriteResponse",
+		Done:                true,
+		ObjectSize:          int64(len(obj.data)),
+		TotalBytesRewritten: int64(len(obj.data)),
+		Resource:            &res.attrs,
+	})
+}
@@ -0,0 +1,160 @@
+package gcsext
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kvanticoss/goutils/gzip"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/writerfactory"
+	"github.com/pkg/errors"
+)
+
+// RecordDecodeError is returned by decoders for a single record that couldn't be decoded while the rest of the stream
+// still can be; calling the iterator again continues with the next record. See WithDeadLetterQueue.
+type RecordDecodeError struct {
+	Line int64  // 1-based line (or record) number within the object
+	Raw  []byte // The raw bytes of the offending record
+	Err  error
+}
+
+func (e *RecordDecodeError) Error() string {
+	return fmt.Sprintf("failed to decode record at line %d: %v", e.Line, e.Err)
+}
+
+// RecordEncoder writes records, one at a time, to an underlying writer. Close flushes any buffered
+// state (blocks, footers etc) but does NOT close the underlying writer.
+type RecordEncoder interface {
+	Encode(record interface{}) error
+	Close() error
+}
+
+// Format describes how records are (de)serialized inside a GCS object.
+type Format interface {
+	// Extensions returns the object name suffixes (excluding any .gz suffix) that the format handles, e.g ".json"
+	Extensions() []string
+
+	// NewDecoder returns a RecordIterator which yields records decoded from r into instances created by new.
+	// Once the stream is exhausted ErrIteratorStop is returned and r is closed if it is an io.Closer.
+	NewDecoder(r io.Reader, new func() interface{}) iterator.RecordIterator
+
+	// NewEncoder returns a RecordEncoder writing records to w
+	NewEncoder(w io.Writer) (RecordEncoder, error)
+}
+
+// lineDecoderFormat is implemented by formats which can decode each line on its own; used with a DeadLetterQueue so a
+// record failing to decode doesn't stop the rest of the object from being read (see RecordDecodeError). Like
+// newOffsetDecoder the returned func reports where the last record returned starts.
+type lineDecoderFormat interface {
+	newLineDecoder(r io.Reader, new func() interface{}) (iterator.RecordIterator, func() int64)
+}
+
+// offsetDecoderFormat is implemented by formats which can tell the byte offset (in the decompressed object) at which
+// the last record returned by the decoder starts; used to locate out of order records (see UnsortedObjectError)
+type offsetDecoderFormat interface {
+	newOffsetDecoder(r io.Reader, new func() interface{}) (iterator.RecordIterator, func() int64)
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]Format{}
+)
+
+func init() {
+	RegisterFormat(JSONFormat)
+	RegisterFormat(CSVFormat)
+	RegisterFormat(AvroFormat)
+	RegisterFormat(ParquetFormat)
+	RegisterFormat(ProtobufFormat)
+}
+
+// RegisterFormat makes a format available for suffix based lookups through FormatByName. Registering a format
+// for an already registered extension replaces the previous one; useful to e.g register an Avro format with a writer schema.
+func RegisterFormat(f Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	for _, ext := range f.Extensions() {
+		formats[ext] = f
+	}
+}
+
+// FormatByName selects a registered format from the suffix of an object name (ignoring a trailing .gz).
+// The longest matching extension wins and objects with unknown suffixes default to JSONFormat (newline delimited JSON).
+func FormatByName(name string) Format {
+	name = strings.TrimSuffix(name, ".gz")
+
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	exts := make([]string, 0, len(formats))
+	for ext := range formats {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		return len(exts[i]) > len(exts[j])
+	})
+	for _, ext := range exts {
+		if strings.HasSuffix(name, ext) {
+			return formats[ext]
+		}
+	}
+	return JSONFormat
+}
+
+// EncodeRecords writes all records from the iterator through the encoder. Like recordwriter.NewLineJSON the
+// error of the iterator (normally ErrIteratorStop) is returned once exhausted. The encoder is not closed.
+func EncodeRecords(it iterator.RecordIterator, enc RecordEncoder) error {
+	var record interface{}
+	var err error
+	for record, err = it(); err == nil; record, err = it() {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// WriteRecords writes all records from the iterator to path through the writer factory (e.g GetGCSWriterFactory) in the
+// format registered for the path's extension; gzipped if it ends with .gz. On errors the writer is aborted if it has an
+// Abort method (like the GCS writers) so no partial object is created; other writers are closed.
+func WriteRecords(wf writerfactory.WriterFactory, path string, it iterator.RecordIterator) error {
+	base, err := wf(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to create writer")
+	}
+	var w io.WriteCloser = base
+	if strings.HasSuffix(path, ".gz") {
+		w = gzip.NewWriter(w)
+	}
+	enc, err := FormatByName(path).NewEncoder(w)
+	if err != nil {
+		abortWriter(base)
+		return errors.Wrap(err, "failed to create record encoder")
+	}
+	if err = EncodeRecords(it, enc); err != nil && err != iterator.ErrIteratorStop {
+		abortWriter(base)
+		return errors.Wrap(err, "failed to write records")
+	}
+	if err = enc.Close(); err != nil {
+		abortWriter(base)
+		return errors.Wrap(err, "failed to flush records")
+	}
+	return w.Close()
+}
+
+// isEmpty reports whether there is nothing more to read from br
+func isEmpty(br *bufio.Reader) bool {
+	_, err := br.Peek(1)
+	return err == io.EOF
+}
+
+// closeIfCloser closes r if it implements io.Closer; used by decoders once their stream is exhausted
+func closeIfCloser(r io.Reader) {
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+}
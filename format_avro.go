@@ -0,0 +1,70 @@
+package gcsext
+
+import (
+	"bufio"
+	"errors"
+	"io"
+
+	"github.com/kvanticoss/goutils/iterator"
+
+	"github.com/hamba/avro/v2/ocf"
+)
+
+// ErrAvroSchemaRequired is returned when trying to write Avro without a writer schema; see NewAvroFormat
+var ErrAvroSchemaRequired = errors.New("avro: a writer schema is required to encode records; register a format from NewAvroFormat(schema)")
+
+// AvroFormat reads Avro Object Container Files (the schema is embedded in the file). Records are decoded into
+// structs using `avro:"name"` tags. AvroFormat has no writer schema and can't encode records; use NewAvroFormat for that.
+var AvroFormat = NewAvroFormat("")
+
+// NewAvroFormat returns an Avro Object Container File format which writes records using the given schema.
+// Use RegisterFormat(NewAvroFormat(schema)) to make it the default for objects ending in .avro
+func NewAvroFormat(schema string) Format {
+	return avroFormat{schema: schema}
+}
+
+type avroFormat struct {
+	schema string
+}
+
+func (avroFormat) Extensions() []string {
+	return []string{".avro"}
+}
+
+func (avroFormat) NewDecoder(r io.Reader, new func() interface{}) iterator.RecordIterator {
+	var dec *ocf.Decoder
+	return func() (interface{}, error) {
+		if dec == nil {
+			br := bufio.NewReader(r)
+			if isEmpty(br) { // e.g. a destination file created by TouchFile
+				closeIfCloser(r)
+				return nil, iterator.ErrIteratorStop
+			}
+			var err error
+			if dec, err = ocf.NewDecoder(br); err != nil {
+				return nil, err
+			}
+		}
+
+		if !dec.HasNext() {
+			closeIfCloser(r)
+			if err := dec.Error(); err != nil {
+				return nil, err
+			}
+			return nil, iterator.ErrIteratorStop
+		}
+		dst := new()
+		return dst, dec.Decode(dst)
+	}
+}
+
+func (f avroFormat) NewEncoder(w io.Writer) (RecordEncoder, error) {
+	if f.schema == "" {
+		return nil, ErrAvroSchemaRequired
+	}
+	enc, err := ocf.NewEncoder(f.schema, w)
+	if err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
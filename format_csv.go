@@ -0,0 +1,307 @@
+package gcsext
+
+import (
+	"encoding"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/pkg/errors"
+)
+
+// CSVFormat reads and writes comma separated values with a header row. Columns are matched against struct
+// fields through the `csv:"name"` tag or (case insensitively) the field name. Records may also be
+// *map[string]string in which case every column is kept. Fields tagged `csv:"-"` are ignored.
+// Rows that fail to parse are reported as *RecordDecodeError.
+var CSVFormat Format = csvFormat{}
+
+type csvFormat struct{}
+
+func (csvFormat) Extensions() []string {
+	return []string{".csv"}
+}
+
+func (f csvFormat) NewDecoder(r io.Reader, new func() interface{}) iterator.RecordIterator {
+	it, _ := f.newOffsetDecoder(r, new)
+	return it
+}
+
+// newOffsetDecoder is NewDecoder keeping track of where each row starts; see offsetDecoderFormat
+func (csvFormat) newOffsetDecoder(r io.Reader, new func() interface{}) (iterator.RecordIterator, func() int64) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = false
+	var header []string
+	var start int64
+	return func() (interface{}, error) {
+		if header == nil {
+			var err error
+			if header, err = cr.Read(); err == io.EOF {
+				closeIfCloser(r)
+				return nil, iterator.ErrIteratorStop
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		start = cr.InputOffset()
+		row, err := cr.Read()
+		if err == io.EOF {
+			closeIfCloser(r)
+			return nil, iterator.ErrIteratorStop
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			return nil, &RecordDecodeError{Line: int64(parseErr.StartLine), Raw: []byte(strings.Join(row, ",")), Err: parseErr}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dst := new()
+		if err := csvUnmarshal(header, row, dst); err != nil {
+			line, _ := cr.FieldPos(0)
+			return nil, &RecordDecodeError{Line: int64(line), Raw: []byte(strings.Join(row, ",")), Err: err}
+		}
+		return dst, nil
+	}, func() int64 { return start }
+}
+
+func (csvFormat) NewEncoder(w io.Writer) (RecordEncoder, error) {
+	return &csvEncoder{w: csv.NewWriter(w)}, nil
+}
+
+type csvEncoder struct {
+	w      *csv.Writer
+	header []string
+}
+
+func (e *csvEncoder) Encode(record interface{}) error {
+	if e.header == nil {
+		e.header = csvHeader(record)
+		if err := e.w.Write(e.header); err != nil {
+			return err
+		}
+	}
+	row, err := csvMarshal(e.header, record)
+	if err != nil {
+		return err
+	}
+	return e.w.Write(row)
+}
+
+func (e *csvEncoder) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csvFields maps lower cased column names to struct field indexes
+func csvFields(t reflect.Type) (names []string, index map[string][]int) {
+	index = map[string][]int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("csv"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag = strings.Split(tag, ",")[0]; tag != "" {
+				name = tag
+			}
+		}
+		names = append(names, name)
+		index[strings.ToLower(name)] = f.Index
+	}
+	return names, index
+}
+
+func csvHeader(record interface{}) []string {
+	v := reflect.Indirect(reflect.ValueOf(record))
+	if v.Kind() == reflect.Map {
+		keys := []string{}
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	names, _ := csvFields(v.Type())
+	return names
+}
+
+func csvMarshal(header []string, record interface{}) ([]string, error) {
+	v := reflect.Indirect(reflect.ValueOf(record))
+	row := make([]string, len(header))
+	if v.Kind() == reflect.Map {
+		for i, col := range header {
+			if val := v.MapIndex(reflect.ValueOf(col)); val.IsValid() {
+				row[i] = fmt.Sprint(val.Interface())
+			}
+		}
+		return row, nil
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("csv: can't encode records of type %T", record)
+	}
+
+	_, index := csvFields(v.Type())
+	for i, col := range header {
+		fieldIndex, ok := index[strings.ToLower(col)]
+		if !ok {
+			continue
+		}
+		s, err := csvFormatValue(v.FieldByIndex(fieldIndex))
+		if err != nil {
+			return nil, errors.Wrapf(err, "csv: failed to encode column %s", col)
+		}
+		row[i] = s
+	}
+	return row, nil
+}
+
+func csvUnmarshal(header, row []string, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("csv: can't decode into non pointer %T", dst)
+	}
+	v = v.Elem()
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() == reflect.Map {
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("csv: can only decode into map[string]string, not %s", v.Type())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for i, col := range header {
+			if i < len(row) {
+				v.SetMapIndex(reflect.ValueOf(col), reflect.ValueOf(row[i]))
+			}
+		}
+		return nil
+	}
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("csv: can't decode into %s", v.Type())
+	}
+
+	_, index := csvFields(v.Type())
+	for i, col := range header {
+		fieldIndex, ok := index[strings.ToLower(col)]
+		if !ok || i >= len(row) {
+			continue
+		}
+		if err := csvParseValue(v.FieldByIndex(fieldIndex), row[i]); err != nil {
+			return errors.Wrapf(err, "csv: failed to decode column %s", col)
+		}
+	}
+	return nil
+}
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+func csvFormatValue(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+	if v.Type().Implements(textMarshalerType) {
+		b, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(b), err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()), nil
+	}
+	return "", fmt.Errorf("unsupported type %s", v.Type())
+}
+
+func csvParseValue(v reflect.Value, s string) error {
+	if v.Kind() == reflect.Ptr {
+		if s == "" {
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.Type() == timeType {
+		if s == "" {
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	if s == "" && v.Kind() != reflect.String {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
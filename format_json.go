@@ -0,0 +1,101 @@
+package gcsext
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/kvanticoss/goutils/iterator"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// JSONFormat reads and writes newline delimited JSON; it is the default format for unknown suffixes. Records are read
+// as a stream of JSON values so pretty printed records and several records per line are fine. With a DeadLetterQueue
+// (see WithDeadLetterQueue) each line is decoded on its own instead; lines that fail to decode are then reported as
+// *RecordDecodeError and the rest of the object can still be read.
+var JSONFormat Format = jsonFormat{}
+
+var jsonRecordDelimiter = []byte("\n")
+
+type jsonFormat struct{}
+
+func (jsonFormat) Extensions() []string {
+	return []string{".json", ".ndjson", ".jsonl"}
+}
+
+func (jsonFormat) NewDecoder(r io.Reader, new func() interface{}) iterator.RecordIterator {
+	return iterator.JSONRecordIterator(new, r)
+}
+
+// newOffsetDecoder is NewDecoder keeping track of where each record starts; see offsetDecoderFormat
+func (jsonFormat) newOffsetDecoder(r io.Reader, new func() interface{}) (iterator.RecordIterator, func() int64) {
+	dec := json.NewDecoder(r)
+	var start int64
+	return func() (interface{}, error) {
+		if !dec.More() {
+			closeIfCloser(r)
+			return nil, iterator.ErrIteratorStop
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		start = dec.InputOffset() - int64(len(raw))
+		dst := new()
+		return dst, json.Unmarshal(raw, dst)
+	}, func() int64 { return start }
+}
+
+// newLineDecoder decodes one record per line; see lineDecoderFormat
+func (jsonFormat) newLineDecoder(r io.Reader, new func() interface{}) (iterator.RecordIterator, func() int64) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var line, offset, start int64
+	return func() (interface{}, error) {
+		for {
+			raw, err := br.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			line++
+			lineStart := offset
+			offset += int64(len(raw))
+
+			if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 {
+				start = lineStart + int64(bytes.Index(raw, trimmed))
+				dst := new()
+				if decodeErr := json.Unmarshal(trimmed, dst); decodeErr != nil {
+					return nil, &RecordDecodeError{Line: line, Raw: trimmed, Err: decodeErr}
+				}
+				return dst, nil
+			}
+
+			if err == io.EOF {
+				closeIfCloser(r)
+				return nil, iterator.ErrIteratorStop
+			}
+		}
+	}, func() int64 { return start }
+}
+
+func (jsonFormat) NewEncoder(w io.Writer) (RecordEncoder, error) {
+	return &jsonEncoder{w: w}, nil
+}
+
+type jsonEncoder struct {
+	w io.Writer
+}
+
+func (e *jsonEncoder) Encode(record interface{}) error {
+	d, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(d, jsonRecordDelimiter...))
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package gcsext
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/writerfactory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestJSONLineDecoderReportsBadLines(t *testing.T) {
+	it, offset := jsonFormat{}.newLineDecoder(bytes.NewBufferString("{\"Key\":1}\n{broken\n\n{\"Key\":3}"), func() interface{} {
+		return &plainRecord{}
+	})
+
+	rec, err := it()
+	require.NoError(t, err)
+	assert.Equal(t, 1, rec.(*plainRecord).Key)
+	assert.Equal(t, int64(0), offset())
+
+	_, err = it()
+	decodeErr, ok := err.(*RecordDecodeError)
+	require.True(t, ok, "expected a RecordDecodeError; got %v", err)
+	assert.Equal(t, int64(2), decodeErr.Line)
+	assert.Equal(t, "{broken", string(decodeErr.Raw))
+
+	rec, err = it()
+	require.NoError(t, err, "expected the decoder to continue after a bad line")
+	assert.Equal(t, 3, rec.(*plainRecord).Key)
+	assert.Equal(t, int64(19), offset())
+
+	_, err = it()
+	assert.EqualError(t, err, iterator.ErrIteratorStop.Error())
+}
+
+func TestDeadLetterQueueDecodesLineByLine(t *testing.T) {
+	buffers, wf := writerfactory.GetMemoryWriterFactory()
+	q, err := NewDeadLetterQueue(wf, "dead/letters.json", 0)
+	require.NoError(t, err)
+	cfg := newReadConfig([]ReadOption{WithDeadLetterQueue(q)})
+
+	objAttr := &storage.ObjectAttrs{Name: "folder/file.json", Generation: 3}
+	it := cfg.unorderedDecoder(objAttr, bytes.NewBufferString("{\"Key\":1}\n{broken\n{\"Key\":3}\n"), func() interface{} {
+		return &plainRecord{}
+	})
+	assert.Equal(t, []int{1, 3}, collectKeys(t, it))
+	require.NoError(t, q.Close())
+	assert.Equal(t, map[string]int{"folder/file.json": 1}, q.Counts())
+	assert.Contains(t, buffers["dead/letters.json"].String(), `"raw":"{broken"`)
+}
+
+func TestDeadLetterQueueGzipped(t *testing.T) {
+	ctx := context.Background()
+	_, bucket := newFakeGCS(t)
+	q, err := NewDeadLetterQueue(GetGCSWriterFactory(ctx, bucket), "dead/letters.json.gz", 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Add(&storage.ObjectAttrs{Name: "folder/file.json"}, &RecordDecodeError{Line: 2, Raw: []byte("{broken"), Err: errors.New("bad")}))
+	require.NoError(t, q.Close())
+
+	r, err := newObjectReader(ctx, bucket, &storage.ObjectAttrs{Name: "dead/letters.json.gz"})
+	require.NoError(t, err)
+	it := FormatByName("dead/letters.json.gz").NewDecoder(r, func() interface{} { return &DeadLetter{} })
+	rec, err := it()
+	require.NoError(t, err)
+	assert.Equal(t, &DeadLetter{Object: "folder/file.json", Line: 2, Raw: "{broken", Error: "bad"}, rec)
+}
+
+func TestDeadLetterQueueRequiresAnEncoder(t *testing.T) {
+	_, wf := writerfactory.GetMemoryWriterFactory()
+	q, err := NewDeadLetterQueue(wf, "dead/letters.avro", 0)
+	assert.Nil(t, q)
+	assert.True(t, errors.Is(err, ErrAvroSchemaRequired), "unexpected error %v", err)
+}
+
+func TestOffsetDecodersReportRecordStarts(t *testing.T) {
+	newRecord := func() interface{} { return &plainRecord{} }
+	cases := map[string]struct {
+		format offsetDecoderFormat
+		input  string
+		want   []int64
+	}{
+		"json": {jsonFormat{}, "{\"Key\":1}\n  {\"Key\":2} {\n\"Key\":3}\n", []int64{0, 12, 22}},
+		"csv":  {csvFormat{}, "Key,Value\n1,a\n2,bb\n3,c\n", []int64{10, 14, 19}},
+	}
+	for name, tc := range cases {
+		it, offset := tc.format.newOffsetDecoder(bytes.NewBufferString(tc.input), newRecord)
+		var got []int64
+		for _, err := it(); err == nil; _, err = it() {
+			got = append(got, offset())
+		}
+		assert.Equal(t, tc.want, got, name)
+	}
+}
@@ -0,0 +1,79 @@
+package gcsext
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/kvanticoss/goutils/iterator"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// ParquetFormat reads and writes Apache Parquet files. Records must be (pointers to) structs, optionally using
+// `parquet:"name"` tags; the writer schema is inferred from the first record written.
+// Parquet keeps its metadata in a footer so the decoder has to buffer the entire object in memory before the first
+// record can be returned (unless the reader provided is both an io.ReaderAt and has a Size() int64 method).
+var ParquetFormat Format = parquetFormat{}
+
+type parquetFormat struct{}
+
+func (parquetFormat) Extensions() []string {
+	return []string{".parquet"}
+}
+
+type sizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+func (parquetFormat) NewDecoder(r io.Reader, new func() interface{}) iterator.RecordIterator {
+	var reader *parquet.Reader
+	return func() (interface{}, error) {
+		if reader == nil {
+			ra, ok := r.(sizedReaderAt)
+			if !ok {
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					return nil, err
+				}
+				ra = bytes.NewReader(b)
+			}
+			if ra.Size() == 0 { // e.g. a destination file created by TouchFile
+				closeIfCloser(r)
+				return nil, iterator.ErrIteratorStop
+			}
+
+			f, err := parquet.OpenFile(ra, ra.Size())
+			if err != nil {
+				return nil, err
+			}
+			reader = parquet.NewReader(f)
+		}
+
+		dst := new()
+		if err := reader.Read(dst); err == io.EOF {
+			closeIfCloser(r)
+			return nil, iterator.ErrIteratorStop
+		} else if err != nil {
+			return nil, err
+		}
+		return dst, nil
+	}
+}
+
+func (parquetFormat) NewEncoder(w io.Writer) (RecordEncoder, error) {
+	return &parquetEncoder{parquet.NewWriter(w)}, nil
+}
+
+type parquetEncoder struct {
+	w *parquet.Writer
+}
+
+func (e *parquetEncoder) Encode(record interface{}) error {
+	return e.w.Write(record)
+}
+
+func (e *parquetEncoder) Close() error {
+	return e.w.Close()
+}
@@ -0,0 +1,88 @@
+package gcsext
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/kvanticoss/goutils/iterator"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufFormat reads and writes streams of varint length-delimited protocol buffer messages. Records must
+// implement proto.Message (google.golang.org/protobuf)
+var ProtobufFormat Format = protobufFormat{}
+
+type protobufFormat struct{}
+
+func (protobufFormat) Extensions() []string {
+	return []string{".pb", ".protodelim"}
+}
+
+func (f protobufFormat) NewDecoder(r io.Reader, new func() interface{}) iterator.RecordIterator {
+	it, _ := f.newOffsetDecoder(r, new)
+	return it
+}
+
+// newOffsetDecoder is NewDecoder keeping track of where each message starts; see offsetDecoderFormat
+func (protobufFormat) newOffsetDecoder(r io.Reader, new func() interface{}) (iterator.RecordIterator, func() int64) {
+	br := &countingByteReader{r: bufio.NewReader(r)}
+	var start int64
+	return func() (interface{}, error) {
+		if isEmpty(br.r) {
+			closeIfCloser(r)
+			return nil, iterator.ErrIteratorStop
+		}
+
+		start = br.n
+		dst := new()
+		msg, ok := dst.(proto.Message)
+		if !ok {
+			return nil, fmt.Errorf("protobuf: record of type %T does not implement proto.Message", dst)
+		}
+		return dst, protodelim.UnmarshalFrom(br, msg)
+	}, func() int64 { return start }
+}
+
+// countingByteReader counts the bytes read through it
+type countingByteReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingByteReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (protobufFormat) NewEncoder(w io.Writer) (RecordEncoder, error) {
+	return &protobufEncoder{w}, nil
+}
+
+type protobufEncoder struct {
+	w io.Writer
+}
+
+func (e *protobufEncoder) Encode(record interface{}) error {
+	msg, ok := record.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf: record of type %T does not implement proto.Message", record)
+	}
+	_, err := protodelim.MarshalTo(e.w, msg)
+	return err
+}
+
+func (e *protobufEncoder) Close() error {
+	return nil
+}
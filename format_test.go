@@ -0,0 +1,135 @@
+package gcsext_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	gcsext "github.com/kvanticoss/google-cloudstorage-ext"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type formatRecord struct {
+	Name  string    `csv:"name" avro:"name" parquet:"name" json:"name"`
+	Value int64     `csv:"value" avro:"value" parquet:"value" json:"value"`
+	When  time.Time `csv:"when" avro:"-" parquet:"when" json:"when"`
+}
+
+const formatRecordAvroSchema = `{
+	"type": "record",
+	"name": "formatRecord",
+	"fields": [
+		{"name": "name", "type": "string"},
+		{"name": "value", "type": "long"}
+	]
+}`
+
+func formatRoundTrip(t *testing.T, f gcsext.Format, records []interface{}, new func() interface{}) []interface{} {
+	buf := &bytes.Buffer{}
+	enc, err := f.NewEncoder(buf)
+	require.NoError(t, err)
+	for _, rec := range records {
+		require.NoError(t, enc.Encode(rec))
+	}
+	require.NoError(t, enc.Close())
+
+	res := []interface{}{}
+	it := f.NewDecoder(ioutil.NopCloser(buf), new)
+	var rec interface{}
+	for rec, err = it(); err == nil; rec, err = it() {
+		res = append(res, rec)
+	}
+	assert.EqualError(t, err, iterator.ErrIteratorStop.Error())
+	return res
+}
+
+func TestFormatRoundTrips(t *testing.T) {
+	when := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	records := []interface{}{
+		&formatRecord{Name: "a", Value: 1, When: when},
+		&formatRecord{Name: "b, with comma", Value: 2, When: when.Add(time.Hour)},
+	}
+	newer := func() interface{} { return &formatRecord{} }
+
+	tests := []struct {
+		name   string
+		format gcsext.Format
+		avro   bool
+	}{
+		{name: "json", format: gcsext.JSONFormat},
+		{name: "csv", format: gcsext.CSVFormat},
+		{name: "parquet", format: gcsext.ParquetFormat},
+		{name: "avro", format: gcsext.NewAvroFormat(formatRecordAvroSchema), avro: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := formatRoundTrip(t, test.format, records, newer)
+			require.Len(t, res, len(records))
+			for i, rec := range res {
+				expected := *records[i].(*formatRecord)
+				got := *rec.(*formatRecord)
+				if test.avro { // the avro test schema doesn't carry the timestamp
+					expected.When = time.Time{}
+				}
+				assert.Equal(t, expected.Name, got.Name)
+				assert.Equal(t, expected.Value, got.Value)
+				assert.True(t, expected.When.Equal(got.When), "expected %v got %v", expected.When, got.When)
+			}
+		})
+	}
+}
+
+func TestProtobufFormatRoundTrip(t *testing.T) {
+	records := []interface{}{
+		wrapperspb.String("first"),
+		wrapperspb.String(""),
+		wrapperspb.String("third"),
+	}
+	res := formatRoundTrip(t, gcsext.ProtobufFormat, records, func() interface{} {
+		return &wrapperspb.StringValue{}
+	})
+
+	require.Len(t, res, len(records))
+	for i, rec := range res {
+		assert.True(t, proto.Equal(records[i].(proto.Message), rec.(proto.Message)))
+	}
+}
+
+func TestCSVFormatIntoMap(t *testing.T) {
+	it := gcsext.CSVFormat.NewDecoder(bytes.NewBufferString("a,b\n1,2\n3,4\n"), func() interface{} {
+		return &map[string]string{}
+	})
+
+	rec, err := it()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "2"}, *rec.(*map[string]string))
+	_, err = it()
+	require.NoError(t, err)
+	_, err = it()
+	assert.EqualError(t, err, iterator.ErrIteratorStop.Error())
+}
+
+func TestEmptyObjectsYieldNoRecords(t *testing.T) {
+	for _, f := range []gcsext.Format{gcsext.JSONFormat, gcsext.CSVFormat, gcsext.AvroFormat, gcsext.ParquetFormat, gcsext.ProtobufFormat} {
+		_, err := f.NewDecoder(&bytes.Buffer{}, func() interface{} { return &formatRecord{} })()
+		assert.EqualError(t, err, iterator.ErrIteratorStop.Error(), "%T", f)
+	}
+}
+
+func TestFormatByName(t *testing.T) {
+	assert.Equal(t, gcsext.JSONFormat, gcsext.FormatByName("folder/sorted.json.gz"))
+	assert.Equal(t, gcsext.JSONFormat, gcsext.FormatByName("folder/unsorted_records_s0001"))
+	assert.Equal(t, gcsext.CSVFormat, gcsext.FormatByName("folder/data.csv.gz"))
+	assert.Equal(t, gcsext.ParquetFormat, gcsext.FormatByName("folder/data.parquet"))
+	assert.Equal(t, gcsext.ProtobufFormat, gcsext.FormatByName("folder/data.pb"))
+	assert.Equal(t, gcsext.AvroFormat, gcsext.FormatByName("folder/data.avro"))
+
+	_, err := gcsext.AvroFormat.NewEncoder(&bytes.Buffer{})
+	assert.Equal(t, gcsext.ErrAvroSchemaRequired, err)
+}
@@ -2,16 +2,77 @@ package gcsext
 
 import (
 	"context"
+	"io"
 	"path"
+	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/kvanticoss/goutils/eioutil"
+	"github.com/kvanticoss/goutils/gzip"
 	"github.com/kvanticoss/goutils/writerfactory"
 )
 
-// GetGCSWriterFactory returns a writer factory backed by GCS
+// GetGCSWriterFactory returns a writer factory backed by GCS. The writers also have an Abort method which discards
+// everything written instead of creating the object; WriteRecords and the DeadLetterQueue use it on errors.
 func GetGCSWriterFactory(ctx context.Context, bucket *storage.BucketHandle) writerfactory.WriterFactory {
 	return func(filePath string) (wc eioutil.WriteCloser, err error) {
-		return bucket.Object(path.Clean(filePath)).NewWriter(ctx), nil
+		return newAbortableWriter(ctx, bucket.Object(path.Clean(filePath))), nil
 	}
 }
+
+// aborter is implemented by writers which can discard everything written instead of committing it on Close
+type aborter interface {
+	Abort()
+}
+
+// abortWriter discards what was written to w if it can be aborted; otherwise w is closed
+func abortWriter(w io.Closer) {
+	if a, ok := w.(aborter); ok {
+		a.Abort()
+		return
+	}
+	w.Close()
+}
+
+// abortableWriter is a storage.Writer with a context of its own; cancelling it makes sure a failed write never
+// commits a truncated object (which closing the writer would)
+type abortableWriter struct {
+	*storage.Writer
+	cancel context.CancelFunc
+}
+
+// newAbortableWriter returns a writer for the object (with its conditions)
+func newAbortableWriter(ctx context.Context, obj *storage.ObjectHandle) *abortableWriter {
+	ctx, cancel := context.WithCancel(ctx)
+	return &abortableWriter{Writer: obj.NewWriter(ctx), cancel: cancel}
+}
+
+// Close commits the object
+func (w *abortableWriter) Close() error {
+	defer w.cancel()
+	return w.Writer.Close()
+}
+
+// Abort discards everything written; the object is left as it was
+func (w *abortableWriter) Abort() {
+	w.cancel()
+	w.Writer.Close()
+}
+
+// gzipWriter compresses into an abortableWriter; Abort is passed on
+type gzipWriter struct {
+	*gzip.Writer
+	w *abortableWriter
+}
+
+func (g *gzipWriter) Abort() {
+	g.w.Abort()
+}
+
+// compressed gzips the writes to w if the object name has the .gz suffix
+func compressed(w *abortableWriter) io.WriteCloser {
+	if strings.HasSuffix(w.Name, ".gz") {
+		return &gzipWriter{Writer: gzip.NewWriter(w), w: w}
+	}
+	return w
+}
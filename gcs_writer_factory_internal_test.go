@@ -0,0 +1,35 @@
+package gcsext
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestWriteRecordsAbortsOnError(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	wf := GetGCSWriterFactory(context.Background(), bucket)
+
+	require.NoError(t, WriteRecords(wf, "out/ok.json", plainRecordIterator(1, 2)))
+	content, ok := fake.content("out/ok.json")
+	require.True(t, ok)
+	assert.Equal(t, "{\"Key\":1,\"Value\":\"\"}\n{\"Key\":2,\"Value\":\"\"}\n", content)
+
+	failing := func() iterator.RecordIterator {
+		it := plainRecordIterator(1, 2)
+		return func() (interface{}, error) {
+			rec, err := it()
+			if err == iterator.ErrIteratorStop {
+				return nil, errors.New("source went away")
+			}
+			return rec, err
+		}
+	}
+	assert.Error(t, WriteRecords(wf, "out/failed.json", failing()))
+	assert.Error(t, WriteRecords(wf, "out/failed.json.gz", failing()))
+	assert.Equal(t, []string{"out/ok.json"}, fake.names(), "expected no partial objects")
+}
@@ -0,0 +1,115 @@
+package gcsext
+
+import (
+	"time"
+
+	"github.com/kvanticoss/goutils/backoff"
+	"github.com/kvanticoss/goutils/recordbuffer"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// Comparator returns a negative number when a sorts before b, a positive number when b sorts before a and 0 when they are equal.
+// It matches the signature of the standard library's cmp.Compare and slices.SortFunc.
+type Comparator[T any] func(a, b T) int
+
+// genericCompare adapts a Comparator[T] to the records (*T) produced by newGeneric[T]. A nil Comparator falls back on
+// the Lesser interface, which then needs to be implemented by *T.
+func genericCompare[T any](cmp Comparator[T]) ReadOption {
+	if cmp == nil {
+		return nil
+	}
+	return withCompare(func(a, b interface{}) int {
+		return cmp(*a.(*T), *b.(*T))
+	})
+}
+
+func newGeneric[T any]() interface{} {
+	return new(T)
+}
+
+// IterateRecords is the type safe version of IterateRecordsByFoldersSorted. Records are decoded into a *T (so T is
+// typically a struct) and merged in the order given by cmp within each folder.
+func IterateRecords[T any](
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	predicate func(*storage.ObjectAttrs) bool,
+	cmp Comparator[T],
+	opts ...ReadOption,
+) func() (string, T, error) {
+	it := IterateRecordsByFoldersSorted(ctx, bucket, prefix, newGeneric[T], predicate, append(opts[:len(opts):len(opts)], genericCompare(cmp))...)
+	return func() (string, T, error) {
+		folder, rec, err := it()
+		if err != nil {
+			var zero T
+			return folder, zero, err
+		}
+		return folder, *rec.(*T), nil
+	}
+}
+
+// IterateRecordsCB works like IterateRecords but through an callback pattern; see IterateRecordsByFoldersSortedCB
+func IterateRecordsCB[T any](
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	predicate func(*storage.ObjectAttrs) bool,
+	cmp Comparator[T],
+	callback func(string, func() (T, error)) error,
+	opts ...ReadOption,
+) error {
+	return IterateRecordsByFoldersSortedCB(ctx, bucket, prefix, newGeneric[T], predicate,
+		func(folder string, it func() (interface{}, error)) error {
+			return callback(folder, func() (T, error) {
+				rec, err := it()
+				if err != nil {
+					var zero T
+					return zero, err
+				}
+				return *rec.(*T), nil
+			})
+		},
+		append(opts[:len(opts):len(opts)], genericCompare(cmp))...,
+	)
+}
+
+// SortFolders is the type safe version of SortGCSFolders; records are decoded into a *T and sorted by cmp, so T doesn't
+// need to implement the Lesser interface. See SortGCSFolders for a description of the parameters.
+func SortFolders[T any](
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	cmp Comparator[T],
+	srcPredicate func(*storage.ObjectAttrs) bool,
+	destinationPrefix string,
+	cacheFactory recordbuffer.ReadWriteResetterFactory,
+	bo *backoff.RandExpBackoff,
+	removeDuplicates bool,
+	removeSrcOnSuccess bool,
+	opts ...ReadOption,
+) error {
+	return sortFolders(ctx, bucket, prefix, newGeneric[T], srcPredicate, destinationPrefix, cacheFactory, bo,
+		removeDuplicates, removeSrcOnSuccess, nil, append(opts[:len(opts):len(opts)], genericCompare(cmp))...)
+}
+
+// SortFoldersLeased is the type safe version of SortGCSFoldersLeased; see SortFolders and SortGCSFoldersLeased.
+func SortFoldersLeased[T any](
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	cmp Comparator[T],
+	srcPredicate func(*storage.ObjectAttrs) bool,
+	destinationPrefix string,
+	cacheFactory recordbuffer.ReadWriteResetterFactory,
+	bo *backoff.RandExpBackoff,
+	removeDuplicates bool,
+	removeSrcOnSuccess bool,
+	leaseTTL time.Duration,
+	opts ...ReadOption,
+) error {
+	return sortFolders(ctx, bucket, prefix, newGeneric[T], srcPredicate, destinationPrefix, cacheFactory, bo,
+		removeDuplicates, removeSrcOnSuccess, WithFolderLeases(leaseTTL),
+		append(opts[:len(opts):len(opts)], genericCompare(cmp))...)
+}
@@ -0,0 +1,221 @@
+package gcsext
+
+import (
+	"time"
+
+	"github.com/kvanticoss/goutils/iterator"
+)
+
+// Group is a run of adjacent records sharing the same key; see GroupBy
+type Group struct {
+	Key     Key
+	Records iterator.RecordIterator
+}
+
+// GroupIterator returns the next Group until ErrIteratorStop
+type GroupIterator func() (*Group, error)
+
+// GroupBy splits a sorted RecordIterator into groups of adjacent records with equal keys (so the records must be sorted
+// by, or at least clustered on, the key). Groups are streamed; the Records of a group stops yielding once the next group
+// is requested and any records not read are skipped.
+func GroupBy(it iterator.RecordIterator, key KeyExtractor) GroupIterator {
+	g := &grouper{it: it, key: key}
+	return g.next
+}
+
+type grouper struct {
+	it  iterator.RecordIterator
+	key KeyExtractor
+
+	started bool
+	rec     interface{}
+	recKey  Key
+	err     error
+
+	inGroup    bool
+	groupKey   Key
+	generation int
+}
+
+func (g *grouper) advance() {
+	g.rec, g.err = g.it()
+	if g.err == nil {
+		g.recKey = g.key(g.rec)
+	}
+}
+
+func (g *grouper) next() (*Group, error) {
+	if !g.started {
+		g.started = true
+		g.advance()
+	}
+	for g.inGroup && g.err == nil && CompareKeys(g.recKey, g.groupKey) == 0 {
+		g.advance()
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	g.inGroup, g.groupKey = true, g.recKey
+	g.generation++
+	generation, groupKey := g.generation, g.recKey
+	return &Group{
+		Key: groupKey,
+		Records: func() (interface{}, error) {
+			if generation != g.generation || g.err == iterator.ErrIteratorStop {
+				return nil, iterator.ErrIteratorStop
+			}
+			if g.err != nil {
+				return nil, g.err
+			}
+			if CompareKeys(g.recKey, groupKey) != 0 {
+				return nil, iterator.ErrIteratorStop
+			}
+			rec := g.rec
+			g.advance()
+			return rec, nil
+		},
+	}, nil
+}
+
+// TumblingWindow returns a KeyExtractor grouping records by key and fixed, non overlapping, time windows of the given
+// size; the start of the window (in UTC) is appended as the last element of the key. For GroupBy the records must be
+// sorted by key and then time. key may be nil to group by time only.
+func TumblingWindow(key KeyExtractor, timestamp func(record interface{}) time.Time, size time.Duration) KeyExtractor {
+	return func(record interface{}) Key {
+		var res Key
+		if key != nil {
+			res = append(res, key(record)...)
+		}
+		return append(res, timestamp(record).UTC().Truncate(size))
+	}
+}
+
+// Reducer folds the records of a group into a single value
+type Reducer interface {
+	Add(record interface{})
+	Result() interface{}
+}
+
+// ReducerFactory creates a new Reducer for each group
+type ReducerFactory func() Reducer
+
+// Aggregate is the result of Reduce for a single group
+type Aggregate struct {
+	Key    Key                    `json:"key"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// Reduce applies the named reducers to each group; yielding an *Aggregate per group. Write the results with e.g.
+// WriteRecords.
+func Reduce(groups GroupIterator, reducers map[string]ReducerFactory) iterator.RecordIterator {
+	return func() (interface{}, error) {
+		group, err := groups()
+		if err != nil {
+			return nil, err
+		}
+
+		instances := make(map[string]Reducer, len(reducers))
+		for name, factory := range reducers {
+			instances[name] = factory()
+		}
+		var rec interface{}
+		for rec, err = group.Records(); err == nil; rec, err = group.Records() {
+			for _, r := range instances {
+				r.Add(rec)
+			}
+		}
+		if err != iterator.ErrIteratorStop {
+			return nil, err
+		}
+
+		res := &Aggregate{Key: group.Key, Values: make(map[string]interface{}, len(instances))}
+		for name, r := range instances {
+			res.Values[name] = r.Result()
+		}
+		return res, nil
+	}
+}
+
+// reducerFunc implements Reducer through closures
+type reducerFunc struct {
+	add    func(record interface{})
+	result func() interface{}
+}
+
+func (r *reducerFunc) Add(record interface{}) { r.add(record) }
+func (r *reducerFunc) Result() interface{}    { return r.result() }
+
+// Count counts the records of each group (as an int64)
+func Count() ReducerFactory {
+	return func() Reducer {
+		var count int64
+		return &reducerFunc{
+			add:    func(interface{}) { count++ },
+			result: func() interface{} { return count },
+		}
+	}
+}
+
+// Sum sums the value of the records of each group (as a float64)
+func Sum(value func(record interface{}) float64) ReducerFactory {
+	return func() Reducer {
+		var sum float64
+		return &reducerFunc{
+			add:    func(record interface{}) { sum += value(record) },
+			result: func() interface{} { return sum },
+		}
+	}
+}
+
+// Min keeps the smallest value of each group; values are compared like Key elements
+func Min(value func(record interface{}) interface{}) ReducerFactory {
+	return extremeReducer(value, -1)
+}
+
+// Max keeps the largest value of each group; values are compared like Key elements
+func Max(value func(record interface{}) interface{}) ReducerFactory {
+	return extremeReducer(value, 1)
+}
+
+func extremeReducer(value func(record interface{}) interface{}, sign int) ReducerFactory {
+	return func() Reducer {
+		var res interface{}
+		seen := false
+		return &reducerFunc{
+			add: func(record interface{}) {
+				v := value(record)
+				if !seen || compareKeyElements(v, res)*sign > 0 {
+					res, seen = v, true
+				}
+			},
+			result: func() interface{} { return res },
+		}
+	}
+}
+
+// First keeps the first record of each group
+func First() ReducerFactory {
+	return func() Reducer {
+		var res interface{}
+		return &reducerFunc{
+			add: func(record interface{}) {
+				if res == nil {
+					res = record
+				}
+			},
+			result: func() interface{} { return res },
+		}
+	}
+}
+
+// Last keeps the last record of each group
+func Last() ReducerFactory {
+	return func() Reducer {
+		var res interface{}
+		return &reducerFunc{
+			add:    func(record interface{}) { res = record },
+			result: func() interface{} { return res },
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package gcsext_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	gcsext "github.com/kvanticoss/google-cloudstorage-ext"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/writerfactory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStructIterator(records ...testStruct) iterator.RecordIterator {
+	return func() (interface{}, error) {
+		if len(records) == 0 {
+			return nil, iterator.ErrIteratorStop
+		}
+		rec := records[0]
+		records = records[1:]
+		return &rec, nil
+	}
+}
+
+func byVar1(record interface{}) gcsext.Key {
+	return gcsext.Key{record.(*testStruct).Var1}
+}
+
+func TestGroupBy(t *testing.T) {
+	groups := gcsext.GroupBy(testStructIterator(
+		testStruct{Var1: "a", Var2: 1}, testStruct{Var1: "a", Var2: 2}, testStruct{Var1: "b", Var2: 3},
+		testStruct{Var1: "c", Var2: 4}, testStruct{Var1: "c", Var2: 5},
+	), byVar1)
+
+	group, err := groups()
+	require.NoError(t, err)
+	assert.Equal(t, gcsext.Key{"a"}, group.Key)
+	rec, err := group.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 1, rec.(*testStruct).Var2)
+
+	// The rest of group a is skipped
+	group, err = groups()
+	require.NoError(t, err)
+	assert.Equal(t, gcsext.Key{"b"}, group.Key)
+
+	group, err = groups()
+	require.NoError(t, err)
+	assert.Equal(t, gcsext.Key{"c"}, group.Key)
+	values := []int{}
+	for rec, err = group.Records(); err == nil; rec, err = group.Records() {
+		values = append(values, rec.(*testStruct).Var2)
+	}
+	assert.Equal(t, iterator.ErrIteratorStop, err)
+	assert.Equal(t, []int{4, 5}, values)
+
+	_, err = groups()
+	assert.Equal(t, iterator.ErrIteratorStop, err)
+}
+
+func TestReduceTumblingWindows(t *testing.T) {
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	// Var3 is minutes past start
+	records := testStructIterator(
+		testStruct{Var1: "a", Var2: 5, Var3: 1}, testStruct{Var1: "a", Var2: 2, Var3: 59}, testStruct{Var1: "a", Var2: 7, Var3: 61},
+		testStruct{Var1: "b", Var2: 3, Var3: 10},
+	)
+	window := gcsext.TumblingWindow(byVar1, func(record interface{}) time.Time {
+		return start.Add(time.Duration(record.(*testStruct).Var3) * time.Minute)
+	}, time.Hour)
+	var2 := func(record interface{}) interface{} { return record.(*testStruct).Var2 }
+
+	it := gcsext.Reduce(gcsext.GroupBy(records, window), map[string]gcsext.ReducerFactory{
+		"count": gcsext.Count(),
+		"sum":   gcsext.Sum(func(record interface{}) float64 { return float64(record.(*testStruct).Var2) }),
+		"min":   gcsext.Min(var2),
+		"max":   gcsext.Max(var2),
+		"first": gcsext.First(),
+		"last":  gcsext.Last(),
+	})
+
+	rec, err := it()
+	require.NoError(t, err)
+	first := rec.(*gcsext.Aggregate)
+	assert.Equal(t, gcsext.Key{"a", start}, first.Key)
+	assert.Equal(t, int64(2), first.Values["count"])
+	assert.Equal(t, 7.0, first.Values["sum"])
+	assert.Equal(t, 2, first.Values["min"])
+	assert.Equal(t, 5, first.Values["max"])
+	assert.Equal(t, 1, first.Values["first"].(*testStruct).Var3)
+	assert.Equal(t, 59, first.Values["last"].(*testStruct).Var3)
+
+	rec, err = it()
+	require.NoError(t, err)
+	assert.Equal(t, gcsext.Key{"a", start.Add(time.Hour)}, rec.(*gcsext.Aggregate).Key)
+	assert.Equal(t, int64(1), rec.(*gcsext.Aggregate).Values["count"])
+
+	rec, err = it()
+	require.NoError(t, err)
+	assert.Equal(t, gcsext.Key{"b", start}, rec.(*gcsext.Aggregate).Key)
+
+	_, err = it()
+	assert.Equal(t, iterator.ErrIteratorStop, err)
+}
+
+func TestWriteRecords(t *testing.T) {
+	buffers, wf := writerfactory.GetMemoryWriterFactory()
+	it := gcsext.Reduce(gcsext.GroupBy(testStructIterator(testStruct{Var1: "a"}, testStruct{Var1: "a"}), byVar1), map[string]gcsext.ReducerFactory{
+		"count": gcsext.Count(),
+	})
+	require.NoError(t, gcsext.WriteRecords(wf, "aggregates/counts.json", it))
+	assert.Equal(t, `{"key":["a"],"values":{"count":2}}`, strings.TrimSpace(buffers["aggregates/counts.json"].String()))
+}
@@ -0,0 +1,275 @@
+package gcsext
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kvanticoss/goutils/backoff"
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+const (
+	leaseOwnerMetadata = "gcsext-lease-owner"
+	leaseTTLMetadata   = "gcsext-lease-ttl"
+
+	// leaseAttempts bounds how often an attempt to lock retries when the lock is released or taken over meanwhile
+	leaseAttempts = 3
+
+	// MinLeaseTTL is the smallest ttl of a Lock; shorter leases couldn't be renewed (see KeepAlive)
+	MinLeaseTTL = time.Millisecond
+)
+
+var (
+	// ErrLeaseHeld is returned when a lock is held by another owner and hasn't expired
+	ErrLeaseHeld = errors.New("lease is held by another owner")
+	// ErrLeaseLost is returned when a lock has been taken over (or removed) since it was acquired or last renewed; or
+	// was never acquired
+	ErrLeaseLost = errors.New("lease was lost")
+	// ErrInvalidLeaseTTL is returned when a lock is created with a ttl below MinLeaseTTL
+	ErrInvalidLeaseTTL = errors.New("lease ttl is too short")
+)
+
+// Lock is a cross-process mutex with expiry (a lease) backed by a lock object in GCS. The lock object is created with
+// a DoesNotExist precondition; its owner and ttl are stored in the object metadata. A lock which hasn't been renewed
+// within its ttl may be taken over by another owner, replacing the lock object under a GenerationMatch precondition
+// so only one contender wins. Renewing patches the metadata, which moves the update time of the lock object, under
+// preconditions on the generation and metageneration we know; a lock which has been taken over can neither be renewed
+// nor released.
+//
+// Expiry is decided by comparing the local clock with the update time of the lock object; keep ttl well above the
+// expected clock skew. Use Token to fence the resources protected by the lock. A Lock is safe for concurrent use.
+type Lock struct {
+	obj   *storage.ObjectHandle
+	owner string
+	ttl   time.Duration
+
+	mu             sync.Mutex
+	generation     int64
+	metageneration int64
+	renewed        time.Time
+}
+
+// NewLock returns a Lock on the object name; owner identifies the holder to others (see LockHolder). ErrInvalidLeaseTTL
+// is returned if ttl is below MinLeaseTTL.
+func NewLock(bucket *storage.BucketHandle, name, owner string, ttl time.Duration) (*Lock, error) {
+	if ttl < MinLeaseTTL {
+		return nil, errors.Wrapf(ErrInvalidLeaseTTL, "%v is below %v", ttl, MinLeaseTTL)
+	}
+	return &Lock{obj: bucket.Object(name), owner: owner, ttl: ttl}, nil
+}
+
+// TryLock acquires the lock; taking it over if it has expired. ErrLeaseHeld is returned if the lock is held by another
+// owner. With a backoff, TryLock sleeps and tries again while the lock is held until the backoff gives up; with a nil
+// backoff it only tries once. Sleeping stops as soon as the context is done. The backoff isn't modified.
+func (l *Lock) TryLock(ctx context.Context, bo *backoff.RandExpBackoff) error {
+	if bo != nil {
+		copied := *bo
+		bo = &copied
+	}
+	for {
+		err := l.acquire(ctx)
+		if bo == nil || !errors.Is(err, ErrLeaseHeld) {
+			return err
+		}
+		var boErr error
+		if bo, boErr = sleepAndIncr(ctx, bo); boErr != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return fmt.Errorf("%w: %w", ctxErr, err)
+			}
+			return err
+		}
+	}
+}
+
+// sleepAndIncr is bo.SleepAndIncr returning the context's error as soon as it is done. The sleep itself can't be
+// interrupted; it finishes in the background and the backoff must not be used after an error.
+func sleepAndIncr(ctx context.Context, bo *backoff.RandExpBackoff) (*backoff.RandExpBackoff, error) {
+	type slept struct {
+		bo  *backoff.RandExpBackoff
+		err error
+	}
+	done := make(chan slept, 1)
+	go func() {
+		next, err := bo.SleepAndIncr()
+		done <- slept{next, err}
+	}()
+	select {
+	case res := <-done:
+		return res.bo, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquire makes a single attempt at creating (or taking over) the lock object
+func (l *Lock) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.generation != 0 {
+		return errors.Errorf("lock %s is already held", l.obj.ObjectName())
+	}
+
+	for attempt := 0; attempt < leaseAttempts; attempt++ {
+		err := l.create(ctx, storage.Conditions{DoesNotExist: true})
+		if !isPreconditionFailed(err) {
+			return l.created(err)
+		}
+
+		objAttr, err := l.obj.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			continue // Released in the meantime
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to get the attributes of lock %s", l.obj.ObjectName())
+		}
+		holder, expires := LockHolder(objAttr)
+		if time.Now().Before(expires) {
+			return errors.Wrapf(ErrLeaseHeld, "%s is held by %s until %s", l.obj.ObjectName(), holder, expires.Format(time.RFC3339))
+		}
+
+		// Take over the expired lock; only one contender can replace this generation
+		err = l.create(ctx, storage.Conditions{GenerationMatch: objAttr.Generation})
+		if !isPreconditionFailed(err) {
+			return l.created(err)
+		}
+	}
+	return errors.Wrapf(ErrLeaseHeld, "%s is contended", l.obj.ObjectName())
+}
+
+func (l *Lock) created(err error) error {
+	return errors.Wrapf(err, "failed to create lock %s", l.obj.ObjectName())
+}
+
+// LockHolder returns the owner of the lock object and when the lock expires; ttl after it was acquired or last renewed.
+// Locks without a valid ttl are expired.
+func LockHolder(objAttr *storage.ObjectAttrs) (string, time.Time) {
+	ttl, err := time.ParseDuration(objAttr.Metadata[leaseTTLMetadata])
+	if err != nil {
+		ttl = 0
+	}
+	return objAttr.Metadata[leaseOwnerMetadata], objAttr.Updated.Add(ttl)
+}
+
+// Token returns the fencing token of the lock; the generation of the lock object when it was acquired, or 0 if the lock
+// isn't held. Generations of an object name only increase, so every later holder of the lock gets a larger token than
+// the holders before it; resources protected by the lock should reject writes with a token smaller than the largest
+// seen. Renewing the lock doesn't change the token.
+func (l *Lock) Token() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.generation
+}
+
+func (l *Lock) metadata() map[string]string {
+	return map[string]string{
+		leaseOwnerMetadata: l.owner,
+		leaseTTLMetadata:   l.ttl.String(),
+	}
+}
+
+// create writes the (empty) lock object under the conditions
+func (l *Lock) create(ctx context.Context, conditions storage.Conditions) error {
+	renewed := time.Now()
+	w := l.obj.If(conditions).NewWriter(ctx)
+	w.Metadata = l.metadata()
+	if err := w.Close(); err != nil {
+		return err
+	}
+	l.generation, l.metageneration, l.renewed = w.Attrs().Generation, w.Attrs().Metageneration, renewed
+	return nil
+}
+
+func (l *Lock) conditions() storage.Conditions {
+	return storage.Conditions{GenerationMatch: l.generation, MetagenerationMatch: l.metageneration}
+}
+
+// Renew extends the lock by its ttl; ErrLeaseLost is returned if it has been taken over or isn't held
+func (l *Lock) Renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.generation == 0 {
+		return errors.Wrapf(ErrLeaseLost, "%s isn't held", l.obj.ObjectName())
+	}
+
+	renewed := time.Now()
+	objAttr, err := l.obj.If(l.conditions()).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: l.metadata()})
+	if err == storage.ErrObjectNotExist || isPreconditionFailed(err) {
+		l.generation = 0
+		return errors.Wrapf(ErrLeaseLost, "%s", l.obj.ObjectName())
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to renew lock %s", l.obj.ObjectName())
+	}
+	l.metageneration, l.renewed = objAttr.Metageneration, renewed
+	return nil
+}
+
+// Release removes the lock object; ErrLeaseLost is returned if it has been taken over or isn't held. The Lock may be
+// acquired again afterwards.
+func (l *Lock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.generation == 0 {
+		return errors.Wrapf(ErrLeaseLost, "%s isn't held", l.obj.ObjectName())
+	}
+
+	err := l.obj.If(l.conditions()).Delete(ctx)
+	if err == storage.ErrObjectNotExist || isPreconditionFailed(err) {
+		l.generation = 0
+		return errors.Wrapf(ErrLeaseLost, "%s", l.obj.ObjectName())
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to release lock %s", l.obj.ObjectName())
+	}
+	l.generation = 0
+	return nil
+}
+
+// expired reports if the lock hasn't been renewed within its ttl
+func (l *Lock) expired() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Since(l.renewed) >= l.ttl
+}
+
+// KeepAlive renews the lock every ttl/3 until stop is called. The returned context is cancelled if the lock is lost;
+// either taken over or not renewed within its ttl (failed renewals are retried until then). stop returns the reason
+// the lock was lost; if it was. The lock is still held after stop; see Release.
+func (l *Lock) KeepAlive(ctx context.Context) (context.Context, func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	var lostErr error
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			err := l.Renew(ctx)
+			if err == nil {
+				continue
+			}
+			if errors.Is(err, ErrLeaseLost) || l.expired() {
+				lostErr = err
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, func() error {
+		close(done)
+		<-stopped
+		cancel()
+		return lostErr
+	}
+}
@@ -0,0 +1,135 @@
+package gcsext
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/kvanticoss/goutils/backoff"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func newTestLock(t *testing.T, bucket *storage.BucketHandle, name, owner string, ttl time.Duration) *Lock {
+	l, err := NewLock(bucket, name, owner, ttl)
+	require.NoError(t, err)
+	return l
+}
+
+func TestNewLockRejectsShortTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{-time.Second, 0, 2, MinLeaseTTL - 1} {
+		l, err := NewLock(&storage.BucketHandle{}, "locks/scheduler", "worker-1", ttl)
+		assert.Nil(t, l)
+		assert.True(t, errors.Is(err, ErrInvalidLeaseTTL), "unexpected error %v for %v", err, ttl)
+	}
+}
+
+func TestLockHolder(t *testing.T) {
+	updated := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := &Lock{owner: "worker-1", ttl: time.Minute}
+
+	owner, expires := LockHolder(&storage.ObjectAttrs{Metadata: l.metadata(), Updated: updated})
+	assert.Equal(t, "worker-1", owner)
+	assert.Equal(t, updated.Add(time.Minute), expires)
+
+	_, expires = LockHolder(&storage.ObjectAttrs{Metadata: map[string]string{leaseTTLMetadata: "forever"}, Updated: updated})
+	assert.Equal(t, updated, expires, "expected locks without a valid ttl to be expired")
+}
+
+func TestLockNotHeld(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLock(t, &storage.BucketHandle{}, "locks/scheduler", "worker-1", time.Minute)
+	assert.Equal(t, int64(0), l.Token())
+	assert.True(t, errors.Is(l.Renew(ctx), ErrLeaseLost))
+	assert.True(t, errors.Is(l.Release(ctx), ErrLeaseLost))
+}
+
+func TestLockAlreadyHeld(t *testing.T) {
+	l := newTestLock(t, &storage.BucketHandle{}, "locks/scheduler", "worker-1", time.Minute)
+	l.generation, l.renewed = 42, time.Now()
+	assert.Equal(t, int64(42), l.Token())
+	assert.EqualError(t, l.TryLock(context.Background(), nil), "lock locks/scheduler is already held")
+	assert.False(t, l.expired())
+}
+
+func TestLockAcquireAndRelease(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	l := newTestLock(t, bucket, "locks/scheduler", "worker-1", time.Minute)
+	require.NoError(t, l.TryLock(ctx, nil))
+	assert.Equal(t, fake.attrs("locks/scheduler").Generation, l.Token())
+	owner, _ := LockHolder(fake.attrs("locks/scheduler"))
+	assert.Equal(t, "worker-1", owner)
+
+	other := newTestLock(t, bucket, "locks/scheduler", "worker-2", time.Minute)
+	assert.True(t, errors.Is(other.TryLock(ctx, nil), ErrLeaseHeld))
+
+	require.NoError(t, l.Release(ctx))
+	assert.Nil(t, fake.attrs("locks/scheduler"))
+	require.NoError(t, other.TryLock(ctx, nil))
+	assert.Greater(t, other.Token(), int64(0))
+}
+
+func TestLockTakeoverOfExpiredLease(t *testing.T) {
+	ctx := context.Background()
+	_, bucket := newFakeGCS(t)
+	l := newTestLock(t, bucket, "locks/scheduler", "worker-1", 10*time.Millisecond)
+	require.NoError(t, l.TryLock(ctx, nil))
+	time.Sleep(20 * time.Millisecond)
+
+	other := newTestLock(t, bucket, "locks/scheduler", "worker-2", time.Minute)
+	require.NoError(t, other.TryLock(ctx, nil))
+	assert.Greater(t, other.Token(), l.Token(), "expected the fencing token to increase")
+	assert.True(t, errors.Is(l.Renew(ctx), ErrLeaseLost))
+	assert.True(t, errors.Is(l.Release(ctx), ErrLeaseLost))
+	require.NoError(t, other.Release(ctx))
+}
+
+func TestLockRenew(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	l := newTestLock(t, bucket, "locks/scheduler", "worker-1", time.Minute)
+	require.NoError(t, l.TryLock(ctx, nil))
+	before := fake.attrs("locks/scheduler")
+
+	require.NoError(t, l.Renew(ctx))
+	after := fake.attrs("locks/scheduler")
+	assert.Equal(t, before.Generation, after.Generation)
+	assert.Equal(t, l.Token(), after.Generation, "expected renewing to keep the token")
+	assert.Greater(t, after.Metageneration, before.Metageneration)
+	assert.True(t, after.Updated.After(before.Updated), "expected renewing to extend the lease")
+	assert.Equal(t, map[string]string{leaseOwnerMetadata: "worker-1", leaseTTLMetadata: "1m0s"}, after.Metadata)
+	require.NoError(t, l.Release(ctx))
+}
+
+func TestKeepAliveCancelsOnLostLease(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	l := newTestLock(t, bucket, "locks/scheduler", "worker-1", 30*time.Millisecond)
+	require.NoError(t, l.TryLock(context.Background(), nil))
+
+	ctx, stop := l.KeepAlive(context.Background())
+	fake.put("locks/scheduler", "", nil) // Taken over by someone else
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the context to be cancelled once the lease was lost")
+	}
+	assert.True(t, errors.Is(stop(), ErrLeaseLost))
+}
+
+func TestTryLockStopsSleepingWhenCancelled(t *testing.T) {
+	_, bucket := newFakeGCS(t)
+	held := newTestLock(t, bucket, "locks/scheduler", "worker-1", time.Minute)
+	require.NoError(t, held.TryLock(context.Background(), nil))
+
+	var bo *backoff.RandExpBackoff
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err := newTestLock(t, bucket, "locks/scheduler", "worker-2", time.Minute).TryLock(ctx, bo.WithMinBackoff(time.Hour))
+	assert.Less(t, time.Since(started), 5*time.Second)
+	assert.True(t, errors.Is(err, ErrLeaseHeld), "unexpected error %v", err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error %v", err)
+}
@@ -0,0 +1,210 @@
+package gcsext
+
+import (
+	"errors"
+
+	"github.com/kvanticoss/goutils/iterator"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// ErrJoinInputUnsorted is returned by MergeJoin when the keys of either side are not in ascending order
+var ErrJoinInputUnsorted = errors.New("merge join input is not sorted by the join key")
+
+// JoinType decides which unmatched records MergeJoin yields
+type JoinType int
+
+const (
+	// InnerJoin only yields pairs of matching records
+	InnerJoin JoinType = iota
+	// LeftJoin also yields left records without a match (with a nil Right)
+	LeftJoin
+	// FullOuterJoin also yields unmatched records from both sides (with a nil Right or Left)
+	FullOuterJoin
+)
+
+// JoinedRecord is what MergeJoin yields; Left or Right is nil for unmatched records of outer joins
+type JoinedRecord struct {
+	Key   Key
+	Left  interface{}
+	Right interface{}
+}
+
+// JoinSide describes one of the prefixes joined by MergeJoinPrefixes
+type JoinSide struct {
+	Prefix    string
+	New       func() interface{}
+	Predicate func(*storage.ObjectAttrs) bool
+	Key       KeyExtractor
+}
+
+// MergeJoin joins two iterators which are both sorted (ascending) on their join keys, yielding *JoinedRecord.
+// Both sides are streamed; only the right records of the current key are held in memory so duplicate keys on both sides
+// give every combination of the duplicates. Any iterator can be used as input, e.g. a folder from
+// IterateJSONRecordsByFoldersSorted or IterateRecordsGloballySorted; see also MergeJoinPrefixes.
+func MergeJoin(left, right iterator.RecordIterator, leftKey, rightKey KeyExtractor, joinType JoinType) iterator.RecordIterator {
+	j := &mergeJoin{
+		left:     newKeyedIterator(left, leftKey),
+		right:    newKeyedIterator(right, rightKey),
+		joinType: joinType,
+	}
+	return j.next
+}
+
+// MergeJoinPrefixes joins all records under two prefixes on the key of each side. Each side is read with
+// IterateRecordsGloballySorted ordered by its key (so the objects need to be sorted by it) using the given options.
+func MergeJoinPrefixes(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	left, right JoinSide,
+	joinType JoinType,
+	opts ...ReadOption,
+) iterator.RecordIterator {
+	leftIt := IterateRecordsGloballySorted(ctx, bucket, left.Prefix, left.New, left.Predicate, append(opts[:len(opts):len(opts)], WithSortKey(left.Key))...)
+	rightIt := IterateRecordsGloballySorted(ctx, bucket, right.Prefix, right.New, right.Predicate, append(opts[:len(opts):len(opts)], WithSortKey(right.Key))...)
+	return MergeJoin(leftIt, rightIt, left.Key, right.Key, joinType)
+}
+
+// keyedIterator peeks one record ahead and verifies that the keys are ascending
+type keyedIterator struct {
+	it  iterator.RecordIterator
+	key KeyExtractor
+
+	started bool
+	rec     interface{}
+	recKey  Key
+	err     error
+}
+
+func newKeyedIterator(it iterator.RecordIterator, key KeyExtractor) *keyedIterator {
+	return &keyedIterator{it: it, key: key}
+}
+
+// peek returns the current record and its key without advancing; err is ErrIteratorStop when exhausted
+func (k *keyedIterator) peek() (interface{}, Key, error) {
+	if !k.started {
+		k.started = true
+		k.advance()
+	}
+	return k.rec, k.recKey, k.err
+}
+
+func (k *keyedIterator) advance() {
+	if k.err != nil {
+		return
+	}
+	previous := k.recKey
+	k.rec, k.err = k.it()
+	if k.err != nil {
+		k.rec, k.recKey = nil, nil
+		return
+	}
+	k.recKey = k.key(k.rec)
+	if previous != nil && CompareKeys(k.recKey, previous) < 0 {
+		k.rec, k.recKey, k.err = nil, nil, ErrJoinInputUnsorted
+	}
+}
+
+type mergeJoin struct {
+	left, right *keyedIterator
+	joinType    JoinType
+
+	group        []interface{} // right records sharing groupKey
+	groupKey     Key
+	groupMatched bool
+
+	pending []*JoinedRecord
+}
+
+func (j *mergeJoin) next() (interface{}, error) {
+	for len(j.pending) == 0 {
+		if err := j.step(); err != nil {
+			return nil, err
+		}
+	}
+	res := j.pending[0]
+	j.pending = j.pending[1:]
+	return res, nil
+}
+
+// step adds zero or more records to pending; returning ErrIteratorStop once both sides are done
+func (j *mergeJoin) step() error {
+	if j.group == nil {
+		if err := j.loadGroup(); err != nil && err != iterator.ErrIteratorStop {
+			return err
+		}
+	}
+
+	leftRec, leftKey, err := j.left.peek()
+	if err != nil && err != iterator.ErrIteratorStop {
+		return err
+	}
+	leftDone := err == iterator.ErrIteratorStop
+
+	switch {
+	case leftDone && j.group == nil:
+		return iterator.ErrIteratorStop
+	case leftDone:
+		if j.joinType != FullOuterJoin {
+			return iterator.ErrIteratorStop
+		}
+		j.flushGroup()
+	case j.group == nil:
+		if j.joinType == InnerJoin {
+			return iterator.ErrIteratorStop
+		}
+		j.pending = append(j.pending, &JoinedRecord{Key: leftKey, Left: leftRec})
+		j.left.advance()
+	default:
+		switch c := CompareKeys(leftKey, j.groupKey); {
+		case c < 0:
+			if j.joinType != InnerJoin {
+				j.pending = append(j.pending, &JoinedRecord{Key: leftKey, Left: leftRec})
+			}
+			j.left.advance()
+		case c == 0:
+			for _, rightRec := range j.group {
+				j.pending = append(j.pending, &JoinedRecord{Key: leftKey, Left: leftRec, Right: rightRec})
+			}
+			j.groupMatched = true
+			j.left.advance()
+		default:
+			j.flushGroup()
+		}
+	}
+	return nil
+}
+
+// flushGroup yields the current right group if unmatched in a full outer join and drops it
+func (j *mergeJoin) flushGroup() {
+	if j.joinType == FullOuterJoin && !j.groupMatched {
+		for _, rightRec := range j.group {
+			j.pending = append(j.pending, &JoinedRecord{Key: j.groupKey, Right: rightRec})
+		}
+	}
+	j.group, j.groupKey, j.groupMatched = nil, nil, false
+}
+
+// loadGroup reads all right records with the same key as the next one
+func (j *mergeJoin) loadGroup() error {
+	rec, key, err := j.right.peek()
+	if err != nil {
+		return err
+	}
+	j.group, j.groupKey = []interface{}{rec}, key
+	for {
+		j.right.advance()
+		rec, next, err := j.right.peek()
+		if err == iterator.ErrIteratorStop {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if CompareKeys(next, key) != 0 {
+			return nil
+		}
+		j.group = append(j.group, rec)
+	}
+}
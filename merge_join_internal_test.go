@@ -0,0 +1,66 @@
+package gcsext
+
+import (
+	"testing"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func plainKey(r interface{}) Key {
+	return Key{r.(*plainRecord).Key}
+}
+
+func collectJoined(t *testing.T, it iterator.RecordIterator) [][2]string {
+	res := [][2]string{}
+	var rec interface{}
+	var err error
+	for rec, err = it(); err == nil; rec, err = it() {
+		joined := rec.(*JoinedRecord)
+		pair := [2]string{"-", "-"}
+		if joined.Left != nil {
+			pair[0] = joined.Left.(*plainRecord).Value
+		}
+		if joined.Right != nil {
+			pair[1] = joined.Right.(*plainRecord).Value
+		}
+		res = append(res, pair)
+	}
+	require.EqualError(t, err, iterator.ErrIteratorStop.Error())
+	return res
+}
+
+func TestMergeJoin(t *testing.T) {
+	left := func() iterator.RecordIterator {
+		return versionedRecords(plainRecord{1, "l1"}, plainRecord{2, "l2a"}, plainRecord{2, "l2b"}, plainRecord{4, "l4"})
+	}
+	right := func() iterator.RecordIterator {
+		return versionedRecords(plainRecord{0, "r0"}, plainRecord{2, "r2a"}, plainRecord{2, "r2b"}, plainRecord{3, "r3"}, plainRecord{5, "r5"})
+	}
+
+	for joinType, expected := range map[JoinType][][2]string{
+		InnerJoin: {{"l2a", "r2a"}, {"l2a", "r2b"}, {"l2b", "r2a"}, {"l2b", "r2b"}},
+		LeftJoin:  {{"l1", "-"}, {"l2a", "r2a"}, {"l2a", "r2b"}, {"l2b", "r2a"}, {"l2b", "r2b"}, {"l4", "-"}},
+		FullOuterJoin: {
+			{"-", "r0"}, {"l1", "-"}, {"l2a", "r2a"}, {"l2a", "r2b"}, {"l2b", "r2a"}, {"l2b", "r2b"},
+			{"-", "r3"}, {"l4", "-"}, {"-", "r5"},
+		},
+	} {
+		assert.Equal(t, expected, collectJoined(t, MergeJoin(left(), right(), plainKey, plainKey, joinType)), "join type %d", joinType)
+	}
+}
+
+func TestMergeJoinEmptySides(t *testing.T) {
+	assert.Equal(t, [][2]string{{"l1", "-"}}, collectJoined(t, MergeJoin(versionedRecords(plainRecord{1, "l1"}), versionedRecords(), plainKey, plainKey, FullOuterJoin)))
+	assert.Equal(t, [][2]string{{"-", "r1"}}, collectJoined(t, MergeJoin(versionedRecords(), versionedRecords(plainRecord{1, "r1"}), plainKey, plainKey, FullOuterJoin)))
+	assert.Equal(t, [][2]string{}, collectJoined(t, MergeJoin(versionedRecords(plainRecord{1, "l1"}), versionedRecords(), plainKey, plainKey, InnerJoin)))
+}
+
+func TestMergeJoinUnsortedInput(t *testing.T) {
+	it := MergeJoin(versionedRecords(plainRecord{2, "a"}, plainRecord{1, "b"}), versionedRecords(plainRecord{2, "c"}), plainKey, plainKey, InnerJoin)
+	_, err := it()
+	require.NoError(t, err)
+	_, err = it()
+	assert.Equal(t, ErrJoinInputUnsorted, err)
+}
@@ -0,0 +1,237 @@
+package gcsext
+
+import (
+	"io"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// readAttempts bounds how often Read relists a folder whose objects are replaced (e.g. compacted) while being opened
+const readAttempts = 3
+
+// IterateRecordsMergedOnRead returns the records of each folder under the prefix as SortGCSFolders would write them;
+// merging the compacted output (destinationPrefix) with the sources (srcPredicate) not yet compacted. It is a wrapper
+// around Compactor.Read; see SortGCSFolders for a description of the parameters.
+func IterateRecordsMergedOnRead(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	new func() interface{},
+	srcPredicate func(*storage.ObjectAttrs) bool,
+	destinationPrefix string,
+	removeDuplicates bool,
+	opts ...ReadOption,
+) func() (string, interface{}, error) {
+	compactionOpts := []CompactionOption{
+		WithSourcePredicate(srcPredicate),
+		WithDestination(destinationPrefix),
+		WithReadOptions(opts...),
+	}
+	if removeDuplicates {
+		compactionOpts = append(compactionOpts, WithDuplicateRemoval())
+	}
+	return NewCompactor(bucket, new, compactionOpts...).Read(ctx, prefix)
+}
+
+// Read returns the records of each folder under the prefix as Compact would write them (merge on read); the compacted
+// output (the destination or its parts) is merged in sorted order with the sources not yet compacted, and duplicates,
+// tombstones and the retention policy are handled like Compact does. Reads thereby give the same view before and after
+// a compaction: sources which a compaction in progress has already written to the output are left out, and parts it
+// has staged are read in place of those they replace (see CompactionManifest); a folder is relisted if its objects are
+// compacted away while being opened. Folders are read as the listing passes them, like Compact does; nested folders
+// therefore come before their parents rather than in name order.
+//
+// Records sorting as equal are read in the order Compact writes them; those of the outputs first and then those of the
+// sources in name order.
+//
+// Each object must be sorted unless WithUnsortedInput(UnsortedExternalSort) is among the ReadOptions. Without
+// WithSourceRemoval compacted sources remain; they are told apart by the records of the outputs (see compactionRecord)
+// and only their records in the outputs are read.
+func (c *Compactor) Read(ctx context.Context, prefix string) func() (string, interface{}, error) {
+	var listings func() (*FolderListing, error)
+	var current iterator.RecordIterator
+	var folder string
+	var err error
+	started := false
+	return func() (string, interface{}, error) {
+		if !started {
+			started = true
+			if c.destination == nil {
+				err = ErrNoCompactionDestination
+			} else if c, _, err = c.withTombstones(ctx); err == nil {
+				listings = c.folderListings(ctx, prefix, true)
+			}
+		}
+
+		for err == nil {
+			if current != nil {
+				var rec interface{}
+				if rec, err = current(); err != iterator.ErrIteratorStop {
+					return folder, rec, err
+				}
+				err = nil
+			}
+			var listing *FolderListing
+			if listing, err = listings(); err == iterator.ErrIteratorStop {
+				return "", nil, err
+			}
+			if err == nil {
+				folder = listing.Folder
+				current, err = c.readFolder(ctx, folder)
+			}
+		}
+		return folder, nil, err
+	}
+}
+
+// readFolder opens the objects of the folder; relisting the folder if any of them has been replaced since it was listed
+func (c *Compactor) readFolder(ctx context.Context, folder string) (iterator.RecordIterator, error) {
+	var err error
+	for attempt := 0; attempt < readAttempts; attempt++ {
+		var it iterator.RecordIterator
+		if it, err = c.openFolder(ctx, folder); !errors.Is(err, storage.ErrObjectNotExist) {
+			return it, err
+		}
+	}
+	return nil, errors.Wrapf(err, "the objects of %s kept changing while being opened", folder)
+}
+
+// openFolder lists the folder and merges its outputs with its uncompacted sources
+func (c *Compactor) openFolder(ctx context.Context, folder string) (iterator.RecordIterator, error) {
+	cfg := newReadConfig(c.readOpts)
+	listings, err := c.listFolders(ctx, folder+"/", true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s", folder)
+	}
+	listing := &FolderListing{Folder: folder}
+	for _, l := range listings {
+		if l.Folder == folder {
+			listing = l
+		}
+	}
+	if listing, err = c.view(ctx, listing); err != nil {
+		return nil, err
+	}
+	sources := listing.Sources
+
+	closers := []io.Closer{}
+	closeAll := func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}
+	iterators := []iterator.RecordIterator{}
+	open := func(cfg *readConfig, objAttr *storage.ObjectAttrs) error {
+		reader, err := newObjectReader(ctx, c.bucket, objAttr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %s", objAttr.Name)
+		}
+		closers = append(closers, reader)
+		iterators = append(iterators, cfg.decoder(objAttr, reader, c.newer))
+		return nil
+	}
+
+	// Outputs are always written in the format matching their name
+	outputCfg := *cfg
+	outputCfg.format = nil
+	for _, objAttr := range listing.Outputs {
+		if err := open(&outputCfg, objAttr); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	if cfg.unsorted == UnsortedExternalSort {
+		sorted, cleanup, err := cfg.sortedSources(ctx, c.bucket, sources, c.newer)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		closers = append(closers, closerFunc(cleanup))
+		iterators = append(iterators, sorted...)
+	} else {
+		for _, objAttr := range sources {
+			if err := open(cfg, objAttr); err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+	}
+
+	merged, err := mergeSorted(iterators, cfg.comparator())
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	it := cfg.filtered(c.deduplicated(cfg, merged), nil, nil)
+	return func() (interface{}, error) {
+		rec, err := it()
+		if err != nil {
+			closeAll()
+		}
+		return rec, err
+	}, nil
+}
+
+// view returns the listing as a compaction in progress leaves it once finished (see CompactionManifest); the sources it
+// has already written to the outputs are left out and the parts it has staged replace those they are published over.
+func (c *Compactor) view(ctx context.Context, listing *FolderListing) (*FolderListing, error) {
+	if !c.tracked() {
+		return listing, nil // Manifests are only written when sources are removed or the destination is rolled
+	}
+	m, _, err := c.readManifest(ctx, listing.Folder)
+	if err != nil || m == nil {
+		return listing, err
+	}
+	if m.State == manifestPending {
+		committed, err := c.outputsCommitted(ctx, m)
+		if err != nil || !committed {
+			return listing, err
+		}
+	}
+
+	res := &FolderListing{Folder: listing.Folder, Outputs: listing.Outputs, Now: listing.Now}
+	if m.State == manifestStaged {
+		res.Outputs = stagedOutputs(m, listing.Outputs)
+	}
+	// The outputs of the compaction refer to its record, which holds the sources compacted along with those merged
+	if err := c.classify(ctx, res, append(listing.Sources[:len(listing.Sources):len(listing.Sources)], listing.Compacted...)); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// stagedOutputs returns the outputs as they are once the staged parts of the manifest are published; parts not yet
+// published are read from their staged objects
+func stagedOutputs(m *CompactionManifest, outputs []*storage.ObjectAttrs) []*storage.ObjectAttrs {
+	staged := map[string]*StagedPart{}
+	for _, part := range m.Staged {
+		staged[part.Name] = part
+	}
+	removed := map[string]int64{}
+	for _, o := range m.Removes {
+		removed[o.Name] = o.Generation
+	}
+
+	res := []*storage.ObjectAttrs{}
+	for _, objAttr := range outputs {
+		if part, ok := staged[objAttr.Name]; ok {
+			if objAttr.Metadata[compactionIDMetadata] != m.ID {
+				continue // Not yet published
+			}
+			delete(staged, part.Name)
+		} else if generation, ok := removed[objAttr.Name]; ok && generation == objAttr.Generation {
+			continue
+		}
+		res = append(res, objAttr)
+	}
+	for _, part := range m.Staged {
+		if _, ok := staged[part.Name]; ok {
+			res = append(res, &storage.ObjectAttrs{Name: part.Staged, Generation: part.Generation, Metadata: m.Metadata})
+		}
+	}
+	return res
+}
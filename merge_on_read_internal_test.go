@@ -0,0 +1,67 @@
+package gcsext
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestReadRequiresDestination(t *testing.T) {
+	it := NewCompactor(nil, nil).Read(context.Background(), "prefix/")
+	_, _, err := it()
+	assert.Equal(t, ErrNoCompactionDestination, err)
+	_, _, err = it()
+	assert.Equal(t, ErrNoCompactionDestination, err, "expected the error to be sticky")
+}
+
+func TestViewWithoutSourceRemoval(t *testing.T) {
+	listing := &FolderListing{Folder: "prefix/a", Sources: []*storage.ObjectAttrs{{Name: "prefix/a/1.json", Generation: 1}}}
+	res, err := NewCompactor(nil, nil, WithDestination("sorted.json")).view(context.Background(), listing)
+	require.NoError(t, err)
+	assert.Equal(t, listing, res, "expected no manifest to be read when sources aren't removed")
+}
+
+func TestReadLeavesOutCompactedSources(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("f/1.json", 1, 3)
+	c := NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+		WithDestination("sorted.json"),
+		WithReadOptions(WithComparator(comparePlainRecords)),
+	)
+	_, err := c.Compact(ctx, "")
+	require.NoError(t, err)
+	fake.putKeys("f/2.json", 2)
+
+	it, err := c.readFolder(ctx, "f")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, collectKeys(t, it), "expected the compacted source to be read only through the output")
+	assert.Contains(t, fake.names(), "f/1.json")
+}
+
+func TestReadOrdersEqualRecordsLikeCompact(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	fake.put("f/sorted.json", `{"Key":1,"Value":"output"}`+"\n", nil)
+	fake.put("f/1.json", `{"Key":1,"Value":"first"}`+"\n"+`{"Key":2,"Value":"first"}`+"\n", nil)
+	fake.put("f/2.json", `{"Key":0,"Value":"second"}`+"\n"+`{"Key":1,"Value":"second"}`+"\n", nil)
+	c := NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+		WithDestination("sorted.json"),
+		WithReadOptions(WithComparator(comparePlainRecords)),
+	)
+
+	it, err := c.readFolder(ctx, "f")
+	require.NoError(t, err)
+	read := collectRecords(t, it)
+	assert.Equal(t, []plainRecord{{0, "second"}, {1, "output"}, {1, "first"}, {1, "second"}, {2, "first"}}, read)
+
+	_, err = c.Compact(ctx, "")
+	require.NoError(t, err)
+	content, _ := fake.content("f/sorted.json")
+	written := collectRecords(t, FormatByName("f/sorted.json").NewDecoder(strings.NewReader(content), c.newer))
+	assert.Equal(t, read, written, "expected Read to give what Compact writes")
+}
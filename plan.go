@@ -0,0 +1,257 @@
+package gcsext
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// ErrPlanOutdated is returned when executing a plan whose objects have changed (or disappeared) since it was made
+var ErrPlanOutdated = errors.New("plan is outdated; objects have changed since it was made")
+
+// PlannedObject is an object, at a specific generation, which a plan reads or deletes
+type PlannedObject struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	Size       int64  `json:"size"`
+}
+
+// FolderPlan describes what compacting a folder will do
+type FolderPlan struct {
+	Folder      string          `json:"folder"`
+	Destination string          `json:"destination"`
+	Sources     []PlannedObject `json:"sources"` // Merged into the destination
+	Outputs     []PlannedObject `json:"outputs"` // Existing destination (or parts) which are rewritten
+	Deletes     []PlannedObject `json:"deletes"` // Removed once the destination has been written
+	Skipped     bool            `json:"skipped"` // Not compacted as decided by the CompactionPolicies
+	Listed      time.Time       `json:"listed"`  // When the listing started; see FolderListing
+
+	// Estimates based on the (compressed) object sizes
+	EstimatedBytesRead    int64 `json:"estimated_bytes_read"`
+	EstimatedBytesWritten int64 `json:"estimated_bytes_written"`
+}
+
+// CompactionPlan is returned by Compactor.Plan; it can be serialized (e.g. as JSON) and later executed with
+// Compactor.Execute
+type CompactionPlan struct {
+	Prefix  string        `json:"prefix"`
+	Folders []*FolderPlan `json:"folders"`
+}
+
+// Plan lists the prefix and returns what Compact would do without reading or writing any object (a dry run)
+func (c *Compactor) Plan(ctx context.Context, prefix string) (*CompactionPlan, error) {
+	if c.destination == nil {
+		return nil, ErrNoCompactionDestination
+	}
+	rewrite, err := c.hasTombstones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	folders, err := c.listFolders(ctx, prefix, rewrite)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list source objects")
+	}
+
+	plan := &CompactionPlan{Prefix: prefix, Folders: make([]*FolderPlan, len(folders))}
+	for i, folder := range folders {
+		folderPlan := &FolderPlan{
+			Folder:      folder.Folder,
+			Destination: c.destination(folder.Folder),
+			Sources:     plannedObjects(c.merged(folder)),
+			Outputs:     plannedObjects(folder.Outputs),
+			Deletes:     []PlannedObject{},
+			Skipped:     !rewrite && !c.shouldCompact(folder),
+			Listed:      folder.Now,
+		}
+		if c.removeSources {
+			folderPlan.Deletes = folderPlan.Sources
+		}
+		if !folderPlan.Skipped {
+			for _, o := range append(folderPlan.Sources[:len(folderPlan.Sources):len(folderPlan.Sources)], folderPlan.Outputs...) {
+				folderPlan.EstimatedBytesRead += o.Size
+			}
+			folderPlan.EstimatedBytesWritten = folderPlan.EstimatedBytesRead
+		}
+		plan.Folders[i] = folderPlan
+	}
+	return plan, nil
+}
+
+// Execute carries out the plan exactly; only the planned source objects, at their planned generations, are merged.
+// A folder fails with ErrPlanOutdated, without being written, if any of its planned objects has changed. The Compactor
+// should be configured as when the plan was made; folders skipped in the plan are skipped. Tombstone objects (see
+// WithTombstonePrefix) are applied but never removed by Execute.
+func (c *Compactor) Execute(ctx context.Context, plan *CompactionPlan) (*CompactionResult, error) {
+	if c.destination == nil {
+		return nil, ErrNoCompactionDestination
+	}
+	c, _, err := c.withTombstones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tasks := make([]*folderTask, len(plan.Folders))
+	for i, folderPlan := range plan.Folders {
+		folderPlan := folderPlan
+		tasks[i] = &folderTask{folder: folderPlan.Folder, weight: folderPlan.EstimatedBytesRead, compact: func() *FolderResult {
+			return c.executeFolder(ctx, folderPlan)
+		}}
+	}
+	results, err := c.runFolders(ctx, folderTasks(tasks))
+	if err != nil {
+		return nil, err
+	}
+	return collectResults(results)
+}
+
+// executeFolder carries out the plan of a single folder
+func (c *Compactor) executeFolder(ctx context.Context, folderPlan *FolderPlan) *FolderResult {
+	res := &FolderResult{Folder: folderPlan.Folder, Destination: folderPlan.Destination, Skipped: folderPlan.Skipped}
+	if folderPlan.Skipped {
+		return res
+	}
+	if dst := c.destination(folderPlan.Folder); dst != folderPlan.Destination {
+		res.Err = errors.Errorf("the plan's destination %s doesn't match the compactor's %s", folderPlan.Destination, dst)
+		return res
+	}
+
+	return c.compactLeased(ctx, folderPlan.Folder, func(ctx context.Context) *FolderResult {
+		listing, err := c.plannedListing(ctx, folderPlan)
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		return c.compactFolder(ctx, listing, true)
+	})
+}
+
+// plannedListing returns the listing of the planned objects; failing with ErrPlanOutdated if any of them has changed
+func (c *Compactor) plannedListing(ctx context.Context, folderPlan *FolderPlan) (*FolderListing, error) {
+	sources, err := verifyPlanned(ctx, c.bucket, folderPlan.Sources)
+	if err != nil {
+		return nil, err
+	}
+	listing := &FolderListing{Folder: folderPlan.Folder, Sources: sources, Now: folderPlan.Listed}
+	if listing.Outputs, err = c.verifyOutputs(ctx, folderPlan); err != nil {
+		return nil, err
+	}
+	// The sources compacted earlier aren't planned; those in the records of the outputs are carried over as they are
+	if listing.records, err = c.readRecords(ctx, listing.Outputs); err != nil {
+		return nil, err
+	}
+	for _, record := range listing.records {
+		listing.carried = append(listing.carried, record.Sources...)
+	}
+	if listing.Now.IsZero() {
+		// Planned before the listing time was recorded
+		listing.Now = newestUpdated(sources)
+	}
+	return listing, nil
+}
+
+// verifyOutputs returns the existing destination (or parts); failing with ErrPlanOutdated unless they are exactly the
+// planned outputs
+func (c *Compactor) verifyOutputs(ctx context.Context, folderPlan *FolderPlan) ([]*storage.ObjectAttrs, error) {
+	var current []*storage.ObjectAttrs
+	if c.rolling() {
+		parts, err := c.listParts(ctx, folderPlan.Destination)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list existing parts")
+		}
+		current = parts
+	} else {
+		objAttr, err := c.bucket.Object(folderPlan.Destination).Attrs(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return nil, errors.Wrapf(err, "failed to get the attributes of %s", folderPlan.Destination)
+		}
+		if err == nil {
+			current = []*storage.ObjectAttrs{objAttr}
+		}
+	}
+
+	planned := map[string]int64{}
+	for _, o := range folderPlan.Outputs {
+		planned[o.Name] = o.Generation
+	}
+	if len(current) != len(planned) {
+		return nil, errors.Wrapf(ErrPlanOutdated, "%s has %d outputs; planned %d", folderPlan.Folder, len(current), len(planned))
+	}
+	for _, objAttr := range current {
+		if generation, ok := planned[objAttr.Name]; !ok || generation != objAttr.Generation {
+			return nil, errors.Wrapf(ErrPlanOutdated, "%s (generation %d) wasn't planned", objAttr.Name, objAttr.Generation)
+		}
+	}
+	return current, nil
+}
+
+// verifyPlanned returns the current attributes of the objects; failing with ErrPlanOutdated if they have changed
+func verifyPlanned(ctx context.Context, bucket *storage.BucketHandle, objects []PlannedObject) ([]*storage.ObjectAttrs, error) {
+	res := make([]*storage.ObjectAttrs, len(objects))
+	for i, o := range objects {
+		objAttr, err := bucket.Object(o.Name).Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil, errors.Wrapf(ErrPlanOutdated, "%s no longer exists", o.Name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get the attributes of %s", o.Name)
+		}
+		if objAttr.Generation != o.Generation {
+			return nil, errors.Wrapf(ErrPlanOutdated, "%s is at generation %d; planned %d", o.Name, objAttr.Generation, o.Generation)
+		}
+		res[i] = objAttr
+	}
+	return res, nil
+}
+
+func plannedObjects(objects []*storage.ObjectAttrs) []PlannedObject {
+	res := make([]PlannedObject, len(objects))
+	for i, objAttr := range objects {
+		res[i] = PlannedObject{Name: objAttr.Name, Generation: objAttr.Generation, Size: objAttr.Size}
+	}
+	return res
+}
+
+// RemovalPlan is returned by PlanRemoveFolder; it can be serialized (e.g. as JSON) and later executed with ExecuteRemoval
+type RemovalPlan struct {
+	Prefix  string          `json:"prefix"`
+	Deletes []PlannedObject `json:"deletes"`
+}
+
+// PlanRemoveFolder returns the objects RemoveFolder would remove without removing anything (a dry run); listed exactly
+// like RemoveFolder lists them, placeholders and compaction manifests included
+func PlanRemoveFolder(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	predicate func(*storage.ObjectAttrs) bool,
+) (*RemovalPlan, error) {
+	objects := []*storage.ObjectAttrs{}
+	err := forEachRemoval(ctx, bucket, prefix, predicate, func(objAttr *storage.ObjectAttrs) error {
+		objects = append(objects, objAttr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &RemovalPlan{Prefix: prefix, Deletes: plannedObjects(objects)}, nil
+}
+
+// ExecuteRemoval removes exactly the planned objects. Nothing is removed if any of them has changed since the plan was
+// made (ErrPlanOutdated) and each object is only removed at its planned generation.
+func ExecuteRemoval(ctx context.Context, bucket *storage.BucketHandle, plan *RemovalPlan) error {
+	if _, err := verifyPlanned(ctx, bucket, plan.Deletes); err != nil {
+		return err
+	}
+	for _, o := range plan.Deletes {
+		err := bucket.Object(o.Name).If(storage.Conditions{GenerationMatch: o.Generation}).Delete(ctx)
+		if isRetryable(err) {
+			return errors.Wrapf(ErrPlanOutdated, "failed to remove %s: %v", o.Name, err)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove %s", o.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package gcsext
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	raw "google.golang.org/api/storage/v1"
+)
+
+func TestPlanSerialization(t *testing.T) {
+	plan := &CompactionPlan{Prefix: "prefix/", Folders: []*FolderPlan{{
+		Folder:                "prefix/a",
+		Destination:           "prefix/a/sorted.json.gz",
+		Sources:               plannedObjects([]*storage.ObjectAttrs{{Name: "prefix/a/1.json", Generation: 11, Size: 100}}),
+		Outputs:               []PlannedObject{},
+		Deletes:               []PlannedObject{},
+		EstimatedBytesRead:    100,
+		EstimatedBytesWritten: 100,
+	}}}
+
+	encoded, err := json.Marshal(plan)
+	require.NoError(t, err)
+	assert.Contains(t, string(encoded), `"sources":[{"name":"prefix/a/1.json","generation":11,"size":100}]`)
+
+	decoded := &CompactionPlan{}
+	require.NoError(t, json.Unmarshal(encoded, decoded))
+	assert.Equal(t, plan, decoded)
+}
+
+func TestExecuteRefusesMismatchingPlans(t *testing.T) {
+	plan := &CompactionPlan{Prefix: "prefix/", Folders: []*FolderPlan{
+		{Folder: "prefix/a", Destination: "prefix/a/sorted.json.gz", Skipped: true},
+		{Folder: "prefix/b", Destination: "prefix/b/other.json.gz"},
+		{Folder: "prefix/c", Destination: "prefix/c/other.json.gz"},
+	}}
+	res, err := NewCompactor(nil, nil, WithDestination("sorted.json.gz"), WithConcurrency(2)).Execute(context.Background(), plan)
+	compactionErr, ok := err.(*CompactionError)
+	require.True(t, ok, "expected a CompactionError; got %v", err)
+	require.Len(t, compactionErr.Folders, 2)
+	assert.EqualError(t, compactionErr.Folders[0].Err, "the plan's destination prefix/b/other.json.gz doesn't match the compactor's prefix/b/sorted.json.gz")
+	assert.Equal(t, "prefix/c", compactionErr.Folders[1].Folder)
+
+	require.Len(t, res.Folders, 3)
+	assert.True(t, res.Folders[0].Skipped)
+}
+
+func TestPlanRemoveFolderListsLikeRemoveFolder(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	for _, name := range []string{"f/", "f/a.json", "f/b.json", "f/" + compactionManifestName, "g/a.json"} {
+		fake.put(name, "", nil)
+	}
+	notB := func(objAttr *storage.ObjectAttrs) bool { return objAttr.Name != "f/b.json" }
+
+	plan, err := PlanRemoveFolder(context.Background(), bucket, "f/", notB)
+	require.NoError(t, err)
+	require.NoError(t, ExecuteRemoval(context.Background(), bucket, plan))
+	planned := fake.names()
+
+	for _, name := range []string{"f/", "f/a.json", "f/" + compactionManifestName} {
+		fake.put(name, "", nil)
+	}
+	require.NoError(t, RemoveFolder(context.Background(), bucket, "f/", notB))
+	assert.Equal(t, []string{"f/b.json", "g/a.json"}, fake.names())
+	assert.Equal(t, fake.names(), planned)
+}
+
+func TestExecuteReadsThePlannedOutput(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("f/1.json", 2)
+	fake.putKeys("f/sorted.json", 1)
+	c := NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+		WithDestination("sorted.json"),
+		WithReadOptions(WithComparator(comparePlainRecords)),
+	)
+	plan, err := c.Plan(context.Background(), "f/")
+	require.NoError(t, err)
+
+	// The destination is replaced after the plan has been verified but before it is read
+	replaced := false
+	fake.hook = func(op, name string) int {
+		if op == "read" && name == "f/1.json" && !replaced {
+			replaced = true
+			fake.store(&raw.Object{Name: "f/sorted.json"}, []byte("{\"Key\":3}\n"))
+		}
+		return 0
+	}
+	_, err = c.Execute(context.Background(), plan)
+	require.True(t, replaced)
+	assert.True(t, errors.Is(err, ErrPlanOutdated), "expected the plan to be outdated; got %v", err)
+	assert.Equal(t, []int{3}, fake.keys(t, "f/sorted.json"))
+
+	plan, err = c.Plan(context.Background(), "f/")
+	require.NoError(t, err)
+	_, err = c.Execute(context.Background(), plan)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, fake.keys(t, "f/sorted.json"))
+}
@@ -0,0 +1,180 @@
+package gcsext
+
+import (
+	"io"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/recordbuffer"
+
+	"cloud.google.com/go/storage"
+)
+
+// ReadOption configures how records are read by the record iterators (and SortGCSFolders)
+type ReadOption func(*readConfig)
+
+// readConfig is the internal state built up by ReadOptions
+type readConfig struct {
+	format      Format
+	compare     compareFunc
+	sortKey     KeyExtractor
+	descending  bool
+	deduplicate bool
+	dedupKey    KeyExtractor
+	dedupMerge  MergeFunc
+	deadLetters *DeadLetterQueue
+	retention   RetentionPolicy
+
+	tombstoneKey    KeyExtractor
+	isTombstone     func(record interface{}) bool
+	tombstonePrefix string
+	tombstoneKeys   sortedKeys
+	keepTombstones  bool
+	merging         bool // Merging into the outputs of a Compactor; see WithTombstoneRetention
+
+	tombstoneRetention RetentionPolicy
+
+	maxOpenReaders int
+	spillFactory   recordbuffer.ReadWriteResetterFactory
+
+	unsorted UnsortedInputMode
+	spillDir string
+}
+
+func newReadConfig(opts []ReadOption) *readConfig {
+	cfg := &readConfig{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	return cfg
+}
+
+// formatFor returns the format to use when decoding the object
+func (cfg *readConfig) formatFor(objectName string) Format {
+	if cfg.format != nil {
+		return cfg.format
+	}
+	return FormatByName(objectName)
+}
+
+// comparator returns the compareFunc records are sorted by; defaulting to the Lesser interface
+func (cfg *readConfig) comparator() compareFunc {
+	cmp := compareFunc(compareLessers)
+	if cfg.compare != nil {
+		cmp = cfg.compare
+	}
+	if cfg.descending {
+		return func(a, b interface{}) int {
+			return cmp(b, a)
+		}
+	}
+	return cmp
+}
+
+// sorted merges the sorted iterators; deduplicating and applying tombstones and the retention policy if requested
+func (cfg *readConfig) sorted(iterators []iterator.RecordIterator) (iterator.RecordIterator, error) {
+	it, err := mergeSorted(iterators, cfg.comparator())
+	if err != nil {
+		return nil, err
+	}
+	return cfg.filtered(cfg.deduplicated(it), nil, nil), nil
+}
+
+// filtered applies the tombstones and then the retention policy to the deduplicated sorted records; counting the
+// records deleted and dropped unless the counters are nil
+func (cfg *readConfig) filtered(it iterator.RecordIterator, deleted, dropped *int64) iterator.RecordIterator {
+	return cfg.retained(cfg.tombstoned(it, deleted), dropped)
+}
+
+// deduplicated removes duplicates from the sorted iterator if requested
+func (cfg *readConfig) deduplicated(it iterator.RecordIterator) iterator.RecordIterator {
+	if !cfg.deduplicate {
+		return it
+	}
+	return cfg.removeDuplicates(it)
+}
+
+// decoder returns a RecordIterator for the object; enforcing the Lesser interface unless a compareFunc is configured
+func (cfg *readConfig) decoder(objAttr *storage.ObjectAttrs, r io.Reader, new func() interface{}) iterator.RecordIterator {
+	if cfg.unsorted != UnsortedFail {
+		return cfg.requireLessers(cfg.unorderedDecoder(objAttr, r, new))
+	}
+	it, offset := cfg.newDecoder(objAttr, r, new, true)
+	return checkSorted(objAttr, cfg.requireLessers(it), offset, cfg.comparator())
+}
+
+// requireLessers enforces the Lesser interface unless a compareFunc is configured
+func (cfg *readConfig) requireLessers(it iterator.RecordIterator) iterator.RecordIterator {
+	if cfg.compare == nil {
+		return requireLessers(it)
+	}
+	return it
+}
+
+// unorderedDecoder is like decoder for when the order of the records doesn't matter; only the format and the dead letter
+// queue are applied
+func (cfg *readConfig) unorderedDecoder(objAttr *storage.ObjectAttrs, r io.Reader, new func() interface{}) iterator.RecordIterator {
+	it, _ := cfg.newDecoder(objAttr, r, new, false)
+	return it
+}
+
+// newDecoder decodes the object with its format; through the dead letter queue if any. With offsets the returned func
+// reports the byte offset at which the last record returned starts; or -1 if the format can't tell.
+func (cfg *readConfig) newDecoder(
+	objAttr *storage.ObjectAttrs,
+	r io.Reader,
+	new func() interface{},
+	offsets bool,
+) (iterator.RecordIterator, func() int64) {
+	format := cfg.formatFor(objAttr.Name)
+	lf, lineMode := format.(lineDecoderFormat)
+	of, hasOffsets := format.(offsetDecoderFormat)
+
+	var it iterator.RecordIterator
+	offset := func() int64 { return -1 }
+	switch {
+	case lineMode && cfg.deadLetters != nil:
+		it, offset = lf.newLineDecoder(r, new)
+	case hasOffsets && offsets:
+		it, offset = of.newOffsetDecoder(r, new)
+	default:
+		it = format.NewDecoder(r, new)
+	}
+
+	if cfg.deadLetters != nil {
+		it = cfg.deadLetters.quarantine(objAttr, it)
+	}
+	return it, offset
+}
+
+// withCompare sets the compareFunc; used by the generic API
+func withCompare(cmp compareFunc) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.compare = cmp
+		cfg.sortKey = nil
+	}
+}
+
+// WithFormat forces all objects to be decoded with the format regardless of their suffix. Without it
+// the format is selected through FormatByName.
+func WithFormat(f Format) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.format = f
+	}
+}
+
+// WithMaxOpenReaders bounds the number of objects read concurrently by IterateRecordsGloballySorted (default 100)
+func WithMaxOpenReaders(n int) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.maxOpenReaders = n
+	}
+}
+
+// WithSpillBuffers sets the factory for the buffers holding intermediate sorted runs (e.g backed by local disk)
+// when merging more objects than allowed by WithMaxOpenReaders. Defaults to temporary files in WithSpillDir.
+func WithSpillBuffers(factory recordbuffer.ReadWriteResetterFactory) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.spillFactory = factory
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"cloud.google.com/go/storage"
 
 	"golang.org/x/net/context"
+	googleIterator "google.golang.org/api/iterator"
 )
 
 // RemoveFolder remove all contents under the specificed prefix; unless a predicate function is present and returns false
@@ -13,6 +14,19 @@ func RemoveFolder(
 	bucket *storage.BucketHandle,
 	prefix string,
 	predicate func(*storage.ObjectAttrs) bool,
+) error {
+	return forEachRemoval(ctx, bucket, prefix, predicate, func(objAttr *storage.ObjectAttrs) error {
+		return bucket.Object(objAttr.Name).Delete(ctx)
+	})
+}
+
+// forEachRemoval calls fn for each object RemoveFolder removes (see also PlanRemoveFolder); stopping on the first error
+func forEachRemoval(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	predicate func(*storage.ObjectAttrs) bool,
+	fn func(*storage.ObjectAttrs) error,
 ) error {
 	q := &storage.Query{
 		Delimiter: "",
@@ -20,13 +34,19 @@ func RemoveFolder(
 		Versions:  false,
 	}
 	objIt := bucket.Objects(ctx, q)
-	for objAttr, err := objIt.Next(); err == nil; objAttr, err = objIt.Next() {
+	for {
+		objAttr, err := objIt.Next()
+		if err == googleIterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 		if predicate != nil && !predicate(objAttr) {
 			continue
 		}
-		if err := bucket.Object(objAttr.Name).Delete(ctx); err != nil {
+		if err := fn(objAttr); err != nil {
 			return err
 		}
 	}
-	return nil
 }
@@ -0,0 +1,54 @@
+package gcsext
+
+import (
+	"time"
+
+	"github.com/kvanticoss/goutils/iterator"
+)
+
+// RetentionPolicy decides if a record is kept; now is when the records started to be read (the same for all records of
+// a compaction or an iterator)
+type RetentionPolicy func(record interface{}, now time.Time) bool
+
+// MaxAge is a RetentionPolicy keeping the records whose timestamp is at most maxAge old
+func MaxAge(timestamp func(record interface{}) time.Time, maxAge time.Duration) RetentionPolicy {
+	return func(record interface{}, now time.Time) bool {
+		return !timestamp(record).Before(now.Add(-maxAge))
+	}
+}
+
+// KeepIf is a RetentionPolicy keeping the records accepted by keep
+func KeepIf(keep func(record interface{}) bool) RetentionPolicy {
+	return func(record interface{}, now time.Time) bool {
+		return keep(record)
+	}
+}
+
+// WithRetention drops the records rejected by the policy (e.g. MaxAge or KeepIf). SortGCSFolders (and the Compactor)
+// apply it while merging, after removing duplicates, so expired records already in the destination are dropped as well;
+// the Compactor reports the number of dropped records in FolderResult.Dropped. With WithIncrementalCompaction only the
+// parts receiving new records are filtered. The sorted iterators skip the rejected records.
+func WithRetention(policy RetentionPolicy) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.retention = policy
+	}
+}
+
+// retained drops the records rejected by the retention policy, if any; counting them in dropped unless it is nil
+func (cfg *readConfig) retained(it iterator.RecordIterator, dropped *int64) iterator.RecordIterator {
+	if cfg.retention == nil {
+		return it
+	}
+	policy, now := cfg.retention, time.Now()
+	return func() (interface{}, error) {
+		for {
+			rec, err := it()
+			if err != nil || policy(rec, now) {
+				return rec, err
+			}
+			if dropped != nil {
+				*dropped++
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package gcsext
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionPolicies(t *testing.T) {
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	// Key is the day of month the record was written
+	timestamp := func(r interface{}) time.Time { return time.Date(2020, 1, r.(*plainRecord).Key, 0, 0, 0, 0, time.UTC) }
+
+	maxAge := MaxAge(timestamp, 48*time.Hour)
+	assert.False(t, maxAge(&plainRecord{Key: 7}, now))
+	assert.True(t, maxAge(&plainRecord{Key: 8}, now))
+	assert.True(t, maxAge(&plainRecord{Key: 10}, now))
+
+	keepIf := KeepIf(func(r interface{}) bool { return r.(*plainRecord).Value != "deleted" })
+	assert.True(t, keepIf(&plainRecord{Key: 1, Value: "a"}, now))
+	assert.False(t, keepIf(&plainRecord{Key: 1, Value: "deleted"}, now))
+}
+
+func TestRetainedAfterDeduplication(t *testing.T) {
+	key := func(r interface{}) Key { return Key{r.(*plainRecord).Key} }
+	cfg := newReadConfig([]ReadOption{
+		withCompare(comparePlainRecords),
+		WithKeyDeduplication(key, KeepLast),
+		WithRetention(KeepIf(func(r interface{}) bool { return r.(*plainRecord).Value != "deleted" })),
+	})
+
+	it, err := cfg.sorted([]iterator.RecordIterator{
+		versionedRecords(plainRecord{1, "a"}, plainRecord{2, "deleted"}, plainRecord{3, "c"}),
+		versionedRecords(plainRecord{1, "deleted"}, plainRecord{2, "b"}, plainRecord{4, "deleted"}),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []plainRecord{{2, "b"}, {3, "c"}}, collectRecords(t, it))
+}
+
+func TestRetainedCountsDropped(t *testing.T) {
+	var dropped int64
+	cfg := newReadConfig([]ReadOption{WithRetention(KeepIf(func(r interface{}) bool { return r.(*plainRecord).Key%2 == 0 }))})
+	it := cfg.retained(versionedRecords(plainRecord{1, "a"}, plainRecord{2, "b"}, plainRecord{3, "c"}, plainRecord{5, "d"}), &dropped)
+	assert.Equal(t, []plainRecord{{2, "b"}}, collectRecords(t, it))
+	assert.Equal(t, int64(3), dropped)
+
+	cfg = newReadConfig(nil)
+	it = cfg.retained(versionedRecords(plainRecord{1, "a"}), &dropped)
+	assert.Equal(t, []plainRecord{{1, "a"}}, collectRecords(t, it))
+}
@@ -0,0 +1,233 @@
+package gcsext
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// SampleRecords returns about n random records from all objects under the prefix without reading them all.
+//
+// Objects are picked with a probability proportional to their ObjectAttrs.Size by drawing n random byte offsets over
+// the whole prefix. For uncompressed objects in a line delimited format (newline delimited JSON) the record on the first
+// line starting after each offset is read through a range read, so lines following long lines are somewhat more likely
+// to be picked; offsets landing on the same line yield the record once. Other objects (gzipped or in formats which
+// can't be decoded from any line, like CSV with its header) are read in full once instead, keeping a uniform reservoir
+// sample of as many records as offsets landed in the object. No record is returned twice and the result is
+// reproducible for the same seed and objects.
+func SampleRecords(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	new func() interface{},
+	predicate func(*storage.ObjectAttrs) bool,
+	n int,
+	seed int64,
+	opts ...ReadOption,
+) ([]interface{}, error) {
+	objects, err := listObjects(ctx, bucket, prefix, predicate)
+	if err != nil {
+		return nil, err
+	}
+	return newReadConfig(opts).sample(ctx, bucket, objects, new, n, rand.New(rand.NewSource(seed)))
+}
+
+// SampleRecordsByFolder works like SampleRecords but samples n records from each folder (stratified sampling) so small
+// folders are represented as well as large ones.
+func SampleRecordsByFolder(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	new func() interface{},
+	predicate func(*storage.ObjectAttrs) bool,
+	n int,
+	seed int64,
+	opts ...ReadOption,
+) (map[string][]interface{}, error) {
+	cfg := newReadConfig(opts)
+	rng := rand.New(rand.NewSource(seed))
+	folderIt := folderObjectsByPrefix(ctx, bucket, prefix, predicate)
+
+	res := map[string][]interface{}{}
+	for {
+		folder, objects, err := folderIt()
+		if err == iterator.ErrIteratorStop {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if res[folder], err = cfg.sample(ctx, bucket, objects, new, n, rng); err != nil {
+			return nil, errors.Wrapf(err, "failed to sample folder %s", folder)
+		}
+	}
+}
+
+// sample takes n records from the objects; see SampleRecords
+func (cfg *readConfig) sample(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	objects []*storage.ObjectAttrs,
+	new func() interface{},
+	n int,
+	rng *rand.Rand,
+) ([]interface{}, error) {
+	res := []interface{}{}
+	for i, offsets := range allocateSamples(objects, n, rng) {
+		if len(offsets) == 0 {
+			continue
+		}
+		objAttr := objects[i]
+
+		if !cfg.rangeReadable(objAttr) {
+			reader, err := newObjectReader(ctx, bucket, objAttr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to open %s", objAttr.Name)
+			}
+			records, err := reservoirSample(cfg.unorderedDecoder(objAttr, reader, new), len(offsets), rng)
+			reader.Close()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to sample %s", objAttr.Name)
+			}
+			res = append(res, records...)
+			continue
+		}
+
+		picked := map[int64]bool{} // The starts of the lines already sampled
+		for _, offset := range offsets {
+			line, start, err := readLineAt(ctx, bucket, objAttr, offset)
+			if err == io.EOF {
+				break // No records in the object
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s at offset %d", objAttr.Name, offset)
+			}
+			if picked[start] {
+				continue
+			}
+			picked[start] = true
+			rec, err := cfg.unorderedDecoder(objAttr, bytes.NewReader(line), new)()
+			if err == iterator.ErrIteratorStop {
+				continue // Quarantined by the dead letter queue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to decode %s at offset %d", objAttr.Name, offset)
+			}
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+// rangeReadable reports if records of the object can be read from any line boundary
+func (cfg *readConfig) rangeReadable(objAttr *storage.ObjectAttrs) bool {
+	_, lineDelimited := cfg.formatFor(objAttr.Name).(lineDecoderFormat)
+	return lineDelimited && !strings.HasSuffix(objAttr.Name, ".gz")
+}
+
+// allocateSamples draws n uniform byte offsets over the total size of the objects; returning the sorted offsets falling
+// within each object
+func allocateSamples(objects []*storage.ObjectAttrs, n int, rng *rand.Rand) [][]int64 {
+	res := make([][]int64, len(objects))
+	var total int64
+	for _, objAttr := range objects {
+		total += objAttr.Size
+	}
+	if total <= 0 {
+		return res
+	}
+
+	offsets := make([]int64, n)
+	for i := range offsets {
+		offsets[i] = rng.Int63n(total)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var start int64
+	obj := 0
+	for _, offset := range offsets {
+		for offset >= start+objects[obj].Size {
+			start += objects[obj].Size
+			obj++
+		}
+		res[obj] = append(res[obj], offset-start)
+	}
+	return res
+}
+
+// readLineAt returns the first non blank line starting after offset, and where it starts; wrapping around to the start
+// of the object if there is none. io.EOF is returned for objects without any non blank line.
+func readLineAt(ctx context.Context, bucket *storage.BucketHandle, objAttr *storage.ObjectAttrs, offset int64) ([]byte, int64, error) {
+	handle := bucket.Object(objAttr.Name)
+	if objAttr.Generation != 0 {
+		handle = handle.Generation(objAttr.Generation)
+	}
+
+	// Start one byte early so that an offset right at the start of a line picks that line
+	start := offset - 1
+	if start < 0 {
+		start = 0
+	}
+	r, err := handle.NewRangeReader(ctx, start, -1)
+	if err != nil {
+		return nil, 0, err
+	}
+	line, lineStart, err := nextLine(bufio.NewReader(r), offset > 0)
+	r.Close()
+	if err == io.EOF && offset > 0 {
+		return readLineAt(ctx, bucket, objAttr, 0)
+	}
+	return line, start + lineStart, err
+}
+
+// nextLine returns the next non blank line and its offset within br; optionally skipping the (partial) line first.
+// io.EOF is returned if there is no such line.
+func nextLine(br *bufio.Reader, skipPartial bool) ([]byte, int64, error) {
+	var offset int64
+	if skipPartial {
+		partial, err := br.ReadBytes('\n')
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += int64(len(partial))
+	}
+	for {
+		line, err := br.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			return trimmed, offset, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// reservoirSample returns k records picked uniformly from the iterator (all if there are fewer) using Algorithm R
+func reservoirSample(it iterator.RecordIterator, k int, rng *rand.Rand) ([]interface{}, error) {
+	res := make([]interface{}, 0, k)
+	var seen int64
+	var rec interface{}
+	var err error
+	for rec, err = it(); err == nil; rec, err = it() {
+		seen++
+		if len(res) < k {
+			res = append(res, rec)
+		} else if j := rng.Int63n(seen); j < int64(k) {
+			res[j] = rec
+		}
+	}
+	if err != iterator.ErrIteratorStop {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,140 @@
+package gcsext
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/kvanticoss/goutils/gzip"
+	"golang.org/x/net/context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllocateSamples(t *testing.T) {
+	objects := []*storage.ObjectAttrs{{Name: "a", Size: 100}, {Name: "empty"}, {Name: "b", Size: 900}}
+	alloc := allocateSamples(objects, 1000, rand.New(rand.NewSource(1)))
+	require.Len(t, alloc, 3)
+	assert.Empty(t, alloc[1])
+	assert.InDelta(t, 100, len(alloc[0]), 40)
+	assert.Equal(t, 1000, len(alloc[0])+len(alloc[2]))
+	for i, offsets := range alloc {
+		for _, offset := range offsets {
+			assert.True(t, offset >= 0 && offset < objects[i].Size)
+		}
+	}
+
+	assert.Equal(t, alloc, allocateSamples(objects, 1000, rand.New(rand.NewSource(1))), "expected the same seed to give the same sample")
+	assert.Equal(t, [][]int64{nil}, allocateSamples([]*storage.ObjectAttrs{{Name: "empty"}}, 10, rand.New(rand.NewSource(1))))
+}
+
+func TestNextLine(t *testing.T) {
+	data := "first\nsecond\n\nthird"
+	type found struct {
+		line  string
+		start int64
+	}
+	at := func(offset int64) (found, error) {
+		start := offset - 1
+		if start < 0 {
+			start = 0
+		}
+		line, lineStart, err := nextLine(bufio.NewReader(strings.NewReader(data[start:])), offset > 0)
+		return found{string(line), start + lineStart}, err
+	}
+
+	for offset, expected := range map[int64]found{
+		0: {"first", 0}, 1: {"second", 6}, 6: {"second", 6}, 7: {"third", 14}, 12: {"third", 14}, 14: {"third", 14},
+	} {
+		line, err := at(offset)
+		require.NoError(t, err)
+		assert.Equal(t, expected, line, "offset %d", offset)
+	}
+	_, err := at(16)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadLineAtWrapsAround(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.put("folder/a.json", "{\"Key\":1}\n{\"Key\":2}\n", nil)
+	objAttr := fake.attrs("folder/a.json")
+
+	line, start, err := readLineAt(context.Background(), bucket, objAttr, 12)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"Key\":1}", string(line), "expected the last line to wrap around to the first")
+	assert.Equal(t, int64(0), start)
+}
+
+func TestSampleRecordsRangeReadsLineDelimitedObjects(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("folder/a.json", 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	reads := 0
+	fake.hook = func(op, name string) int {
+		if op == "read" {
+			reads++
+		}
+		return 0
+	}
+
+	newRecord := func() interface{} { return &plainRecord{} }
+	sample, err := SampleRecords(context.Background(), bucket, "folder/", newRecord, nil, 3, 1)
+	require.NoError(t, err)
+	assert.NotEmpty(t, sample)
+	assert.GreaterOrEqual(t, reads, 3, "expected a range read per offset rather than reading the object once")
+}
+
+func TestSampleRecordsReadsGzippedObjectsInFull(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	compressed := &bytes.Buffer{}
+	w := gzip.NewWriter(compressed)
+	_, err := w.Write([]byte("{\"Key\":1}\n{\"Key\":2}\n{\"Key\":3}\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	fake.put("folder/a.json.gz", compressed.String(), nil)
+
+	newRecord := func() interface{} { return &plainRecord{} }
+	sample, err := SampleRecords(context.Background(), bucket, "folder/", newRecord, nil, 10, 1)
+	require.NoError(t, err)
+	assert.Len(t, sample, 3, "expected every record once")
+}
+
+func TestReservoirSample(t *testing.T) {
+	sample, err := reservoirSample(plainRecordIterator(1, 2, 3), 5, rand.New(rand.NewSource(1)))
+	require.NoError(t, err)
+	assert.Len(t, sample, 3)
+
+	counts := map[int]int{}
+	for seed := int64(0); seed < 1000; seed++ {
+		sample, err := reservoirSample(plainRecordIterator(0, 1, 2, 3, 4, 5, 6, 7, 8, 9), 2, rand.New(rand.NewSource(seed)))
+		require.NoError(t, err)
+		require.Len(t, sample, 2)
+		for _, rec := range sample {
+			counts[rec.(*plainRecord).Key]++
+		}
+	}
+	for key := 0; key < 10; key++ {
+		assert.InDelta(t, 200, counts[key], 60, "key %d", key)
+	}
+}
+
+func TestSampleRecordsHasNoDuplicates(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.put("folder/a.json", "{\"Key\":1}\n{\"Key\":2}\n{\"Key\":3}\n", nil)
+	fake.put("folder/b.json", "{\"Key\":4,\"Value\":\"a much longer line than the others\"}\n{\"Key\":5}\n", nil)
+
+	newRecord := func() interface{} { return &plainRecord{} }
+	for seed := int64(0); seed < 20; seed++ {
+		sample, err := SampleRecords(context.Background(), bucket, "folder/", newRecord, nil, 10, seed)
+		require.NoError(t, err)
+		keys := map[int]bool{}
+		for _, rec := range sample {
+			key := rec.(*plainRecord).Key
+			assert.False(t, keys[key], "record %d sampled twice (seed %d)", key, seed)
+			keys[key] = true
+		}
+	}
+}
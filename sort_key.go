@@ -0,0 +1,235 @@
+package gcsext
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/kvanticoss/goutils/iterator"
+)
+
+// Key is a comparable tuple extracted from a record. Elements may be strings, (unsigned) integers, floats, bools,
+// time.Time, []byte or nil; they are compared element by element, see CompareKeys.
+type Key []interface{}
+
+// KeyExtractor returns the Key of a record
+type KeyExtractor func(record interface{}) Key
+
+// CompareKeys compares two keys element by element; returning a negative number when a sorts before b, a positive number
+// when b sorts before a and 0 when they are equal. A key which is a prefix of the other sorts first, nil sorts before any
+// other value and elements of different kinds are ordered by kind name.
+func CompareKeys(a, b Key) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareKeyElements(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareKeyElements(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv)
+		}
+	case []byte:
+		if bv, ok := b.([]byte); ok {
+			return bytes.Compare(av, bv)
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			switch {
+			case av == bv:
+				return 0
+			case !av:
+				return -1
+			default:
+				return 1
+			}
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			switch {
+			case av.Before(bv):
+				return -1
+			case av.After(bv):
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+
+	ra, rb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch {
+	case isInt(ra) && isInt(rb):
+		return compareOrdered(ra.Int(), rb.Int())
+	case isUint(ra) && isUint(rb):
+		return compareOrdered(ra.Uint(), rb.Uint())
+	case isNumber(ra) && isNumber(rb):
+		return compareOrdered(toFloat(ra), toFloat(rb))
+	}
+
+	// Different kinds; at least be deterministic
+	if c := strings.Compare(ra.Kind().String(), rb.Kind().String()); c != 0 {
+		return c
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func compareOrdered[V int64 | uint64 | float64](a, b V) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func isNumber(v reflect.Value) bool {
+	return isInt(v) || isUint(v) || v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isInt(v):
+		return float64(v.Int())
+	case isUint(v):
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+// SortField is one field of a multi field sort specification; see SortBy
+type SortField struct {
+	Value      func(record interface{}) interface{}
+	Descending bool
+}
+
+// SortBy returns a comparator ordering records by each field in turn (e.g. customer ascending then time descending).
+// Field values are compared like Key elements.
+func SortBy(fields ...SortField) func(a, b interface{}) int {
+	return func(a, b interface{}) int {
+		for _, f := range fields {
+			c := compareKeyElements(f.Value(a), f.Value(b))
+			if f.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+}
+
+// CompareByKey returns a type safe Comparator ordering records by the key
+func CompareByKey[T any](key func(T) Key) Comparator[T] {
+	return func(a, b T) int {
+		return CompareKeys(key(a), key(b))
+	}
+}
+
+// Reverse returns a Comparator sorting in the opposite order of cmp
+func Reverse[T any](cmp Comparator[T]) Comparator[T] {
+	return func(a, b T) int {
+		return cmp(b, a)
+	}
+}
+
+// WithSortKey orders records by the Key returned by the extractor instead of the Lesser interface. The extractor receives
+// records as created by the new func (i.e *T for the generic API).
+func WithSortKey(key KeyExtractor) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.compare = func(a, b interface{}) int {
+			return CompareKeys(key(a), key(b))
+		}
+		cfg.sortKey = key
+	}
+}
+
+// WithComparator orders records through the compare function (negative when a sorts before b, positive when b sorts
+// before a and 0 when equal) instead of the Lesser interface. See also SortBy for multi field sort specifications.
+func WithComparator(cmp func(a, b interface{}) int) ReadOption {
+	return withCompare(cmp)
+}
+
+// WithDescending reverses the sort order (whether given by the Lesser interface, WithSortKey or WithComparator).
+// Source objects are expected to be sorted in descending order as well.
+func WithDescending() ReadOption {
+	return func(cfg *readConfig) {
+		cfg.descending = true
+	}
+}
+
+// WithDeduplication drops records equal to the previous record in the sorted stream (like the unix command uniq).
+// Records are considered equal when their keys are, or if key is nil, when neither sorts before the other.
+// For SortGCSFolders it implies removeDuplicates and defines what is considered a duplicate. See WithKeyDeduplication
+// to keep another record than the first.
+func WithDeduplication(key KeyExtractor) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.deduplicate = true
+		cfg.dedupKey = key
+	}
+}
+
+// duplicates returns the predicate deciding if two adjacent records are duplicates
+func (cfg *readConfig) duplicates() func(a, b interface{}) bool {
+	if cfg.dedupKey != nil {
+		return func(a, b interface{}) bool {
+			return CompareKeys(cfg.dedupKey(a), cfg.dedupKey(b)) == 0
+		}
+	}
+	cmp := cfg.comparator()
+	return func(a, b interface{}) bool {
+		return cmp(a, b) == 0
+	}
+}
+
+// deduplicateAdjacent works like iterator.DeduplicateRecordIterators but with a custom equality; the first record of
+// each run of duplicates is kept.
+func deduplicateAdjacent(it iterator.RecordIterator, equal func(a, b interface{}) bool) iterator.RecordIterator {
+	var previousRecord interface{}
+	return func() (interface{}, error) {
+		rec, err := it()
+		for err == nil && previousRecord != nil && equal(previousRecord, rec) {
+			rec, err = it()
+		}
+		if err == nil {
+			previousRecord = rec
+		}
+		return rec, err
+	}
+}
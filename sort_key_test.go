@@ -0,0 +1,68 @@
+package gcsext_test
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	gcsext "github.com/kvanticoss/google-cloudstorage-ext"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareKeys(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		a, b     gcsext.Key
+		expected int
+	}{
+		{a: gcsext.Key{"a", 1}, b: gcsext.Key{"a", 1}, expected: 0},
+		{a: gcsext.Key{"a", 1}, b: gcsext.Key{"a", 2}, expected: -1},
+		{a: gcsext.Key{"b"}, b: gcsext.Key{"a", 2}, expected: 1},
+		{a: gcsext.Key{"a"}, b: gcsext.Key{"a", 2}, expected: -1},
+		{a: gcsext.Key{int64(3)}, b: gcsext.Key{int32(3)}, expected: 0},
+		{a: gcsext.Key{uint(3)}, b: gcsext.Key{2.5}, expected: 1},
+		{a: gcsext.Key{now}, b: gcsext.Key{now.Add(time.Second)}, expected: -1},
+		{a: gcsext.Key{nil}, b: gcsext.Key{""}, expected: -1},
+		{a: gcsext.Key{true}, b: gcsext.Key{false}, expected: 1},
+	}
+
+	for _, test := range tests {
+		c := gcsext.CompareKeys(test.a, test.b)
+		switch {
+		case test.expected < 0:
+			assert.True(t, c < 0, "expected %v < %v", test.a, test.b)
+		case test.expected > 0:
+			assert.True(t, c > 0, "expected %v > %v", test.a, test.b)
+		default:
+			assert.Equal(t, 0, c, "expected %v == %v", test.a, test.b)
+		}
+	}
+}
+
+func TestSortBy(t *testing.T) {
+	records := []interface{}{
+		&testStruct{Var1: "b", Var2: 1},
+		&testStruct{Var1: "a", Var2: 1},
+		&testStruct{Var1: "a", Var2: 3},
+		&testStruct{Var1: "b", Var2: 2},
+	}
+	cmp := gcsext.SortBy(
+		gcsext.SortField{Value: func(r interface{}) interface{} { return r.(*testStruct).Var1 }},
+		gcsext.SortField{Value: func(r interface{}) interface{} { return r.(*testStruct).Var2 }, Descending: true},
+	)
+	sort.SliceStable(records, func(i, j int) bool { return cmp(records[i], records[j]) < 0 })
+
+	assert.Equal(t, []interface{}{
+		&testStruct{Var1: "a", Var2: 3},
+		&testStruct{Var1: "a", Var2: 1},
+		&testStruct{Var1: "b", Var2: 2},
+		&testStruct{Var1: "b", Var2: 1},
+	}, records)
+}
+
+func TestCompareByKeyAndReverse(t *testing.T) {
+	records := []testStruct{{Var3: 2}, {Var3: 3}, {Var3: 1}}
+	cmp := gcsext.Reverse(gcsext.CompareByKey(func(s testStruct) gcsext.Key { return gcsext.Key{s.Var3} }))
+	sort.Slice(records, func(i, j int) bool { return cmp(records[i], records[j]) < 0 })
+	assert.Equal(t, []testStruct{{Var3: 3}, {Var3: 2}, {Var3: 1}}, records)
+}
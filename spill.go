@@ -0,0 +1,122 @@
+package gcsext
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/kvanticoss/goutils/recordbuffer"
+)
+
+// defaultSpillFactory keeps spilled records in RAM
+func defaultSpillFactory() recordbuffer.ReadWriteResetter {
+	return &bytes.Buffer{}
+}
+
+// spillRun is a sorted run of gob encoded records stored in a ReadWriteResetter. All records of a run share one gob
+// stream so their type is only described once.
+type spillRun struct {
+	buf recordbuffer.ReadWriteResetter
+	enc *gob.Encoder
+}
+
+func newEmptySpillRun(factory recordbuffer.ReadWriteResetterFactory) *spillRun {
+	buf := factory()
+	return &spillRun{buf: buf, enc: gob.NewEncoder(buf)}
+}
+
+// newSpillRun writes all records from the iterator into a new buffer created by the factory
+func newSpillRun(factory recordbuffer.ReadWriteResetterFactory, it iterator.RecordIterator) (*spillRun, error) {
+	run := newEmptySpillRun(factory)
+
+	var rec interface{}
+	var err error
+	for rec, err = it(); err == nil; rec, err = it() {
+		if err := run.add(rec); err != nil {
+			return nil, err
+		}
+	}
+	if err != iterator.ErrIteratorStop {
+		return nil, err
+	}
+	return run, nil
+}
+
+// add appends the record to the run
+func (run *spillRun) add(rec interface{}) error {
+	return run.enc.Encode(rec)
+}
+
+// iterator reads the records back (once); the buffer is Reset when exhausted
+func (run *spillRun) iterator(new func() interface{}) iterator.RecordIterator {
+	dec := gob.NewDecoder(run.buf)
+	return func() (interface{}, error) {
+		dst := new()
+		err := dec.Decode(dst)
+		if err == io.EOF {
+			run.buf.Reset()
+			return nil, iterator.ErrIteratorStop
+		}
+		return dst, err
+	}
+}
+
+// sortedRuns buffers records in sorted runs like recordbuffer.SortedRecordBuffers but orders them through a compareFunc
+// so the records don't have to implement Lesser. Each record is appended to the first run whose last record doesn't
+// sort after it; sorted input ends up in a single run while unsorted input is split into as many runs as needed.
+// Equal records are yielded in the order they were added.
+type sortedRuns struct {
+	factory recordbuffer.ReadWriteResetterFactory
+	cmp     compareFunc
+	runs    []*spillRun
+	last    []interface{}
+}
+
+func newSortedRuns(factory recordbuffer.ReadWriteResetterFactory, cmp compareFunc) *sortedRuns {
+	return &sortedRuns{factory: factory, cmp: cmp}
+}
+
+// load adds all records of the iterator
+func (s *sortedRuns) load(it iterator.RecordIterator) error {
+	var rec interface{}
+	var err error
+	for rec, err = it(); err == nil; rec, err = it() {
+		if err := s.add(rec); err != nil {
+			return err
+		}
+	}
+	if err != iterator.ErrIteratorStop {
+		return err
+	}
+	return nil
+}
+
+// add appends the record to the first run it extends; creating a new run if there is none
+func (s *sortedRuns) add(rec interface{}) error {
+	for i, last := range s.last {
+		if s.cmp(rec, last) >= 0 {
+			s.last[i] = rec
+			return s.runs[i].add(rec)
+		}
+	}
+	run := newEmptySpillRun(s.factory)
+	s.runs = append(s.runs, run)
+	s.last = append(s.last, rec)
+	return run.add(rec)
+}
+
+// len is the number of runs; 0 when no records were added
+func (s *sortedRuns) len() int {
+	return len(s.runs)
+}
+
+// sorted merges the runs into one sorted iterator; the runs can only be read once
+func (s *sortedRuns) sorted(new func() interface{}) (iterator.RecordIterator, error) {
+	iterators := make([]iterator.RecordIterator, len(s.runs))
+	for i, run := range s.runs {
+		iterators[i] = run.iterator(new)
+	}
+	s.runs, s.last = nil, nil
+	return mergeSorted(iterators, s.cmp)
+}
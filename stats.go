@@ -0,0 +1,196 @@
+package gcsext
+
+import (
+	"io"
+	"time"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	jsoniter "github.com/json-iterator/go"
+	"golang.org/x/net/context"
+)
+
+// FolderStats describes the objects and records of a folder (or of the whole prefix for StatsReport.Total)
+type FolderStats struct {
+	Folder            string `json:"folder"`
+	Objects           int    `json:"objects"`
+	UnsortedObjects   int    `json:"unsorted_objects"` // Objects with records out of order; candidates for SortGCSFolders
+	CompressedBytes   int64  `json:"compressed_bytes"`
+	DecompressedBytes int64  `json:"decompressed_bytes"`
+	Records           int64  `json:"records"`
+
+	// Min and Max are the smallest and largest sort keys (a Key; see WithSortKey) of the records. Without a sort key they
+	// are the smallest and largest records according to the Lesser interface or WithComparator. Nil when the folder has
+	// no records or its records aren't comparable.
+	Min interface{} `json:"min,omitempty"`
+	Max interface{} `json:"max,omitempty"`
+
+	OldestUpdated time.Time `json:"oldest_updated"`
+	NewestUpdated time.Time `json:"newest_updated"`
+}
+
+// StatsReport is returned by Stats
+type StatsReport struct {
+	Folders []*FolderStats
+	Total   *FolderStats
+}
+
+// Stats walks all objects under the prefix and reports statistics per folder and in total. Every object is read and
+// decoded (records are created by new) in order to count the records, the decompressed bytes and to find the min and max
+// sort keys or records. It is typically used to find folders which needs SortGCSFolders or to detect empty and stale partitions.
+func Stats(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	prefix string,
+	new func() interface{},
+	predicate func(*storage.ObjectAttrs) bool,
+	opts ...ReadOption,
+) (*StatsReport, error) {
+	cfg := newReadConfig(opts)
+	folderIt := folderObjectsByPrefix(ctx, bucket, prefix, predicate)
+
+	report := &StatsReport{Folders: []*FolderStats{}, Total: &FolderStats{Folder: prefix}}
+	for {
+		folder, objects, err := folderIt()
+		if err == iterator.ErrIteratorStop {
+			return report, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stats := &FolderStats{Folder: folder}
+		for _, objAttr := range objects {
+			if err := cfg.addObjectStats(ctx, bucket, objAttr, new, stats); err != nil {
+				return nil, errors.Wrapf(err, "failed to read %s", objAttr.Name)
+			}
+		}
+		report.Folders = append(report.Folders, stats)
+		cfg.mergeStats(report.Total, stats)
+	}
+}
+
+// WriteNDJSON writes one line per folder followed by a line for the total
+func (r *StatsReport) WriteNDJSON(w io.Writer) error {
+	enc := jsoniter.NewEncoder(w)
+	for _, stats := range r.Folders {
+		if err := enc.Encode(stats); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(r.Total)
+}
+
+// addObjectStats reads all records of the object into the stats
+func (cfg *readConfig) addObjectStats(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	objAttr *storage.ObjectAttrs,
+	new func() interface{},
+	stats *FolderStats,
+) error {
+	reader, err := newObjectReader(ctx, bucket, objAttr)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	counter := &countingReader{r: reader}
+
+	objStats := &FolderStats{
+		Objects:         1,
+		CompressedBytes: objAttr.Size,
+		OldestUpdated:   objAttr.Updated,
+		NewestUpdated:   objAttr.Updated,
+	}
+	cmp := cfg.comparator()
+	var previous interface{}
+	it := cfg.unorderedDecoder(objAttr, counter, new)
+	var rec interface{}
+	for rec, err = it(); err == nil; rec, err = it() {
+		objStats.Records++
+		if !cfg.comparable(rec) {
+			continue
+		}
+		if previous != nil && cmp(rec, previous) < 0 {
+			objStats.UnsortedObjects = 1
+		}
+		previous = rec
+		var bound interface{} = rec
+		if cfg.sortKey != nil {
+			bound = cfg.sortKey(rec)
+		}
+		if objStats.Min == nil || cfg.compareBounds(bound, objStats.Min) < 0 {
+			objStats.Min = bound
+		}
+		if objStats.Max == nil || cfg.compareBounds(bound, objStats.Max) > 0 {
+			objStats.Max = bound
+		}
+	}
+	if err != iterator.ErrIteratorStop {
+		return err
+	}
+	objStats.DecompressedBytes = counter.n
+
+	cfg.mergeStats(stats, objStats)
+	return nil
+}
+
+// comparable reports if the record can be ordered by the comparator
+func (cfg *readConfig) comparable(rec interface{}) bool {
+	if cfg.compare != nil {
+		return true
+	}
+	_, ok := rec.(iterator.Lesser)
+	return ok
+}
+
+// mergeStats adds the stats of src to dst
+func (cfg *readConfig) mergeStats(dst, src *FolderStats) {
+	dst.Objects += src.Objects
+	dst.UnsortedObjects += src.UnsortedObjects
+	dst.CompressedBytes += src.CompressedBytes
+	dst.DecompressedBytes += src.DecompressedBytes
+	dst.Records += src.Records
+	if src.Min != nil && (dst.Min == nil || cfg.compareBounds(src.Min, dst.Min) < 0) {
+		dst.Min = src.Min
+	}
+	if src.Max != nil && (dst.Max == nil || cfg.compareBounds(src.Max, dst.Max) > 0) {
+		dst.Max = src.Max
+	}
+	if !src.OldestUpdated.IsZero() && (dst.OldestUpdated.IsZero() || src.OldestUpdated.Before(dst.OldestUpdated)) {
+		dst.OldestUpdated = src.OldestUpdated
+	}
+	if src.NewestUpdated.After(dst.NewestUpdated) {
+		dst.NewestUpdated = src.NewestUpdated
+	}
+}
+
+// compareBounds compares the Min or Max of FolderStats; sort keys if a sort key is given, otherwise records
+func (cfg *readConfig) compareBounds(a, b interface{}) int {
+	if cfg.sortKey != nil {
+		return cfg.compareKeys(a.(Key), b.(Key))
+	}
+	return cfg.comparator()(a, b)
+}
+
+// compareKeys compares sort keys in the order of the records (see WithDescending)
+func (cfg *readConfig) compareKeys(a, b Key) int {
+	if cfg.descending {
+		return CompareKeys(b, a)
+	}
+	return CompareKeys(a, b)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
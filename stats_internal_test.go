@@ -0,0 +1,92 @@
+package gcsext
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestMergeStats(t *testing.T) {
+	cfg := newReadConfig([]ReadOption{WithSortKey(plainKey)})
+	older, newer := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	total := &FolderStats{Folder: "prefix/"}
+	cfg.mergeStats(total, &FolderStats{
+		Objects: 2, UnsortedObjects: 1, CompressedBytes: 10, DecompressedBytes: 30, Records: 3,
+		Min: Key{2}, Max: Key{5}, OldestUpdated: newer, NewestUpdated: newer,
+	})
+	cfg.mergeStats(total, &FolderStats{Objects: 1, OldestUpdated: older, NewestUpdated: older})
+	cfg.mergeStats(total, &FolderStats{
+		Objects: 1, CompressedBytes: 5, DecompressedBytes: 5, Records: 1,
+		Min: Key{1}, Max: Key{1}, OldestUpdated: newer, NewestUpdated: newer,
+	})
+
+	assert.Equal(t, &FolderStats{
+		Folder: "prefix/", Objects: 4, UnsortedObjects: 1, CompressedBytes: 15, DecompressedBytes: 35, Records: 4,
+		Min: Key{1}, Max: Key{5}, OldestUpdated: older, NewestUpdated: newer,
+	}, total)
+}
+
+func TestStatsReportNDJSON(t *testing.T) {
+	report := &StatsReport{
+		Folders: []*FolderStats{{Folder: "prefix/a/", Objects: 1, Records: 2, Min: Key{1, "a"}}},
+		Total:   &FolderStats{Folder: "prefix/", Objects: 1, Records: 2},
+	}
+	buf := &bytes.Buffer{}
+	assert.NoError(t, report.WriteNDJSON(buf))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"folder":"prefix/a/"`)
+	assert.Contains(t, lines[0], `"min":[1,"a"]`)
+	assert.NotContains(t, lines[1], `"min"`)
+}
+
+func TestStatsKeepSortKeys(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.put("prefix/a/1.json", "{\"Key\":3,\"Value\":\"c\"}\n{\"Key\":1,\"Value\":\"a\"}\n", nil)
+	fake.put("prefix/a/2.json", "{\"Key\":7,\"Value\":\"g\"}\n", nil)
+	newRecord := func() interface{} { return &plainRecord{} }
+
+	report, err := Stats(context.Background(), bucket, "prefix/", newRecord, nil, WithSortKey(plainKey), WithDescending())
+	require.NoError(t, err)
+	require.Len(t, report.Folders, 1)
+	assert.Equal(t, Key{7}, report.Folders[0].Min)
+	assert.Equal(t, Key{1}, report.Folders[0].Max)
+	assert.Equal(t, 0, report.Folders[0].UnsortedObjects)
+
+	report, err = Stats(context.Background(), bucket, "prefix/", newRecord, nil, WithComparator(comparePlainRecords))
+	require.NoError(t, err)
+	assert.Equal(t, &plainRecord{Key: 1, Value: "a"}, report.Total.Min, "expected the records without a sort key")
+	assert.Equal(t, &plainRecord{Key: 7, Value: "g"}, report.Total.Max)
+	assert.Equal(t, int64(3), report.Total.Records)
+}
+
+// lesserRecord is ordered by the Lesser interface only
+type lesserRecord struct {
+	Key int
+}
+
+func (r *lesserRecord) Less(other interface{}) bool {
+	return r.Key < other.(*lesserRecord).Key
+}
+
+func TestStatsOfLesserRecords(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.put("prefix/a/1.json", "{\"Key\":3}\n{\"Key\":1}\n", nil)
+	fake.put("prefix/b/1.json", "{\"Key\":7}\n", nil)
+
+	report, err := Stats(context.Background(), bucket, "prefix/", func() interface{} { return &lesserRecord{} }, nil)
+	require.NoError(t, err)
+	require.Len(t, report.Folders, 2)
+	assert.Equal(t, &lesserRecord{Key: 1}, report.Folders[0].Min)
+	assert.Equal(t, &lesserRecord{Key: 3}, report.Folders[0].Max)
+	assert.Equal(t, 1, report.Folders[0].UnsortedObjects)
+	assert.Equal(t, &lesserRecord{Key: 1}, report.Total.Min)
+	assert.Equal(t, &lesserRecord{Key: 7}, report.Total.Max)
+}
@@ -0,0 +1,102 @@
+package gcsext
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/kvanticoss/goutils/recordbuffer"
+)
+
+// TempFileBuffers creates recordbuffer.ReadWriteResetters backed by temporary files; useful as a cacheFactory for
+// SortGCSFolders or for spilling when the data doesn't fit in RAM. Files are created on the first write and removed
+// by Reset or Cleanup.
+type TempFileBuffers struct {
+	dir string
+
+	mu      sync.Mutex
+	buffers []*tempFileBuffer
+}
+
+// NewTempFileBuffers returns TempFileBuffers creating files in dir; or the default temp directory if dir is ""
+func NewTempFileBuffers(dir string) *TempFileBuffers {
+	return &TempFileBuffers{dir: dir}
+}
+
+// New returns a new file backed buffer; it has the signature of a recordbuffer.ReadWriteResetterFactory
+func (t *TempFileBuffers) New() recordbuffer.ReadWriteResetter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &tempFileBuffer{dir: t.dir}
+	t.buffers = append(t.buffers, b)
+	return b
+}
+
+// Cleanup removes the files of all buffers created
+func (t *TempFileBuffers) Cleanup() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var err error
+	for _, b := range t.buffers {
+		if rErr := b.remove(); rErr != nil && err == nil {
+			err = rErr
+		}
+	}
+	t.buffers = nil
+	return err
+}
+
+// tempFileBuffer is a FIFO byte buffer stored in a file; reads continue from where the previous read ended while writes
+// are appended.
+type tempFileBuffer struct {
+	dir string
+	f   *os.File
+
+	readOffset  int64
+	writeOffset int64
+}
+
+func (b *tempFileBuffer) Write(p []byte) (int, error) {
+	if b.f == nil {
+		f, err := ioutil.TempFile(b.dir, "gcsext-buffer-")
+		if err != nil {
+			return 0, err
+		}
+		b.f = f
+	}
+	n, err := b.f.WriteAt(p, b.writeOffset)
+	b.writeOffset += int64(n)
+	return n, err
+}
+
+func (b *tempFileBuffer) Read(p []byte) (int, error) {
+	if b.f == nil || b.readOffset >= b.writeOffset {
+		return 0, io.EOF
+	}
+	if remaining := b.writeOffset - b.readOffset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.f.ReadAt(p, b.readOffset)
+	b.readOffset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Reset discards all content and removes the underlying file
+func (b *tempFileBuffer) Reset() {
+	_ = b.remove()
+}
+
+func (b *tempFileBuffer) remove() error {
+	b.readOffset, b.writeOffset = 0, 0
+	if b.f == nil {
+		return nil
+	}
+	name := b.f.Name()
+	b.f.Close()
+	b.f = nil
+	return os.Remove(name)
+}
@@ -0,0 +1,167 @@
+package gcsext
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// CompactionLevel is a level of tiered compaction (see NewTieredCompactor); the outputs of the level below are merged
+// into a single output in their parent folder. E.g. hourly outputs in prefix/2020/01/02/13 into a daily output in
+// prefix/2020/01/02.
+type CompactionLevel struct {
+	Name string // Only used for error messages; e.g. "day"
+
+	// Parent maps a folder of the level below to its folder at this level; defaults to path.Dir. Folders which are their
+	// own parent aren't rolled up.
+	Parent func(folder string) string
+
+	// Destination is the name of the output within each folder of this level; e.g. "daily.json.gz". It must differ from
+	// the names of the other levels.
+	Destination string
+
+	// Policies decide which folders are rolled up; evaluated with the outputs of the level below as FolderListing.Sources.
+	// Without RemoveLower they default to NewerThanLastCompaction.
+	Policies []CompactionPolicy
+
+	// RemoveLower removes the outputs of the level below once this level has committed them (crash safe through the
+	// CompactionManifest) and new lower outputs are merged into the existing output of this level. Otherwise the lower
+	// outputs are kept and the output of this level is rebuilt from all of them whenever rolled up. The level below
+	// must remove its sources as well (WithSourceRemoval for the base Compactor); an output rebuilt from sources which
+	// were kept would be merged again.
+	RemoveLower bool
+}
+
+// TieredCompactor compacts the folders under a prefix with a Compactor and then rolls the compacted outputs up through
+// the levels (e.g. hour, day and month) without re-reading the raw data. Each level is compacted with the options of
+// the base Compactor (record type, read options, concurrency, leases, rolling parts and so on) except for its sources,
+// destination, policies and source removal which are given by the CompactionLevel.
+//
+// Tombstones (see WithTombstones) are kept in the outputs of all levels but the top one, where WithTombstoneRetention
+// decides; older data they delete might still be in the levels above. Tombstone objects (see WithTombstonePrefix) are
+// only removed once applied to all levels.
+type TieredCompactor struct {
+	base   *Compactor
+	levels []CompactionLevel
+}
+
+// NewTieredCompactor returns a TieredCompactor rolling the outputs of base up through the levels; lowest level first
+func NewTieredCompactor(base *Compactor, levels ...CompactionLevel) *TieredCompactor {
+	return &TieredCompactor{base: base, levels: levels}
+}
+
+// TieredResult reports what a TieredCompactor did; Levels[0] is the base compaction and Levels[i] the i'th
+// CompactionLevel
+type TieredResult struct {
+	Levels     []*CompactionResult
+	Tombstones []string // Tombstone objects removed once applied to all levels (see WithTombstonePrefix)
+}
+
+// Compact compacts the prefix with the base Compactor and then rolls up each level in turn. A level is only compacted
+// once all folders of the level below succeeded; otherwise the *CompactionError of the failed level is returned along
+// with the results so far.
+func (t *TieredCompactor) Compact(ctx context.Context, prefix string) (*TieredResult, error) {
+	if t.base.destination == nil {
+		return nil, ErrNoCompactionDestination
+	}
+	// All levels are compacted with the same tombstones; read once
+	base, tombstones, err := t.base.withTombstones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	compactors, err := t.compactors(base)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TieredResult{}
+	folders := []*FolderResult{}
+	for i, c := range compactors {
+		result, err := c.compact(ctx, prefix, len(tombstones) > 0)
+		if err != nil {
+			if i > 0 {
+				err = errors.Wrapf(err, "failed to roll up level %s", t.levels[i-1].Name)
+			}
+			if result != nil {
+				res.Levels = append(res.Levels, result)
+			}
+			return res, err
+		}
+		res.Levels = append(res.Levels, result)
+		folders = append(folders, result.Folders...)
+	}
+
+	if len(tombstones) > 0 {
+		res.Tombstones, err = base.removeTombstones(ctx, prefix, folders, tombstones, compactors)
+	}
+	return res, err
+}
+
+// compactors returns the Compactor of each level; starting with the base
+func (t *TieredCompactor) compactors(base *Compactor) ([]*Compactor, error) {
+	names := map[string]bool{}
+	lowerRemoves := base.removeSources
+	for _, level := range t.levels {
+		if level.Destination == "" || names[level.Destination] || base.isDestination(path.Join("folder", level.Destination)) {
+			return nil, errors.Errorf("level %s needs a destination name distinct from the other levels", level.Name)
+		}
+		if level.RemoveLower && !lowerRemoves {
+			return nil, errors.Errorf("level %s can only remove the outputs of the level below if that level removes its "+
+				"sources", level.Name)
+		}
+		names[level.Destination] = true
+		lowerRemoves = level.RemoveLower
+	}
+
+	res := []*Compactor{t.levelCompactor(base, base, nil, len(t.levels) > 0)}
+	for i := range t.levels {
+		res = append(res, t.levelCompactor(base, res[i], &t.levels[i], i+1 < len(t.levels)))
+	}
+
+	// The raw sources of the base must never include the outputs of the levels above
+	baseSources := base.srcPredicate
+	res[0].srcPredicate = func(objAttr *storage.ObjectAttrs) bool {
+		for _, c := range res[1:] {
+			if c.isDestination(objAttr.Name) {
+				return false
+			}
+		}
+		return baseSources == nil || baseSources(objAttr)
+	}
+	return res, nil
+}
+
+// levelCompactor returns a copy of base compacting the outputs of lower into the level; or base itself if level is nil
+func (t *TieredCompactor) levelCompactor(base, lower *Compactor, level *CompactionLevel, keepTombstones bool) *Compactor {
+	c := *base
+	c.readOpts = base.readOpts[:len(base.readOpts):len(base.readOpts)]
+	if keepTombstones {
+		c.readOpts = append(c.readOpts, withKeptTombstones())
+	}
+	if level == nil {
+		return &c
+	}
+
+	parent := level.Parent
+	if parent == nil {
+		parent = path.Dir
+	}
+	c.parent = parent
+	c.srcPredicate = func(objAttr *storage.ObjectAttrs) bool {
+		folder := path.Dir(objAttr.Name)
+		return lower.isDestination(objAttr.Name) && parent(folder) != folder
+	}
+	c.destination = func(folder string) string {
+		return path.Join(folder, level.Destination)
+	}
+	c.removeSources = level.RemoveLower
+	c.rebuild = !level.RemoveLower
+	c.policies = level.Policies
+	if c.policies == nil && !level.RemoveLower {
+		c.policies = []CompactionPolicy{NewerThanLastCompaction()}
+	}
+	return &c
+}
@@ -0,0 +1,100 @@
+package gcsext
+
+import (
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredCompactorLevels(t *testing.T) {
+	base := NewCompactor(nil, nil, WithDestination("hourly.json.gz"), WithSourceRemoval(), WithSourcePredicate(func(objAttr *storage.ObjectAttrs) bool {
+		return objAttr.Size > 0
+	}))
+	tiered := NewTieredCompactor(base,
+		CompactionLevel{Name: "day", Destination: "daily.json.gz", RemoveLower: true},
+		CompactionLevel{Name: "month", Destination: "monthly.json.gz"},
+	)
+	compactors, err := tiered.compactors(base)
+	require.NoError(t, err)
+	require.Len(t, compactors, 3)
+	hour, day, month := compactors[0].sourcePredicate(), compactors[1].sourcePredicate(), compactors[2].sourcePredicate()
+
+	raw := &storage.ObjectAttrs{Name: "data/2020/01/02/13/1.json", Size: 1}
+	hourly := &storage.ObjectAttrs{Name: "data/2020/01/02/13/hourly.json.gz", Size: 1}
+	daily := &storage.ObjectAttrs{Name: "data/2020/01/02/daily.json.gz", Size: 1}
+	monthly := &storage.ObjectAttrs{Name: "data/2020/01/monthly.json.gz", Size: 1}
+	for _, tc := range []struct {
+		objAttr          *storage.ObjectAttrs
+		hour, day, month bool
+	}{
+		{raw, true, false, false},
+		{hourly, false, true, false},
+		{daily, false, false, true},
+		{monthly, false, false, false},
+		{&storage.ObjectAttrs{Name: "data/2020/01/02/13/empty.json"}, false, false, false},
+	} {
+		assert.Equal(t, tc.hour, hour(tc.objAttr), "hour %s", tc.objAttr.Name)
+		assert.Equal(t, tc.day, day(tc.objAttr), "day %s", tc.objAttr.Name)
+		assert.Equal(t, tc.month, month(tc.objAttr), "month %s", tc.objAttr.Name)
+	}
+
+	assert.Equal(t, "data/2020/01/02", compactors[1].sourceFolder(hourly.Name))
+	assert.Equal(t, "data/2020/01/02/daily.json.gz", compactors[1].destination("data/2020/01/02"))
+	assert.True(t, compactors[1].removeSources)
+	assert.False(t, compactors[1].rebuild)
+	assert.Nil(t, compactors[1].policies)
+
+	assert.Equal(t, "data/2020/01", compactors[2].sourceFolder(daily.Name))
+	assert.False(t, compactors[2].removeSources)
+	assert.True(t, compactors[2].rebuild)
+	assert.Len(t, compactors[2].policies, 1, "expected rebuilt levels to default to NewerThanLastCompaction")
+
+	assert.True(t, newReadConfig(compactors[0].readOpts).keepTombstones)
+	assert.True(t, newReadConfig(compactors[1].readOpts).keepTombstones)
+	assert.False(t, newReadConfig(compactors[2].readOpts).keepTombstones)
+	assert.Empty(t, base.readOpts, "expected the base Compactor to be left as is")
+}
+
+func TestTieredCompactorNeedsDistinctDestinations(t *testing.T) {
+	base := NewCompactor(nil, nil, WithDestination("sorted.json"))
+	for _, levels := range [][]CompactionLevel{
+		{{Name: "day"}},
+		{{Name: "day", Destination: "sorted.json"}},
+		{{Name: "day", Destination: "daily.json"}, {Name: "month", Destination: "daily.json"}},
+	} {
+		_, err := NewTieredCompactor(base, levels...).compactors(base)
+		assert.Error(t, err)
+	}
+}
+
+func TestTieredCompactorRemovesLowerOnlyAboveRemovingLevels(t *testing.T) {
+	base := NewCompactor(nil, nil, WithDestination("hourly.json"))
+	_, err := NewTieredCompactor(base, CompactionLevel{Name: "day", Destination: "daily.json", RemoveLower: true}).compactors(base)
+	assert.EqualError(t, err, "level day can only remove the outputs of the level below if that level removes its sources")
+
+	base = NewCompactor(nil, nil, WithDestination("hourly.json"), WithSourceRemoval())
+	_, err = NewTieredCompactor(base,
+		CompactionLevel{Name: "day", Destination: "daily.json"},
+		CompactionLevel{Name: "month", Destination: "monthly.json", RemoveLower: true},
+	).compactors(base)
+	assert.EqualError(t, err, "level month can only remove the outputs of the level below if that level removes its sources")
+
+	_, err = NewTieredCompactor(base,
+		CompactionLevel{Name: "day", Destination: "daily.json", RemoveLower: true},
+		CompactionLevel{Name: "month", Destination: "monthly.json", RemoveLower: true},
+	).compactors(base)
+	assert.NoError(t, err)
+}
+
+func TestKeptTombstones(t *testing.T) {
+	var deleted int64
+	cfg := newReadConfig([]ReadOption{withCompare(comparePlainRecords), WithTombstones(plainKey, isDeleted), withKeptTombstones()})
+	it := cfg.tombstoned(versionedRecords(plainRecord{1, "a"}, plainRecord{2, "a"}, plainRecord{2, "deleted"}, plainRecord{3, "a"}), &deleted)
+	assert.Equal(t, []plainRecord{{1, "a"}, {2, "deleted"}, {3, "a"}}, collectRecords(t, it))
+	assert.Equal(t, int64(1), deleted)
+	_, err := it()
+	assert.Equal(t, iterator.ErrIteratorStop, err)
+}
@@ -0,0 +1,336 @@
+package gcsext
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// ErrTombstoneKeyOrder is returned when the records aren't sorted by the primary key of WithTombstones
+var ErrTombstoneKeyOrder = errors.New("tombstones need the records sorted by their primary key")
+
+// WithTombstones treats the records accepted by isTombstone as deletions of all records sharing their primary key. Like
+// WithKeyDeduplication the records with the same key must be adjacent in the sorted stream; i.e. the sort order must
+// start with the primary key. Keys out of that order fail with ErrTombstoneKeyOrder. Combined with
+// WithKeyDeduplication (e.g. WithLastWriteWins) the records of a key are merged first; a tombstone only deletes the key
+// if it is the record kept, so a record newer than the tombstone survives it.
+//
+// The sorted iterators never yield tombstones nor the records they delete. SortGCSFolders (and the Compactor) apply
+// the tombstones while merging and keep them in the destination, where they go on deleting records of the key which
+// arrive late, until WithTombstoneRetention drops them. Deleted records are counted in FolderResult.Deleted.
+func WithTombstones(key KeyExtractor, isTombstone func(record interface{}) bool) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.tombstoneKey = key
+		cfg.isTombstone = isTombstone
+	}
+}
+
+// WithTombstoneRetention drops the tombstones (see WithTombstones) rejected by the policy (e.g. MaxAge) from the
+// destinations written by SortGCSFolders and the Compactor; the policy should keep them for as long as older records of
+// their key may still arrive. Without it tombstones are kept indefinitely.
+func WithTombstoneRetention(policy RetentionPolicy) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.tombstoneRetention = policy
+	}
+}
+
+// WithTombstonePrefix reads tombstones from the objects under prefix; every record there (decoded like the other
+// records, e.g. only holding the primary key) deletes the records sharing its key in every folder. The tombstones are
+// read into memory once per iterator or Compact. Objects under the prefix are never read as records themselves.
+//
+// While tombstone objects exist the Compactor rewrites every folder with a destination, even without new sources and
+// regardless of its CompactionPolicies. The tombstone objects read are removed, at the generation read, once a Compact
+// covering their scope (see WithTombstoneScope) has applied them to all folders (none failed nor skipped) and no folder
+// in the scope has sources left which weren't compacted with them; e.g. sources written while compacting. See
+// CompactionResult.Tombstones.
+func WithTombstonePrefix(prefix string, key KeyExtractor) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.tombstonePrefix = prefix
+		cfg.tombstoneKey = key
+	}
+}
+
+// WithTombstoneScope sets the prefix holding all the records which the tombstone objects (see WithTombstonePrefix) may
+// delete; by default the whole bucket. Tombstone objects are only removed by a Compact of a prefix covering the scope;
+// compacting a narrower prefix applies them but keeps them for the folders outside it.
+func WithTombstoneScope(prefix string) CompactionOption {
+	return func(c *Compactor) {
+		c.tombstoneScope = prefix
+	}
+}
+
+// withTombstoneKeys sets the keys deleted by the tombstone objects; used by the Compactor to read them once per Compact
+func withTombstoneKeys(keys sortedKeys) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.tombstoneKeys = keys
+	}
+}
+
+// withKeptTombstones keeps the tombstones (see WithTombstones) while still removing the records they delete; used by
+// the lower levels of a TieredCompactor as older data might still be found in the levels above
+func withKeptTombstones() ReadOption {
+	return func(cfg *readConfig) {
+		cfg.keepTombstones = true
+	}
+}
+
+// mergeConfig returns the readConfig for merging records into the outputs; where tombstones are kept (see
+// WithTombstoneRetention)
+func (c *Compactor) mergeConfig() *readConfig {
+	cfg := newReadConfig(c.readOpts)
+	cfg.merging = true
+	return cfg
+}
+
+// sortedKeys is a set of keys matched through CompareKeys; so keys which compare equal match even if their elements
+// differ in type (e.g. the int 1 of a key extractor and the float64 1 decoded from JSON)
+type sortedKeys []Key
+
+// newSortedKeys sorts the keys and removes the duplicates
+func newSortedKeys(keys []Key) sortedKeys {
+	sort.Slice(keys, func(i, j int) bool { return CompareKeys(keys[i], keys[j]) < 0 })
+	res := sortedKeys{}
+	for _, key := range keys {
+		if len(res) == 0 || CompareKeys(res[len(res)-1], key) != 0 {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// contains reports if a key comparing equal to key is in the set
+func (s sortedKeys) contains(key Key) bool {
+	i := sort.Search(len(s), func(i int) bool { return CompareKeys(s[i], key) >= 0 })
+	return i < len(s) && CompareKeys(s[i], key) == 0
+}
+
+// notTombstoneObject is a predicate removing the tombstone objects (see WithTombstonePrefix)
+func (cfg *readConfig) notTombstoneObject(objAttr *storage.ObjectAttrs) bool {
+	return cfg.tombstonePrefix == "" || !strings.HasPrefix(objAttr.Name, cfg.tombstonePrefix)
+}
+
+// loadTombstones reads the keys of the tombstone objects, unless they are already loaded, and returns the objects read
+func (cfg *readConfig) loadTombstones(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	new func() interface{},
+) ([]*storage.ObjectAttrs, error) {
+	if cfg.tombstonePrefix == "" || cfg.tombstoneKeys != nil {
+		return nil, nil
+	}
+	objects, err := listObjects(ctx, bucket, cfg.tombstonePrefix, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list tombstones")
+	}
+
+	var keys []Key
+	for _, objAttr := range objects {
+		reader, err := newObjectReader(ctx, bucket, objAttr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open tombstones %s", objAttr.Name)
+		}
+		it := cfg.unorderedDecoder(objAttr, reader, new)
+		var rec interface{}
+		for rec, err = it(); err == nil; rec, err = it() {
+			keys = append(keys, cfg.tombstoneKey(rec))
+		}
+		reader.Close()
+		if err != iterator.ErrIteratorStop {
+			return nil, errors.Wrapf(err, "failed to read tombstones %s", objAttr.Name)
+		}
+	}
+	cfg.tombstoneKeys = newSortedKeys(keys)
+	return objects, nil
+}
+
+// tombstoned removes the tombstones (unless kept) and the records they delete from the sorted records; counting the
+// deleted records (not the tombstones) in deleted unless it is nil
+func (cfg *readConfig) tombstoned(it iterator.RecordIterator, deleted *int64) iterator.RecordIterator {
+	if cfg.tombstoneKey == nil || (cfg.isTombstone == nil && len(cfg.tombstoneKeys) == 0) {
+		return it
+	}
+
+	isTombstone := func(rec interface{}) bool {
+		return cfg.isTombstone != nil && cfg.isTombstone(rec)
+	}
+	now := time.Now()
+	kept := func(tombstone interface{}) bool {
+		return cfg.keepTombstones || (cfg.merging && (cfg.tombstoneRetention == nil || cfg.tombstoneRetention(tombstone, now)))
+	}
+	var group []interface{} // Records of the current key; returned once we know that the key isn't deleted
+	var tombstones []interface{}
+	var groupKey Key
+	order := 0 // The direction of the keys; see keyOrder
+	var next interface{}
+	var nextErr error
+	started := false
+	return func() (interface{}, error) {
+		if !started {
+			next, nextErr = it()
+			started = true
+		}
+		for len(group) == 0 {
+			if nextErr != nil {
+				return nil, nextErr
+			}
+
+			previous := groupKey
+			groupKey = cfg.tombstoneKey(next)
+			if cfg.isTombstone != nil && previous != nil {
+				var err error
+				if order, err = keyOrder(order, previous, groupKey); err != nil {
+					nextErr = err
+					return nil, err
+				}
+			}
+			removed := cfg.tombstoneKeys.contains(groupKey)
+			for nextErr == nil && CompareKeys(cfg.tombstoneKey(next), groupKey) == 0 {
+				if isTombstone(next) {
+					removed = true
+					if kept(next) {
+						tombstones = append(tombstones, next)
+					}
+				} else {
+					group = append(group, next)
+				}
+				next, nextErr = it()
+			}
+			if removed {
+				if deleted != nil {
+					*deleted += int64(len(group))
+				}
+				group, tombstones = tombstones, nil
+			}
+		}
+
+		rec := group[0]
+		group = group[1:]
+		return rec, nil
+	}
+}
+
+// keyOrder checks that the key follows the previous key in the direction (1 ascending, -1 descending) of the keys so
+// far; 0 if unknown yet. A key going back might repeat an earlier key which a tombstone then fails to delete. The
+// direction is returned.
+func keyOrder(direction int, previous, key Key) (int, error) {
+	c := CompareKeys(key, previous)
+	if c > 0 {
+		c = 1
+	} else if c < 0 {
+		c = -1
+	}
+	if direction == 0 {
+		direction = c
+	}
+	if c == 0 || c != direction {
+		return direction, errors.Wrapf(ErrTombstoneKeyOrder, "key %v after %v", key, previous)
+	}
+	return direction, nil
+}
+
+// withTombstones reads the tombstone objects (see WithTombstonePrefix) and returns a copy of the Compactor applying
+// them; and the objects read. Without tombstone objects the Compactor itself is returned.
+func (c *Compactor) withTombstones(ctx context.Context) (*Compactor, []*storage.ObjectAttrs, error) {
+	cfg := newReadConfig(c.readOpts)
+	objects, err := cfg.loadTombstones(ctx, c.bucket, c.newer)
+	if err != nil || len(objects) == 0 {
+		return c, nil, err
+	}
+	run := *c
+	run.readOpts = append(c.readOpts[:len(c.readOpts):len(c.readOpts)], withTombstoneKeys(cfg.tombstoneKeys))
+	run.tombstones = objects
+	return &run, objects, nil
+}
+
+// hasTombstones reports if there are any tombstone objects; without reading them
+func (c *Compactor) hasTombstones(ctx context.Context) (bool, error) {
+	cfg := newReadConfig(c.readOpts)
+	if cfg.tombstonePrefix == "" {
+		return false, nil
+	}
+	objects, err := listObjects(ctx, c.bucket, cfg.tombstonePrefix, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to list tombstones")
+	}
+	return len(objects) > 0, nil
+}
+
+// removeTombstones removes the tombstone objects, at the generation read, once they have been applied to all folders
+// of their scope by compacting the prefix with the compactors (e.g. the levels of a TieredCompactor). Tombstone objects
+// which have been overwritten since they were read are left for the next Compact.
+func (c *Compactor) removeTombstones(
+	ctx context.Context,
+	prefix string,
+	folders []*FolderResult,
+	tombstones []*storage.ObjectAttrs,
+	compactors []*Compactor,
+) ([]string, error) {
+	if !strings.HasPrefix(c.tombstoneScope, prefix) {
+		return nil, nil // Folders outside the prefix haven't been compacted
+	}
+	for _, res := range folders {
+		if res.Skipped || res.Err != nil {
+			return nil, nil
+		}
+	}
+	for _, compactor := range compactors {
+		if applied, err := compactor.tombstonesApplied(ctx, tombstones); err != nil || !applied {
+			return nil, err
+		}
+	}
+
+	removed := []string{}
+	for _, objAttr := range tombstones {
+		err := c.bucket.Object(objAttr.Name).If(storage.Conditions{GenerationMatch: objAttr.Generation}).Delete(ctx)
+		if isPreconditionFailed(err) || err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return removed, errors.Wrapf(err, "failed to remove tombstones %s", objAttr.Name)
+		}
+		removed = append(removed, objAttr.Name)
+	}
+	return removed, nil
+}
+
+// tombstonesApplied relists the scope of the tombstones and reports if every output has been written with them applied
+// (see compactionRecord) and no folder has sources left which weren't compacted; e.g. sources written while compacting
+// were never merged with them.
+func (c *Compactor) tombstonesApplied(ctx context.Context, tombstones []*storage.ObjectAttrs) (bool, error) {
+	listings, err := c.listFolders(ctx, c.tombstoneScope, true)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to list the scope of the tombstones")
+	}
+	for _, listing := range listings {
+		if len(listing.Sources) > 0 {
+			return false, nil
+		}
+		for _, objAttr := range listing.Outputs {
+			record := listing.records[objAttr.Metadata[compactionIDMetadata]]
+			if record == nil || !recordsTombstones(record, tombstones) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// recordsTombstones reports if the tombstone objects, at the generation read, were applied to the outputs of the record
+func recordsTombstones(record *compactionRecord, tombstones []*storage.ObjectAttrs) bool {
+	applied := map[sourceGeneration]bool{}
+	for _, o := range record.Tombstones {
+		applied[sourceGeneration{o.Name, o.Generation}] = true
+	}
+	for _, objAttr := range tombstones {
+		if !applied[sourceGeneration{objAttr.Name, objAttr.Generation}] {
+			return false
+		}
+	}
+	return true
+}
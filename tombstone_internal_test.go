@@ -0,0 +1,203 @@
+package gcsext
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/kvanticoss/goutils/iterator"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	raw "google.golang.org/api/storage/v1"
+)
+
+func isDeleted(r interface{}) bool { return r.(*plainRecord).Value == "deleted" }
+
+func TestTombstones(t *testing.T) {
+	cfg := newReadConfig([]ReadOption{withCompare(comparePlainRecords), WithTombstones(plainKey, isDeleted)})
+	it, err := cfg.sorted([]iterator.RecordIterator{
+		versionedRecords(plainRecord{1, "a"}, plainRecord{2, "a"}, plainRecord{2, "b"}, plainRecord{4, "deleted"}),
+		versionedRecords(plainRecord{2, "deleted"}, plainRecord{3, "a"}, plainRecord{4, "a"}),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []plainRecord{{1, "a"}, {3, "a"}}, collectRecords(t, it))
+}
+
+func TestTombstonesAfterLastWriteWins(t *testing.T) {
+	version := func(r interface{}) Key { return Key{r.(*plainRecord).Value} }
+	cfg := newReadConfig([]ReadOption{
+		withCompare(comparePlainRecords),
+		WithTombstones(plainKey, func(r interface{}) bool { return r.(*plainRecord).Value[0] == 'd' }),
+		WithLastWriteWins(plainKey, version),
+	})
+
+	// Values are versions; "d..." are deletions
+	it, err := cfg.sorted([]iterator.RecordIterator{
+		versionedRecords(plainRecord{1, "a"}, plainRecord{2, "e"}),
+		versionedRecords(plainRecord{1, "d"}, plainRecord{2, "d"}),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []plainRecord{{2, "e"}}, collectRecords(t, it), "expected records newer than the tombstone to survive it")
+}
+
+func TestTombstoneKeysCountDeleted(t *testing.T) {
+	var deleted int64
+	cfg := newReadConfig([]ReadOption{
+		WithTombstonePrefix("tombstones/", plainKey),
+		withTombstoneKeys(newSortedKeys([]Key{{5}, {2.0}})),
+	})
+	it := cfg.tombstoned(versionedRecords(plainRecord{1, "a"}, plainRecord{2, "a"}, plainRecord{2, "b"}, plainRecord{3, "a"}), &deleted)
+	assert.Equal(t, []plainRecord{{1, "a"}, {3, "a"}}, collectRecords(t, it))
+	assert.Equal(t, int64(2), deleted)
+}
+
+func TestTombstoneObjects(t *testing.T) {
+	keys := newSortedKeys([]Key{{"a", 1}, {1}, {"a", 1.0}})
+	assert.Equal(t, sortedKeys{{1}, {"a", 1}}, keys)
+	assert.True(t, keys.contains(Key{1.0}), "expected keys comparing equal to match")
+	assert.True(t, keys.contains(Key{"a", uint8(1)}))
+	assert.False(t, keys.contains(Key{"1"}))
+	assert.False(t, keys.contains(Key{"a"}))
+
+	cfg := newReadConfig([]ReadOption{WithTombstonePrefix("data/tombstones/", plainKey)})
+	assert.False(t, cfg.notTombstoneObject(&storage.ObjectAttrs{Name: "data/tombstones/user-1.json"}))
+	assert.True(t, cfg.notTombstoneObject(&storage.ObjectAttrs{Name: "data/a/1.json"}))
+	assert.True(t, newReadConfig(nil).notTombstoneObject(&storage.ObjectAttrs{Name: "data/tombstones/user-1.json"}))
+
+	c := NewCompactor(nil, nil, WithReadOptions(WithTombstonePrefix("data/tombstones/", plainKey)))
+	assert.False(t, c.sourcePredicate()(&storage.ObjectAttrs{Name: "data/tombstones/user-1.json"}))
+}
+
+func TestTombstonesAreKeptUntilAppliedEverywhere(t *testing.T) {
+	c := NewCompactor(nil, nil)
+	folders := []*FolderResult{{Folder: "data/a"}, {Folder: "data/b", Skipped: true, Leased: true}}
+	removed, err := c.removeTombstones(context.Background(), "", folders, []*storage.ObjectAttrs{{Name: "data/tombstones/1.json", Generation: 1}}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+}
+
+func tombstoneCompactor(bucket *storage.BucketHandle, opts ...CompactionOption) *Compactor {
+	return NewCompactor(bucket, func() interface{} { return &plainRecord{} }, append([]CompactionOption{
+		WithDestination("sorted.json"),
+		WithSourceRemoval(),
+		WithReadOptions(WithComparator(comparePlainRecords), WithTombstonePrefix("t/", plainKey)),
+	}, opts...)...)
+}
+
+func TestTombstonesAreKeptUntilTheirScopeIsCompacted(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("a/f/1.json", 1, 2)
+	fake.putKeys("b/g/1.json", 2, 3)
+	fake.putKeys("t/1.json", 2)
+
+	res, err := tombstoneCompactor(bucket).Compact(ctx, "a/")
+	require.NoError(t, err)
+	assert.Empty(t, res.Tombstones)
+	assert.Equal(t, []int{1}, fake.keys(t, "a/f/sorted.json"))
+	assert.NotNil(t, fake.attrs("t/1.json"), "expected the tombstones to be kept for b/")
+
+	res, err = tombstoneCompactor(bucket).Compact(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"t/1.json"}, res.Tombstones)
+	assert.Equal(t, []int{3}, fake.keys(t, "b/g/sorted.json"))
+
+	// A Compact covering the scope removes them
+	fake.putKeys("t/2.json", 3)
+	res, err = tombstoneCompactor(bucket, WithTombstoneScope("b/")).Compact(ctx, "b/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"t/2.json"}, res.Tombstones)
+	assert.Equal(t, []int{}, fake.keys(t, "b/g/sorted.json"))
+}
+
+func TestTombstonesAreKeptForSourcesWrittenWhileCompacting(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	fake.putKeys("f/1.json", 1, 2)
+	fake.putKeys("t/1.json", 2)
+	late := false
+	fake.hook = func(op, name string) int {
+		if op == "insert" && name == "f/sorted.json" && !late {
+			late = true
+			// The hook is called with the fake locked; store directly
+			fake.store(&raw.Object{Name: "f/2.json"}, []byte("{\"Key\":2}\n"))
+		}
+		return 0
+	}
+
+	res, err := tombstoneCompactor(bucket).Compact(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, res.Tombstones, "expected the tombstones to be kept for the late source")
+	assert.Equal(t, []int{1}, fake.keys(t, "f/sorted.json"))
+
+	res, err = tombstoneCompactor(bucket).Compact(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"t/1.json"}, res.Tombstones)
+	assert.Equal(t, []int{1}, fake.keys(t, "f/sorted.json"))
+	names, _ := withoutRecords(fake.names())
+	assert.Equal(t, []string{"f/sorted.json"}, names)
+}
+
+func TestTombstonesAreRemovedOnceAppliedWhateverTheServerClock(t *testing.T) {
+	for _, skew := range []time.Duration{-time.Hour, time.Hour} {
+		ctx := context.Background()
+		fake, bucket := newFakeGCS(t)
+		fake.putKeys("a/f/1.json", 1, 2)
+		_, err := tombstoneCompactor(bucket).Compact(ctx, "a/")
+		require.NoError(t, err)
+
+		fake.skew = skew
+		fake.putKeys("t/1.json", 2)
+		fake.putKeys("a/f/2.json", 3)
+		res, err := tombstoneCompactor(bucket, WithTombstoneScope("a/")).Compact(ctx, "a/")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"t/1.json"}, res.Tombstones, "skew %v", skew)
+		assert.Equal(t, []int{1, 3}, fake.keys(t, "a/f/sorted.json"), "skew %v", skew)
+	}
+}
+
+func TestTombstonesNeedRecordsSortedByKey(t *testing.T) {
+	cfg := newReadConfig([]ReadOption{WithTombstones(plainKey, isDeleted)})
+	it := cfg.tombstoned(versionedRecords(plainRecord{3, "a"}, plainRecord{2, "a"}, plainRecord{1, "a"}), nil)
+	assert.Equal(t, []plainRecord{{3, "a"}, {2, "a"}, {1, "a"}}, collectRecords(t, it), "expected descending keys to be fine")
+
+	it = cfg.tombstoned(versionedRecords(plainRecord{1, "a"}, plainRecord{2, "deleted"}, plainRecord{1, "b"}), nil)
+	rec, err := it()
+	require.NoError(t, err)
+	assert.Equal(t, plainRecord{1, "a"}, *rec.(*plainRecord))
+	_, err = it()
+	assert.True(t, errors.Is(err, ErrTombstoneKeyOrder), "unexpected error %v", err)
+}
+
+func TestTombstonesAreKeptInOutputsUntilTheirRetention(t *testing.T) {
+	ctx := context.Background()
+	fake, bucket := newFakeGCS(t)
+	fake.put("f/1.json", `{"Key":1,"Value":"a"}
+{"Key":2,"Value":"deleted"}
+`, nil)
+	compactor := func(opts ...ReadOption) *Compactor {
+		return NewCompactor(bucket, func() interface{} { return &plainRecord{} },
+			WithDestination("sorted.json"),
+			WithSourceRemoval(),
+			WithReadOptions(append([]ReadOption{WithComparator(comparePlainRecords), WithTombstones(plainKey, isDeleted)}, opts...)...),
+		)
+	}
+
+	_, err := compactor().Compact(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, fake.keys(t, "f/sorted.json"), "expected the tombstone to be kept")
+
+	// Older data of the key arriving late is still deleted
+	fake.putKeys("f/2.json", 2)
+	res, err := compactor().Compact(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Folders[0].Deleted)
+	assert.Equal(t, []int{1, 2}, fake.keys(t, "f/sorted.json"))
+
+	fake.putKeys("f/3.json", 3)
+	_, err = compactor(WithTombstoneRetention(KeepIf(func(interface{}) bool { return false }))).Compact(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, fake.keys(t, "f/sorted.json"), "expected the tombstone to be dropped once expired")
+}
@@ -0,0 +1,185 @@
+package gcsext
+
+import (
+	"fmt"
+
+	"github.com/kvanticoss/goutils/iterator"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// UnsortedInputMode decides what the sorted iterators do about source objects which aren't sorted themselves
+type UnsortedInputMode int
+
+const (
+	// UnsortedIgnore merges the objects as is; unsorted objects gives unsorted output. This is the default.
+	UnsortedIgnore UnsortedInputMode = iota
+	// UnsortedFail returns an *UnsortedObjectError as soon as an out of order record is found
+	UnsortedFail
+	// UnsortedExternalSort reads each object once up front to check that it is sorted. Objects found out of order are
+	// sorted through sorted runs spilled to temporary files (see WithSpillDir) while sorted objects are merged as is.
+	UnsortedExternalSort
+)
+
+// UnsortedObjectError is returned in UnsortedFail mode when a record is found to be smaller than its predecessor in the same object
+type UnsortedObjectError struct {
+	Object     string
+	Generation int64
+	Record     int64 // 1-based index of the out of order record within the object
+	Offset     int64 // Byte offset (in the decompressed object) at which the record starts; -1 if the format can't tell
+}
+
+func (e *UnsortedObjectError) Error() string {
+	return fmt.Sprintf("object %s (generation %d) is not sorted; record %d at offset %d is out of order", e.Object, e.Generation, e.Record, e.Offset)
+}
+
+// WithUnsortedInput sets how the sorted iterators handles unsorted source objects; see UnsortedInputMode.
+// SortGCSFolders always buffers and sorts all records of a folder; there UnsortedExternalSort is the same as UnsortedIgnore.
+func WithUnsortedInput(mode UnsortedInputMode) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.unsorted = mode
+	}
+}
+
+// WithSpillDir sets the directory for the temporary files of UnsortedExternalSort and of the intermediate runs of
+// IterateRecordsGloballySorted; defaults to the system temp directory
+func WithSpillDir(dir string) ReadOption {
+	return func(cfg *readConfig) {
+		cfg.spillDir = dir
+	}
+}
+
+// checkSorted returns an *UnsortedObjectError if the iterator yields a record smaller than the previous one; offset
+// reports where the last record yielded starts (see offsetDecoderFormat)
+func checkSorted(objAttr *storage.ObjectAttrs, it iterator.RecordIterator, offset func() int64, cmp compareFunc) iterator.RecordIterator {
+	var previous interface{}
+	var index int64
+	return func() (interface{}, error) {
+		rec, err := it()
+		if err != nil {
+			return rec, err
+		}
+		index++
+		if previous != nil && cmp(rec, previous) < 0 {
+			return nil, &UnsortedObjectError{Object: objAttr.Name, Generation: objAttr.Generation, Record: index, Offset: offset()}
+		}
+		previous = rec
+		return rec, nil
+	}
+}
+
+// externalSort returns an iterator of all records of the objects in sorted order; see sortedSources. The temporary files
+// are removed once the iterator is exhausted.
+func (cfg *readConfig) externalSort(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	objects []*storage.ObjectAttrs,
+	new func() interface{},
+) (iterator.RecordIterator, error) {
+	sources, cleanup, err := cfg.sortedSources(ctx, bucket, objects, new)
+	if err != nil {
+		return nil, err
+	}
+	it, err := mergeSorted(sources, cfg.comparator())
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanupWhenDone(it, cleanup), nil
+}
+
+// sortedSources returns a sorted iterator per object (in the same order). Each object is read once to check if it is
+// sorted; sorted objects are then read lazily as is while objects found out of order are sorted through sorted runs
+// backed by temporary files. cleanup removes the temporary files.
+func (cfg *readConfig) sortedSources(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	objects []*storage.ObjectAttrs,
+	new func() interface{},
+) (sources []iterator.RecordIterator, cleanup func(), err error) {
+	buffers := NewTempFileBuffers(cfg.spillDir)
+	cleanup = func() { buffers.Cleanup() }
+
+	for _, objAttr := range objects {
+		sorted, err := cfg.isSorted(ctx, bucket, objAttr, new)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if sorted {
+			sources = append(sources, cfg.lazyDecoder(ctx, bucket, objAttr, new))
+			continue
+		}
+
+		runs := newSortedRuns(buffers.New, cfg.comparator())
+		if err := runs.load(cfg.lazyDecoder(ctx, bucket, objAttr, new)); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		it, err := runs.sorted(new)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		sources = append(sources, it)
+	}
+	return sources, cleanup, nil
+}
+
+// isSorted reads through the object to check if its records are sorted. Records failing to decode are skipped; they are
+// handled (e.g. quarantined) once the object is read for real.
+func (cfg *readConfig) isSorted(
+	ctx context.Context,
+	bucket *storage.BucketHandle,
+	objAttr *storage.ObjectAttrs,
+	new func() interface{},
+) (bool, error) {
+	reader, err := newObjectReader(ctx, bucket, objAttr)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	format := cfg.formatFor(objAttr.Name)
+	var it iterator.RecordIterator
+	if lf, ok := format.(lineDecoderFormat); ok && cfg.deadLetters != nil {
+		it, _ = lf.newLineDecoder(reader, new)
+	} else {
+		it = format.NewDecoder(reader, new)
+	}
+	it = checkSorted(objAttr, cfg.requireLessers(it), func() int64 { return -1 }, cfg.comparator())
+
+	for {
+		_, err := it()
+		switch err.(type) {
+		case nil, *RecordDecodeError:
+			continue
+		case *UnsortedObjectError:
+			return false, nil
+		}
+		if err == iterator.ErrIteratorStop {
+			return true, nil
+		}
+		return false, err
+	}
+}
+
+// cleanupWhenDone calls cleanup once the iterator stops or fails
+func cleanupWhenDone(it iterator.RecordIterator, cleanup func()) iterator.RecordIterator {
+	return func() (interface{}, error) {
+		rec, err := it()
+		if err != nil {
+			cleanup()
+		}
+		return rec, err
+	}
+}
+
+// closerFunc turns a cleanup func into an io.Closer
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,90 @@
+package gcsext
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCheckSorted(t *testing.T) {
+	objAttr := &storage.ObjectAttrs{Name: "folder/a.json", Generation: 7}
+	offset := func() int64 { return 42 }
+	assert.Equal(t, []int{1, 2, 2, 5}, collectKeys(t, checkSorted(objAttr, plainRecordIterator(1, 2, 2, 5), offset, comparePlainRecords)))
+
+	it := checkSorted(objAttr, plainRecordIterator(1, 3, 2), offset, comparePlainRecords)
+	for i := 0; i < 2; i++ {
+		_, err := it()
+		require.NoError(t, err)
+	}
+	_, err := it()
+	assert.Equal(t, &UnsortedObjectError{Object: "folder/a.json", Generation: 7, Record: 3, Offset: 42}, err)
+}
+
+func TestTempFileBuffersSortUnsortedInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcsext-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	buffers := NewTempFileBuffers(dir)
+	runs := newSortedRuns(buffers.New, comparePlainRecords)
+	require.NoError(t, runs.load(plainRecordIterator(1, 4, 6)))
+	require.NoError(t, runs.load(plainRecordIterator(9, 2, 5, 3)))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.NotEmpty(t, files)
+
+	it, err := runs.sorted(func() interface{} { return &plainRecord{} })
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 9}, collectKeys(t, it))
+
+	require.NoError(t, buffers.Cleanup())
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSortedSourcesOnlySpillsUnsortedObjects(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	sorted := fake.put("folder/a.json", "{\"Key\":1}\n{\"Key\":4}\n{\"Key\":6}\n", nil)
+	unsorted := fake.put("folder/b.json", "{\"Key\":9}\n{\"Key\":2}\n{\"Key\":5}\n{\"Key\":3}\n", nil)
+
+	dir, err := ioutil.TempDir("", "gcsext-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := newReadConfig([]ReadOption{withCompare(comparePlainRecords), WithSpillDir(dir)})
+	newRecord := func() interface{} { return &plainRecord{} }
+	sources, cleanup, err := cfg.sortedSources(context.Background(), bucket, []*storage.ObjectAttrs{sorted, unsorted}, newRecord)
+	require.NoError(t, err)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 3, "expected only the runs of the unsorted object to be spilled")
+
+	assert.Equal(t, []int{1, 4, 6}, collectKeys(t, sources[0]))
+	assert.Equal(t, []int{2, 3, 5, 9}, collectKeys(t, sources[1]))
+	cleanup()
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestUnsortedFailReportsOffset(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	objAttr := fake.put("folder/a.json", "{\"Key\":1}\n{\"Key\":4}\n{\"Key\":2}\n", nil)
+
+	cfg := newReadConfig([]ReadOption{withCompare(comparePlainRecords), WithUnsortedInput(UnsortedFail)})
+	it := cfg.lazyDecoder(context.Background(), bucket, objAttr, func() interface{} { return &plainRecord{} })
+	for i := 0; i < 2; i++ {
+		_, err := it()
+		require.NoError(t, err)
+	}
+	_, err := it()
+	assert.Equal(t, &UnsortedObjectError{Object: "folder/a.json", Generation: objAttr.Generation, Record: 3, Offset: 20}, err)
+}
@@ -0,0 +1,125 @@
+package gcsext
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/kvanticoss/goutils/backoff"
+	"github.com/kvanticoss/goutils/gzip"
+	"github.com/pkg/errors"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// updateRetries is how often Update retries with a nil backoff
+const updateRetries = 5
+
+// Update replaces the content of a single (small) object with fn(old) using optimistic concurrency; useful for state
+// files, counters and small JSON indexes. The object is read at its current generation and the new content is written
+// with a GenerationMatch precondition on that generation; if the object changed in between (or we are rate limited) fn
+// is called again with the newer content after sleeping according to the backoff. A nil backoff retries up to 5 times;
+// the n'th retry after sleeping 100ms plus a random number of whole seconds below 2^n - 1 (see backoff.RandExpBackoff).
+// Sleeping stops as soon as the context is done. The backoff isn't modified.
+//
+// If the object doesn't exist fn is called with a nil old and the object is created with a DoesNotExist precondition;
+// an existing but empty object gives a non-nil, empty old. Objects with the .gz suffix are gunzipped before calling fn
+// and the new content is gzipped. If fn returns an error the object is left as is and the error is returned.
+//
+// The attributes of the written object are returned.
+func Update(
+	ctx context.Context,
+	obj *storage.ObjectHandle,
+	fn func(old []byte) ([]byte, error),
+	bo *backoff.RandExpBackoff,
+) (*storage.ObjectAttrs, error) {
+	if bo == nil {
+		// RandExpBackoff sleeps until its attempt exceeds the max attempts; 4 gives 5 retries
+		bo = bo.WithMaxAttempts(updateRetries - 1).WithMinBackoff(100 * time.Millisecond)
+	} else {
+		copied := *bo
+		bo = &copied
+	}
+
+	for attempt := 1; ; attempt++ {
+		old, conditions, err := readForUpdate(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := fn(old)
+		if err != nil {
+			return nil, err
+		}
+		objAttr, err := writeUpdate(ctx, obj.If(conditions), updated)
+		if err == nil {
+			return objAttr, nil
+		}
+		if !isRetryable(err) {
+			return nil, errors.Wrapf(err, "failed to write %s", obj.ObjectName())
+		}
+
+		var boErr error
+		if bo, boErr = sleepAndIncr(ctx, bo); boErr != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, errors.Wrapf(err, "failed to update %s even after %d attempts; aborting", obj.ObjectName(), attempt)
+		}
+	}
+}
+
+// readForUpdate returns the (uncompressed) content of the object and the conditions for replacing exactly what was
+// read; a nil content and DoesNotExist if the object doesn't exist.
+func readForUpdate(ctx context.Context, obj *storage.ObjectHandle) ([]byte, storage.Conditions, error) {
+	r, err := obj.NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, storage.Conditions{DoesNotExist: true}, nil
+	}
+	if err != nil {
+		return nil, storage.Conditions{}, errors.Wrapf(err, "failed to read %s", obj.ObjectName())
+	}
+	defer r.Close()
+
+	conditions := storage.Conditions{GenerationMatch: r.Attrs.Generation}
+	content, err := readAllDecompressed(obj.ObjectName(), r)
+	if err != nil {
+		return nil, conditions, errors.Wrapf(err, "failed to read %s", obj.ObjectName())
+	}
+	return content, conditions, nil
+}
+
+// readAllDecompressed reads all of r; gunzipping it if name has the .gz suffix. Never returns nil content.
+func readAllDecompressed(name string, r io.Reader) ([]byte, error) {
+	if strings.HasSuffix(name, ".gz") {
+		gzr, err := gzip.NewReader(ioutil.NopCloser(r))
+		if err == io.EOF {
+			return []byte{}, nil // An empty object; not even gzip headers
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer gzr.Close()
+		r = gzr
+	}
+	content, err := ioutil.ReadAll(r)
+	if content == nil {
+		content = []byte{}
+	}
+	return content, err
+}
+
+// writeUpdate writes the content to the object (with its conditions); gzipped if the object has the .gz suffix
+func writeUpdate(ctx context.Context, obj *storage.ObjectHandle, content []byte) (*storage.ObjectAttrs, error) {
+	gcsWriter := newAbortableWriter(ctx, obj)
+	w := compressed(gcsWriter)
+	if _, err := w.Write(content); err != nil {
+		gcsWriter.Abort()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return gcsWriter.Attrs(), nil
+}
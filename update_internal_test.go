@@ -0,0 +1,114 @@
+package gcsext
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/kvanticoss/goutils/gzip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	raw "google.golang.org/api/storage/v1"
+)
+
+func TestReadAllDecompressed(t *testing.T) {
+	compressed := &bytes.Buffer{}
+	w := gzip.NewWriter(compressed)
+	_, err := w.Write([]byte(`{"count":1}`))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	content, err := readAllDecompressed("state/counter.json.gz", compressed)
+	require.NoError(t, err)
+	assert.Equal(t, `{"count":1}`, string(content))
+
+	content, err = readAllDecompressed("state/counter.json", bytes.NewBufferString(`{"count":2}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"count":2}`, string(content))
+}
+
+func TestReadAllDecompressedEmpty(t *testing.T) {
+	for _, name := range []string{"state/empty.json", "state/empty.json.gz"} {
+		content, err := readAllDecompressed(name, &bytes.Buffer{})
+		require.NoError(t, err)
+		assert.NotNil(t, content, "expected existing but empty objects to be distinguishable from missing ones")
+		assert.Empty(t, content)
+	}
+}
+
+// increment adds one to the counter in the content; starting at 1 for a missing or empty object
+func increment(calls *[][]byte) func(old []byte) ([]byte, error) {
+	return func(old []byte) ([]byte, error) {
+		*calls = append(*calls, old)
+		n := 0
+		if len(old) > 0 {
+			var err error
+			if n, err = strconv.Atoi(string(old)); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+}
+
+func TestUpdateCreatesMissingObjects(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	calls := [][]byte{}
+	objAttr, err := Update(context.Background(), bucket.Object("state/counter"), increment(&calls), noBackoff(0))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{nil}, calls, "expected a missing object to give a nil old")
+	assert.Equal(t, fake.attrs("state/counter").Generation, objAttr.Generation)
+
+	_, err = Update(context.Background(), bucket.Object("state/counter"), increment(&calls), noBackoff(0))
+	require.NoError(t, err)
+	content, _ := fake.content("state/counter")
+	assert.Equal(t, "2", content)
+}
+
+func TestUpdateRetriesWhenTheObjectChanged(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.put("state/counter.gz", "", nil)
+	conflicts := 0
+	fake.hook = func(op, name string) int {
+		if op == "insert" && conflicts == 0 {
+			conflicts++
+			// Another writer got there first; the hook is called with the fake locked so store directly
+			compressed := &bytes.Buffer{}
+			w := gzip.NewWriter(compressed)
+			w.Write([]byte("41"))
+			w.Close()
+			fake.store(&raw.Object{Name: name}, compressed.Bytes())
+			return http.StatusPreconditionFailed
+		}
+		return 0
+	}
+
+	calls := [][]byte{}
+	_, err := Update(context.Background(), bucket.Object("state/counter.gz"), increment(&calls), noBackoff(1))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{{}, []byte("41")}, calls, "expected fn to be called again with the newer content")
+	r, err := bucket.Object("state/counter.gz").NewReader(context.Background())
+	require.NoError(t, err)
+	defer r.Close()
+	content, err := readAllDecompressed("state/counter.gz", r)
+	require.NoError(t, err)
+	assert.Equal(t, "42", string(content))
+}
+
+func TestUpdateGivesUpAfterTheRetries(t *testing.T) {
+	fake, bucket := newFakeGCS(t)
+	fake.hook = func(op, name string) int {
+		if op == "insert" {
+			return http.StatusPreconditionFailed
+		}
+		return 0
+	}
+
+	calls := [][]byte{}
+	// Like the nil backoff but without sleeping
+	_, err := Update(context.Background(), bucket.Object("state/counter"), increment(&calls), noBackoff(updateRetries-1))
+	assert.Error(t, err)
+	assert.Len(t, calls, updateRetries+1, "expected the first attempt and %d retries", updateRetries)
+}